@@ -0,0 +1,175 @@
+// Package admin is http interface for inspecting amp broker and sessions.
+//
+// Endpoints (relative to the router):
+//
+//	GET    /topics            list topics
+//	GET    /topics/{name}     current cached messages of the topic
+//	DELETE /topics/{name}     evict topic
+//	GET    /sessions          list sessions
+//	DELETE /sessions/{no}     close session
+//
+// Requests are authenticated with the Authenticator passed to Mount,
+// all requests are refused without it.
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/session"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+)
+
+// Topic stats
+type Topic struct {
+	Name        string    `json:"name"`
+	Subscribers int       `json:"subscribers"`
+	CacheSize   int       `json:"cacheSize"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Message is cached topic message
+type Message struct {
+	Header json.RawMessage `json:"header"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Authenticator returns true if request is allowed to use admin interface.
+type Authenticator func(*http.Request) bool
+
+// Token allows requests with the "Authorization: Bearer <token>" header.
+// Empty token allows nothing.
+func Token(token string) Authenticator {
+	want := []byte("Bearer " + token)
+	return func(r *http.Request) bool {
+		got := []byte(r.Header.Get("Authorization"))
+		return token != "" && subtle.ConstantTimeCompare(got, want) == 1
+	}
+}
+
+type admin struct {
+	broker   *broker.Broker
+	sessions *session.Sessions
+	auth     Authenticator
+}
+
+// Mount adds admin handlers to the router.
+// Example:
+//
+//	admin.Mount(httpi.Subrouter("/amp"), broker, sessions, admin.Token(token))
+func Mount(r *httpi.Router, b *broker.Broker, s *session.Sessions, auth Authenticator) {
+	a := &admin{broker: b, sessions: s, auth: auth}
+	r.Route("/topics", a.authenticate(a.topics)).Methods("GET")
+	r.RouteVars("/topics/{name:.+}", a.authenticateVars(a.topic)).Methods("GET")
+	r.RouteVars("/topics/{name:.+}", a.authenticateVars(a.evict)).Methods("DELETE")
+	r.Route("/sessions", a.authenticate(a.listSessions)).Methods("GET")
+	r.RouteVars("/sessions/{no:[0-9]+}", a.authenticateVars(a.closeSession)).Methods("DELETE")
+}
+
+func (a *admin) allowed(w http.ResponseWriter, r *http.Request) bool {
+	if a.auth != nil && a.auth(r) {
+		return true
+	}
+	log.S("remoteAddr", r.RemoteAddr).S("method", r.Method).S("url", r.URL.Path).Info("admin unauthorized")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+func (a *admin) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.allowed(w, r) {
+			h(w, r)
+		}
+	}
+}
+
+func (a *admin) authenticateVars(h func(http.ResponseWriter, *http.Request, map[string]string)) func(http.ResponseWriter, *http.Request, map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+		if a.allowed(w, r) {
+			h(w, r, vars)
+		}
+	}
+}
+
+func (a *admin) topics(w http.ResponseWriter, r *http.Request) {
+	var ts []*Topic
+	for _, t := range a.broker.TopicStats() {
+		ts = append(ts, &Topic{
+			Name:        t.Name,
+			Subscribers: len(t.Subscribers),
+			CacheSize:   t.CacheSize,
+			UpdatedAt:   t.UpdatedAt,
+		})
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	writeJSON(w, ts)
+}
+
+func (a *admin) topic(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	name := vars["name"]
+	msgs := a.broker.Replay(name)
+	if len(msgs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	var ms []*Message
+	for _, m := range msgs {
+		ms = append(ms, message(m))
+	}
+	writeJSON(w, ms)
+}
+
+func (a *admin) evict(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	name := vars["name"]
+	if !a.broker.Evict(name) {
+		http.NotFound(w, r)
+		return
+	}
+	log.S("topic", name).S("remoteAddr", r.RemoteAddr).Info("admin evict topic")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) listSessions(w http.ResponseWriter, r *http.Request) {
+	ss := a.sessions.Stats()
+	sort.Slice(ss, func(i, j int) bool { return ss[i].No < ss[j].No })
+	writeJSON(w, ss)
+}
+
+func (a *admin) closeSession(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	no, err := strconv.ParseUint(vars["no"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.sessions.Close(no) {
+		http.NotFound(w, r)
+		return
+	}
+	log.I("no", int(no)).S("remoteAddr", r.RemoteAddr).Info("admin close session")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// message splits marshaled message into header and body
+func message(m *amp.Msg) *Message {
+	parts := bytes.SplitN(m.Marshal(), []byte{10}, 2)
+	msg := &Message{Header: parts[0]}
+	if len(parts) > 1 && json.Valid(parts[1]) {
+		msg.Body = parts[1]
+	}
+	return msg
+}
+
+func writeJSON(w http.ResponseWriter, o interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(o); err != nil {
+		log.Error(err)
+	}
+}
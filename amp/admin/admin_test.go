@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/session"
+	"github.com/minus5/svckit/httpi"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopRequester struct{}
+
+func (nopRequester) Send(amp.Subscriber, *amp.Msg)   {}
+func (nopRequester) Cancel(amp.Subscriber, *amp.Msg) {}
+func (nopRequester) Unsubscribe(amp.Subscriber)      {}
+func (nopRequester) Wait()                           {}
+
+func TestAdmin(t *testing.T) {
+	log.Discard()
+	b := broker.New(nil, nil)
+	in := make(chan *amp.Msg, 1)
+	b.Consume(in)
+	s := session.Factory(context.Background(), b, nopRequester{}, nil)
+	r := httpi.NewRouter().NoDebug()
+	Mount(r, b, s, Token("secret"))
+	h := r.Handler()
+
+	doToken := func(method, url, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	do := func(method, url string) *httptest.ResponseRecorder {
+		return doToken(method, url, "secret")
+	}
+	assert.Equal(t, http.StatusUnauthorized, doToken("GET", "/topics", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, doToken("GET", "/sessions", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, doToken("DELETE", "/sessions/1", "").Code)
+
+	in <- amp.NewPublish("t", "p", 1, amp.Full, map[string]int{"a": 1})
+	var ts []*Topic
+	require.Eventually(t, func() bool {
+		ts = nil
+		rec := do("GET", "/topics")
+		json.Unmarshal(rec.Body.Bytes(), &ts)
+		return len(ts) == 1 && ts[0].CacheSize == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "t/p", ts[0].Name)
+
+	rec := do("GET", "/topics/t/p")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var ms []*Message
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ms))
+	require.Len(t, ms, 1)
+	assert.JSONEq(t, `{"a":1}`, string(ms[0].Body))
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/topics/t/p").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/topics/t/p").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/sessions/1").Code)
+	assert.Equal(t, "null\n", do("GET", "/sessions").Body.String())
+	close(in)
+}
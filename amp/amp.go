@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
@@ -33,6 +34,7 @@ const (
 	Current                // request for current state of a stream
 	Event                  // event stream, no cache
 	Meta                   // set session metadata
+	Cancel                 // cancel previously sent request
 )
 
 // Topic update types
@@ -58,6 +60,12 @@ const (
 	Replay                // replay of the previously sent message
 )
 
+// Response types
+const (
+	Terminal uint8 = iota // last (or the only) response on the request
+	Partial               // one of the many responses, more will follow
+)
+
 // supported compression types
 const (
 	CompressionNone uint8 = iota
@@ -70,8 +78,8 @@ const (
 )
 
 var (
-	compressionLenLimit = 8 * 1024 // do not compress messages smaller than
-	separator           = []byte{10}
+	compressionLenLimit int64 = 8 * 1024 // do not compress messages smaller than, accessed atomically
+	separator                 = []byte{10}
 )
 
 // Subscriber is the interface for subscribing to the topics
@@ -103,15 +111,16 @@ type Msg struct {
 	Replay         uint8             `json:"l,omitempty" backend:"l,omitempty"` // is this a re-play message (repeated)
 	Subscriptions  map[string]int64  `json:"b,omitempty" backend:"b,omitempty"` // topics to subscribe to
 	CacheDepth     int               `json:"d,omitempty" backend:"d,omitempty"` // cache depth for append update type messages
+	Timeout        int64             `json:"o,omitempty" backend:"o,omitempty"` // request timeout in milliseconds
+	ResponseType   uint8             `json:"a,omitempty" backend:"a,omitempty"` // partial or terminal response
 	Meta           map[string]string `json:"m,omitempty" backend:"m,omitempty"` // client session metadata
 	BackendHeaders map[string]string `json:"-" backend:"h,omitempty"`           // exclusive for communication between backend services
 
-	body          []byte
-	noCompression bool
-	payloads      map[uint8][]byte
-	src           BodyMarshaler
-	topic         string
-	path          string
+	body     []byte
+	payloads map[payloadKey]payload
+	src      BodyMarshaler
+	topic    string
+	path     string
 
 	sync.Mutex
 }
@@ -129,7 +138,11 @@ func Parse(buf []byte) *Msg {
 }
 
 // ParseFromBackend parses the message received from another backend service.
+// MessagePack encoded messages (MarshalForBackendMsgpack) are recognized.
 func ParseFromBackend(buf []byte) *Msg {
+	if isMsgpack(buf) {
+		return parseMsgpack(buf, true)
+	}
 	return parse(buf, backendSerializer)
 }
 
@@ -189,23 +202,24 @@ func Undeflate(data []byte) []byte {
 
 // Marshal the message that will be sent to the client.
 func (m *Msg) Marshal() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, jsonSerializer)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, EncodingJSON, false)
 	return buf
 }
 
 // MarshalForBackend is used when marshaling Msg for backend to backend communication.
 func (m *Msg) MarshalForBackend() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, backendSerializer)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, EncodingJSON, true)
 	return buf
 }
 
 // MarshalDeflate packs and compress message that will be sent to the client.
 func (m *Msg) MarshalDeflate() ([]byte, bool) {
-	return m.marshal(CompressionDeflate, CompatibilityVersionDefault, jsonSerializer)
+	return m.marshal(CompressionDeflate, CompatibilityVersionDefault, EncodingJSON, false)
 }
 
 // marshal encodes message into []byte
-func (m *Msg) marshal(supportedCompression, version uint8, serializer jsoniter.API) ([]byte, bool) {
+// Payload is cached for each combination of compression, version, encoding and backend.
+func (m *Msg) marshal(supportedCompression, version, encoding uint8, backend bool) ([]byte, bool) {
 	if version == CompatibilityVersion1 {
 		if m.UpdateType == BurstStart || m.UpdateType == BurstEnd {
 			// unsuported mesage types in this version
@@ -215,41 +229,42 @@ func (m *Msg) marshal(supportedCompression, version uint8, serializer jsoniter.A
 	m.Lock()
 	defer m.Unlock()
 
-	compression := supportedCompression
-	if m.noCompression {
-		compression = CompressionNone
-	}
 	// check if we already have payload
-	key := payloadKey(compression, version)
-	if payload, ok := m.payloads[key]; ok {
-		return payload, compression != CompressionNone
+	key := payloadKey{compression: supportedCompression, version: version, encoding: encoding, backend: backend}
+	if p, ok := m.payloads[key]; ok {
+		return p.buf, p.compressed
 	}
-
-	payload := m.payload(version, serializer)
-	// decide wather we need compression
-	if len(payload) < compressionLenLimit {
-		m.noCompression = true
-		compression = CompressionNone
+	if m.payloads == nil {
+		m.payloads = make(map[payloadKey]payload)
 	}
-	// compress
-	if compression == CompressionDeflate {
-		payload = deflate(payload)
+	// uncompressed payload is base for all compressions
+	rawKey := key
+	rawKey.compression = CompressionNone
+	raw, ok := m.payloads[rawKey]
+	if !ok {
+		raw = payload{buf: m.payload(version, encoding, backend)}
+		m.payloads[rawKey] = raw
 	}
-	// store payload
-	if m.payloads == nil {
-		m.payloads = make(map[uint8][]byte)
+	p := raw
+	// decide wather we need compression
+	if supportedCompression != CompressionNone && int64(len(raw.buf)) >= atomic.LoadInt64(&compressionLenLimit) {
+		p = payload{buf: m.compress(supportedCompression, raw.buf), compressed: true}
 	}
-	m.payloads[key] = payload
-
-	return payload, compression != CompressionNone
+	m.payloads[key] = p
+	return p.buf, p.compressed
 }
 
-func (m *Msg) payload(version uint8, serializer jsoniter.API) []byte {
+func (m *Msg) payload(version, encoding uint8, backend bool) []byte {
+	if encoding == EncodingMsgpack {
+		return m.msgpackPayload(backend)
+	}
 	var header []byte
 	if version == CompatibilityVersion1 {
 		header = m.marshalV1header()
+	} else if backend {
+		header, _ = backendSerializer.Marshal(m)
 	} else {
-		header, _ = serializer.Marshal(m)
+		header, _ = jsonSerializer.Marshal(m)
 	}
 	buf := bytes.NewBuffer(header)
 	buf.Write(separator)
@@ -263,8 +278,17 @@ func (m *Msg) payload(version uint8, serializer jsoniter.API) []byte {
 	return buf.Bytes()
 }
 
-func payloadKey(compression, version uint8) uint8 {
-	return version*4 + compression
+// payloadKey identifies marshaled form of the message
+type payloadKey struct {
+	compression uint8
+	version     uint8
+	encoding    uint8
+	backend     bool
+}
+
+type payload struct {
+	buf        []byte
+	compressed bool
 }
 
 func deflate(src []byte) []byte {
@@ -299,6 +323,14 @@ func (m *Msg) Response(o interface{}) *Msg {
 	}
 }
 
+// PartialResponse creates one of the many responses on the request.
+// Terminal response, created by Response, must follow after the last partial.
+func (m *Msg) PartialResponse(o interface{}) *Msg {
+	rm := m.Response(o)
+	rm.ResponseType = Partial
+	return rm
+}
+
 // BurstStart creates burst start message for the uri from the original message.
 func (m *Msg) BurstStart() *Msg {
 	return &Msg{
@@ -349,12 +381,32 @@ func (m *Msg) Request() *Msg {
 		CorrelationID:  m.CorrelationID,
 		URI:            m.URI,
 		Meta:           m.Meta,
+		Timeout:        m.Timeout,
 		BackendHeaders: m.BackendHeaders,
 		src:            m.src,
 		body:           m.body,
 	}
 }
 
+// NewRequest creates new request type message for the uri
+func NewRequest(uri string, o interface{}) *Msg {
+	return &Msg{
+		Type: Request,
+		URI:  uri,
+		src:  toBodyMarshaler(o),
+	}
+}
+
+// Cancel creates cancel type message for the request
+func (m *Msg) Cancel() *Msg {
+	return &Msg{
+		Type:           Cancel,
+		CorrelationID:  m.CorrelationID,
+		URI:            m.URI,
+		BackendHeaders: m.BackendHeaders,
+	}
+}
+
 // Pong creates Pong for corresponding Ping
 func (m *Msg) Pong() *Msg {
 	return &Msg{
@@ -436,6 +488,16 @@ func (m *Msg) IsRequest() bool {
 	return m.Type == Request
 }
 
+// IsPartial returns true if message is partial response
+func (m *Msg) IsPartial() bool {
+	return m.Type == Response && m.ResponseType == Partial
+}
+
+// IsCancel returns true is message is Cancel type
+func (m *Msg) IsCancel() bool {
+	return m.Type == Cancel
+}
+
 // IsFull ...
 func (m *Msg) IsFull() bool {
 	return m.UpdateType == Full
@@ -471,6 +533,7 @@ func (m *Msg) AsReplay() *Msg {
 		UpdateType: m.UpdateType,
 		Replay:     Replay,
 		Ts:         m.Ts,
+		CacheDepth: m.CacheDepth,
 		body:       m.body,
 		src:        m.src,
 	}
@@ -1,8 +1,13 @@
 package amp
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/minus5/svckit/metric"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -325,3 +330,241 @@ func TestMsg_MarshalForBackend(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestTimeout(t *testing.T) {
+	m := Parse([]byte(`{"t":2,"u":"some.topic/method","i":4,"o":500}`))
+	require.NotNil(t, m)
+	assert.Equal(t, int64(500), m.Timeout)
+
+	rm := m.Request()
+	assert.Equal(t, int64(500), rm.Timeout)
+	assert.Equal(t, `{"t":2,"i":4,"u":"some.topic/method","o":500}`+"\n", string(rm.MarshalForBackend()))
+}
+
+func TestPartialResponse(t *testing.T) {
+	req := &Msg{Type: Request, CorrelationID: 4, URI: "some.topic/method"}
+
+	p := req.PartialResponse(map[string]int{"a": 1})
+	assert.True(t, p.IsPartial())
+	assert.Equal(t, `{"t":3,"i":4,"a":1}`+"\n"+`{"a":1}`, string(p.Marshal()))
+
+	r := req.Response(map[string]int{"a": 2})
+	assert.False(t, r.IsPartial())
+	assert.Equal(t, `{"t":3,"i":4}`+"\n"+`{"a":2}`, string(r.Marshal()))
+}
+
+func TestMerge(t *testing.T) {
+	d1 := NewPublish("topic", "path", 1, Diff, map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}})
+	d2 := &Msg{Type: Publish, URI: "topic/path", Ts: 2, UpdateType: Diff, body: []byte(`{"b":{"c":null},"e":4}`)}
+
+	m, ok := d1.Merge(d2)
+	require.True(t, ok)
+	assert.Equal(t, Diff, m.UpdateType)
+	assert.Equal(t, int64(2), m.Ts)
+	assert.JSONEq(t, `{"a":1,"b":{"c":null,"d":3},"e":4}`, string(m.body))
+
+	f := NewPublish("topic", "path", 1, Full, map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}})
+	m, ok = f.Merge(d2)
+	require.True(t, ok)
+	assert.Equal(t, Full, m.UpdateType)
+	assert.JSONEq(t, `{"a":1,"b":{"d":3},"e":4}`, string(m.body))
+
+	_, ok = d2.Merge(f)
+	assert.False(t, ok)
+	_, ok = d1.Merge(NewPublish("topic", "other", 2, Diff, nil))
+	assert.False(t, ok)
+
+	// delete then set object can't be one diff
+	del := &Msg{Type: Publish, URI: "topic/path", Ts: 3, UpdateType: Diff, body: []byte(`{"b":null}`)}
+	set := &Msg{Type: Publish, URI: "topic/path", Ts: 4, UpdateType: Diff, body: []byte(`{"b":{"x":1}}`)}
+	_, ok = del.Merge(set)
+	assert.False(t, ok)
+	nested := &Msg{Type: Publish, URI: "topic/path", Ts: 3, UpdateType: Diff, body: []byte(`{"a":{"b":null}}`)}
+	_, ok = nested.Merge(&Msg{Type: Publish, URI: "topic/path", Ts: 4, UpdateType: Diff, body: []byte(`{"a":{"b":{"x":1}}}`)})
+	assert.False(t, ok)
+	// delete then set scalar is replace
+	m, ok = del.Merge(&Msg{Type: Publish, URI: "topic/path", Ts: 4, UpdateType: Diff, body: []byte(`{"b":5}`)})
+	require.True(t, ok)
+	assert.JSONEq(t, `{"b":5}`, string(m.body))
+}
+
+func TestParseV1FromServer(t *testing.T) {
+	m := &Msg{
+		Type:       Publish,
+		URI:        "sportsbook/m",
+		Ts:         123,
+		UpdateType: Full,
+		body:       []byte(`{"First":"jozo"}`),
+	}
+	p := ParseV1FromServer(m.MarshalV1())
+	assert.Equal(t, m.URI, p.URI)
+	assert.Equal(t, m.Ts, p.Ts)
+	assert.Equal(t, Full, p.UpdateType)
+	assert.Equal(t, m.body, p.body)
+
+	p = ParseV1FromServer(NewAlive().MarshalV1())
+	assert.Equal(t, Alive, p.Type)
+	assert.Nil(t, p.body)
+}
+
+func TestMsgpack(t *testing.T) {
+	m := &Msg{
+		Type:           Publish,
+		CorrelationID:  300,
+		URI:            "sportsbook/m_1",
+		Ts:             -1234567890123,
+		UpdateType:     Diff,
+		Subscriptions:  map[string]int64{"a": 1, "b": 1 << 40},
+		Meta:           map[string]string{"k": "v"},
+		BackendHeaders: map[string]string{"traceparent": "x"},
+		Error:          &Error{Source: TransportError, Message: "failed", Code: -7},
+		body:           []byte(`{"a":1,"b":[true,null,"s",1.5,-3],"c":{"d":"<e>"},"big":18446744073709551615}`),
+	}
+	buf := m.MarshalMsgpack()
+	require.True(t, isMsgpack(buf))
+	assert.Less(t, len(buf), len(m.Marshal()))
+
+	p := ParseMsgpack(buf)
+	require.NotNil(t, p)
+	assert.Equal(t, m.Type, p.Type)
+	assert.Equal(t, m.CorrelationID, p.CorrelationID)
+	assert.Equal(t, m.URI, p.URI)
+	assert.Equal(t, m.Ts, p.Ts)
+	assert.Equal(t, m.Subscriptions, p.Subscriptions)
+	assert.Equal(t, m.Meta, p.Meta)
+	assert.Equal(t, m.Error, p.Error)
+	assert.Nil(t, p.BackendHeaders)
+	assert.JSONEq(t, string(m.body), string(p.body))
+
+	// backend headers only for backend, recognized by ParseFromBackend
+	p = ParseFromBackend(m.MarshalForBackendMsgpack())
+	require.NotNil(t, p)
+	assert.Equal(t, m.BackendHeaders, p.BackendHeaders)
+	assert.JSONEq(t, string(m.body), string(p.body))
+
+	// json payload is cached separately
+	assert.Equal(t, byte('{'), m.Marshal()[0])
+	assert.True(t, isMsgpack(m.MarshalMsgpack()))
+
+	// body which is not json is passed as bin
+	m = &Msg{Type: Response, body: []byte("not json")}
+	p = ParseMsgpack(m.MarshalMsgpack())
+	assert.Equal(t, "not json", string(p.body))
+
+	assert.Nil(t, ParseMsgpack([]byte{0x82, 0xa1}))
+}
+
+func TestMsgpackBody(t *testing.T) {
+	large := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		large[fmt.Sprintf("k%d", i)] = i
+	}
+	largeBody, _ := json.Marshal(large)
+	for _, body := range []string{
+		`123`,
+		`"s"`,
+		`null`,
+		` {"a":[] , "b":{}} `,
+		string(largeBody),
+		`[` + strings.Repeat(`1,`, 70000) + `1]`,
+	} {
+		m := &Msg{Type: Response, body: []byte(body)}
+		p := ParseMsgpack(m.MarshalMsgpack())
+		require.NotNil(t, p, body)
+		assert.JSONEq(t, body, string(p.body))
+	}
+
+	// not json, or too deep, is sent as bin
+	deep := strings.Repeat("[", msgpackMaxDepth+1) + strings.Repeat("]", msgpackMaxDepth+1)
+	for _, body := range []string{`{"a":1} x`, `{"a":1`, `"s`, `12a`, deep} {
+		m := &Msg{Type: Response, body: []byte(body)}
+		buf := m.MarshalMsgpack()
+		p := ParseMsgpack(buf)
+		require.NotNil(t, p, body)
+		assert.Equal(t, body, string(p.body))
+	}
+
+	// client message nesting is limited
+	buf := (&Msg{Type: Request}).MarshalMsgpack()
+	for i := 0; i <= msgpackMaxDepth+1; i++ {
+		buf = append(buf, 0x91)
+	}
+	buf = append(buf, 0xc0)
+	assert.Nil(t, ParseMsgpack(buf))
+}
+
+type sizeMetric struct {
+	metric.Metric
+	counters map[string]int
+}
+
+func (m *sizeMetric) Counter(name string, values ...int) {
+	for _, v := range values {
+		m.counters[name] += v
+	}
+}
+
+func TestCompression(t *testing.T) {
+	sm := &sizeMetric{Metric: metric.NewNoop(), counters: make(map[string]int)}
+	metric.Set(sm)
+	defer metric.Set(metric.NewNoop())
+
+	encoding, compression, ok := ParseSubprotocol("amp.msgpack+deflate-dict")
+	require.True(t, ok)
+	assert.Equal(t, EncodingMsgpack, encoding)
+	assert.Equal(t, CompressionDeflateDict, compression)
+	_, _, ok = ParseSubprotocol("amp.json+unknown")
+	assert.False(t, ok)
+	encoding, compression, ok = ParseSubprotocol(MsgpackSubprotocol)
+	require.True(t, ok)
+	assert.Equal(t, EncodingMsgpack, encoding)
+	assert.Equal(t, CompressionNone, compression)
+	assert.Equal(t, "amp.json+deflate-dict", Subprotocol(EncodingJSON, "deflate-dict"))
+
+	body := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		body[fmt.Sprintf("key%d", i)] = "value"
+	}
+	m := NewPublish("sportsbook.v1", "m_1", 1, Full, body)
+	raw := m.Marshal()
+	require.Greater(t, int64(len(raw)), compressionLenLimit)
+
+	buf, compressed := m.MarshalFor(CompressionDeflateDict, CompatibilityVersionDefault, EncodingJSON)
+	require.True(t, compressed)
+	assert.Less(t, len(buf), len(raw))
+	out, err := CompressorFor(CompressionDeflateDict).Decompress(buf)
+	require.NoError(t, err)
+	assert.Equal(t, raw, out)
+	assert.Equal(t, len(raw), sm.counters["amp.compression.deflate-dict.sportsbook_v1.raw"])
+	assert.Equal(t, len(buf), sm.counters["amp.compression.deflate-dict.sportsbook_v1.compressed"])
+
+	// cached
+	buf2, _ := m.MarshalFor(CompressionDeflateDict, CompatibilityVersionDefault, EncodingJSON)
+	assert.Equal(t, buf, buf2)
+	assert.Equal(t, len(raw), sm.counters["amp.compression.deflate-dict.sportsbook_v1.raw"])
+
+	// small messages are not compressed
+	small := NewPublish("sportsbook.v1", "m_1", 1, Full, "small")
+	buf, compressed = small.MarshalFor(CompressionDeflateDict, CompatibilityVersionDefault, EncodingJSON)
+	assert.False(t, compressed)
+	assert.Equal(t, small.Marshal(), buf)
+
+	// threshold is configurable
+	SetCompressionLenLimit(0)
+	defer SetCompressionLenLimit(8 * 1024)
+	small = NewPublish("sportsbook.v1", "m_1", 1, Full, "small")
+	_, compressed = small.MarshalFor(CompressionDeflateDict, CompatibilityVersionDefault, EncodingJSON)
+	assert.True(t, compressed)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	src := bytes.Repeat([]byte("a"), 1024)
+	d := NewDictDeflate(DefaultDictionary, DecompressLimit(len(src)))
+	out, err := d.Decompress(d.Compress(src))
+	require.NoError(t, err)
+	assert.Equal(t, src, out)
+
+	d = NewDictDeflate(DefaultDictionary, DecompressLimit(len(src)-1))
+	_, err = d.Decompress(d.Compress(src))
+	assert.Equal(t, ErrDecompressedTooBig, err)
+}
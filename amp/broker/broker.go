@@ -5,6 +5,7 @@
 package broker
 
 import (
+	"sync"
 	"time"
 
 	"github.com/minus5/svckit/amp"
@@ -18,8 +19,13 @@ type Broker struct {
 	closed         chan struct{}
 	spreaders      map[string]*spreader
 	consumerNames  map[amp.Sender]map[string]int64
+	patterns       map[string]map[amp.Sender]struct{} // consumers subscribed to the pattern
 	current        func(string)
 	expireDuration *time.Duration
+	store          Store               // topics state persistence, optional
+	storeInterval  time.Duration       // how often to save state to the store
+	storeLock      sync.Mutex          // serializes saves
+	restored       map[string]struct{} // topics loaded from the store, waiting for the first message
 }
 
 // Consume consumes all msgs from in channel.
@@ -38,16 +44,24 @@ func (s *Broker) Wait() {
 }
 
 // New creates new scatter
-func New(current func(string), expireDuration *time.Duration) *Broker {
+// opts are functions to set additional options.
+func New(current func(string), expireDuration *time.Duration, opts ...func(*Broker)) *Broker {
 	s := &Broker{
 		messages:       make(chan *amp.Msg, 1024),
 		loopWork:       make(chan func()),
 		closed:         make(chan struct{}),
 		spreaders:      make(map[string]*spreader),
 		consumerNames:  make(map[amp.Sender]map[string]int64),
+		patterns:       make(map[string]map[amp.Sender]struct{}),
 		current:        current,
 		expireDuration: expireDuration,
 	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	if s.store != nil {
+		s.load()
+	}
 	go s.loop()
 	return s
 }
@@ -85,48 +99,140 @@ func (s *Broker) Created(c amp.Sender) {}
 
 // Subscribe consumer to topics defined c.Topics()
 // amp.Sender should call this on each change ih his Topics list.
+// Names can be topic patterns (see pattern.go).
 func (s *Broker) Subscribe(c amp.Sender, newNames map[string]int64) {
 	metric.Time("broker.subscribe.len", len(newNames))
 	s.inLoop(func() {
-		oldNames, ok := s.consumerNames[c]
+		oldNames := s.consumerNames[c]
 		s.consumerNames[c] = copyMap(newNames)
 
-		if !ok {
-			for name, ts := range newNames {
-				s.find(name, true).subscribe(c, ts)
+		// makni one kojih vise nema
+		for name := range oldNames {
+			if _, ok := newNames[name]; ok {
+				continue
+			}
+			if isPattern(name) {
+				s.unsubscribePattern(c, name)
+				continue
+			}
+			if s.wants(c, name) {
+				continue // still subscribed through pattern
+			}
+			if spr, ok := s.spreaders[name]; ok {
+				spr.unsubscribe(c)
 			}
-			return
 		}
 
-		// proizvedi mapu promjena za one koje treba dodati true,
-		// za one koje treba maknuti false
-		updMap := make(map[string]bool)
-		for t := range oldNames {
-			updMap[t] = false
-		}
-		for name := range newNames {
-			if _, ok := updMap[name]; ok {
-				delete(updMap, name)
-			} else {
-				updMap[name] = true
+		// dodaj nove, prvo topice pa patterne da topic dobije svoj ts
+		for name, ts := range newNames {
+			if _, ok := oldNames[name]; ok || isPattern(name) {
+				continue
 			}
+			spr := s.find(name, true)
+			if spr.has(c) {
+				continue // already subscribed through pattern
+			}
+			spr.subscribe(c, ts)
 		}
-
-		// obradi mapu promjena
-		for name, v := range updMap {
-			if v == true {
-				s.find(name, true).subscribe(c, newNames[name])
+		for name, ts := range newNames {
+			if !isPattern(name) {
 				continue
 			}
-			spr, ok := s.spreaders[name]
-			if !ok {
+			if _, ok := oldNames[name]; ok {
+				// authorization of the matching topics could be changed
+				s.refreshPattern(c, name)
 				continue
 			}
-			spr.unsubscribe(c)
+			s.subscribePattern(c, name, ts)
 		}
 	})
 }
 
+// topicAuthorizer is implemented by consumers which authorize each topic
+// matched by the pattern subscription (session with Authorizer).
+// Called from the broker loop, so it must not block. Consumer which can't
+// decide immediately should deny the topic and call Subscribe again, with
+// the same subscriptions, when the topic becomes allowed.
+type topicAuthorizer interface {
+	AllowTopic(name string) bool
+}
+
+// allowTopic returns true if consumer can be subscribed to the topic through pattern.
+func allowTopic(c amp.Sender, name string) bool {
+	if a, ok := c.(topicAuthorizer); ok {
+		return a.AllowTopic(name)
+	}
+	return true
+}
+
+// wants returns true if consumer is subscribed to the topic by name or by pattern.
+func (s *Broker) wants(c amp.Sender, name string) bool {
+	names := s.consumerNames[c]
+	if _, ok := names[name]; ok {
+		return true
+	}
+	for n := range names {
+		if isPattern(n) && matchTopic(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribePattern subscribes consumer to all existing allowed topics matching pattern.
+// Client ts of the pattern is used for existing topics.
+// Topics created later are subscribed in find.
+func (s *Broker) subscribePattern(c amp.Sender, pattern string, ts int64) {
+	cs, ok := s.patterns[pattern]
+	if !ok {
+		cs = make(map[amp.Sender]struct{})
+		s.patterns[pattern] = cs
+	}
+	cs[c] = struct{}{}
+	for name, spr := range s.spreaders {
+		if matchTopic(pattern, name) && !spr.has(c) && allowTopic(c, name) {
+			spr.subscribe(c, ts)
+		}
+	}
+}
+
+// refreshPattern subscribes consumer to the topics matching pattern which
+// became allowed, and unsubscribes from the ones which are no longer allowed.
+func (s *Broker) refreshPattern(c amp.Sender, pattern string) {
+	names := s.consumerNames[c]
+	for name, spr := range s.spreaders {
+		if !matchTopic(pattern, name) {
+			continue
+		}
+		if _, ok := names[name]; ok {
+			continue // subscribed by name
+		}
+		allowed := allowTopic(c, name)
+		if allowed && !spr.has(c) {
+			spr.subscribe(c, 0)
+		}
+		if !allowed && spr.has(c) {
+			spr.unsubscribe(c)
+		}
+	}
+}
+
+// unsubscribePattern unsubscribes consumer from the topics matching pattern
+// unless they are still wanted by name or some other pattern.
+func (s *Broker) unsubscribePattern(c amp.Sender, pattern string) {
+	if cs, ok := s.patterns[pattern]; ok {
+		delete(cs, c)
+		if len(cs) == 0 {
+			delete(s.patterns, pattern)
+		}
+	}
+	for name, spr := range s.spreaders {
+		if matchTopic(pattern, name) && !s.wants(c, name) {
+			spr.unsubscribe(c)
+		}
+	}
+}
+
 func (s *Broker) find(name string, currentOnNew bool) *spreader {
 	if spr, ok := s.spreaders[name]; ok {
 		return spr
@@ -139,6 +245,16 @@ func (s *Broker) find(name string, currentOnNew bool) *spreader {
 	}
 	spr := newSpreader(name, topicCount)
 	s.spreaders[name] = spr
+	for pattern, cs := range s.patterns {
+		if !matchTopic(pattern, name) {
+			continue
+		}
+		for c := range cs {
+			if !spr.has(c) && allowTopic(c, name) {
+				spr.subscribe(c, 0)
+			}
+		}
+	}
 	if currentOnNew && s.current != nil {
 		log.S("topic", name).I("count", topicCount).Info("new top current")
 		go s.current(name)
@@ -155,6 +271,10 @@ func (s *Broker) Unsubscribe(c amp.Sender) {
 		oldNames := s.consumerNames[c]
 		delete(s.consumerNames, c)
 		for name := range oldNames {
+			if isPattern(name) {
+				s.unsubscribePattern(c, name)
+				continue
+			}
 			spr, ok := s.spreaders[name]
 			if !ok {
 				continue
@@ -211,6 +331,9 @@ func (s *Broker) signalClose() {
 }
 
 func (s *Broker) close() {
+	if s.store != nil {
+		s.save(s.snapshot(), true)
+	}
 	for _, spr := range s.spreaders {
 		spr.close()
 	}
@@ -221,6 +344,12 @@ func (s *Broker) close() {
 func (s *Broker) loop() {
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
+	var storeTick <-chan time.Time
+	if s.store != nil && s.storeInterval > 0 {
+		storeTicker := time.NewTicker(s.storeInterval)
+		defer storeTicker.Stop()
+		storeTick = storeTicker.C
+	}
 	for {
 		select {
 		case m := <-s.messages:
@@ -231,6 +360,7 @@ func (s *Broker) loop() {
 			}
 			name := m.URI
 			spr := s.find(name, !m.IsFull())
+			s.firstAfterRestore(name, m)
 			if m.IsTopicClose() {
 				log.S("topic", name).Info("delete from msg")
 				delete(s.spreaders, name)
@@ -247,6 +377,8 @@ func (s *Broker) loop() {
 			if s.expireDuration != nil {
 				s.removeExpired(*s.expireDuration)
 			}
+		case <-storeTick:
+			s.save(s.snapshot(), false)
 		}
 	}
 }
@@ -255,6 +387,7 @@ func (s *Broker) removeExpired(expireDuration time.Duration) {
 	for name, spr := range s.spreaders {
 		if spr.isExpired(expireDuration) {
 			delete(s.spreaders, name)
+			delete(s.restored, name)
 			spr.close()
 		}
 	}
@@ -307,6 +440,8 @@ type TopicSubscriber struct {
 type TopicStats struct {
 	Name        string
 	Subscribers []*TopicSubscriber
+	CacheSize   int       // number of cached messages
+	UpdatedAt   time.Time // time of the last message
 }
 
 func (s *Broker) TopicStats() []*TopicStats {
@@ -316,6 +451,7 @@ func (s *Broker) TopicStats() []*TopicStats {
 			t := &TopicStats{
 				Name: name,
 			}
+			t.CacheSize, t.UpdatedAt = spr.stats()
 			for sub := range spr.consumerTopics {
 				meta := make(map[string]string)
 				for k, v := range sub.Meta() {
@@ -330,3 +466,26 @@ func (s *Broker) TopicStats() []*TopicStats {
 	})
 	return ts
 }
+
+// Evict removes topic cache.
+// Topic with subscribers is kept, they get the next full message.
+// Topic without subscribers is removed.
+// Returns false if topic is not found.
+func (s *Broker) Evict(name string) bool {
+	found := false
+	s.inLoopWait(func() {
+		spr, ok := s.spreaders[name]
+		if !ok {
+			return
+		}
+		found = true
+		log.S("topic", name).I("subscribers", len(spr.consumerTopics)).Info("evict")
+		if len(spr.consumerTopics) > 0 {
+			spr.evict()
+			return
+		}
+		delete(s.spreaders, name)
+		spr.close()
+	})
+	return found
+}
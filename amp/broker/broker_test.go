@@ -8,6 +8,7 @@ import (
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testConsumer struct {
@@ -203,3 +204,172 @@ func TestReplay(t *testing.T) {
 	msgs = s.Replay("")
 	assert.Len(t, msgs, 6)
 }
+
+func TestPatternSubscribe(t *testing.T) {
+	s := New(nil, nil)
+	m1 := &amp.Msg{URI: "live/1", Ts: 1, UpdateType: amp.Full}
+	s.Publish(m1)
+	s.wait("live/1")
+
+	c := &testConsumer{topics: map[string]int64{"live/*": 0}}
+	s.Subscribe(c, c.topics)
+	s.inLoop(func() {})
+	s.wait("live/1")
+	// dobije current postojeceg topica
+	assert.Len(t, c.messages, 1)
+
+	// i novih topica koji odgovaraju patternu
+	m2 := &amp.Msg{URI: "live/2", Ts: 1, UpdateType: amp.Full}
+	m3 := &amp.Msg{URI: "live/2/x", Ts: 1, UpdateType: amp.Full}
+	m4 := &amp.Msg{URI: "prematch/1", Ts: 1, UpdateType: amp.Full}
+	s.Publish(m2)
+	s.Publish(m3)
+	s.Publish(m4)
+	s.wait("live/2")
+	s.wait("live/2/x")
+	s.wait("prematch/1")
+	assert.Len(t, c.messages, 2)
+	assert.Equal(t, m2, c.messages[1])
+
+	// exact i pattern na isti topic, makni pattern ostaje exact
+	c.topics = map[string]int64{"live/>": 0, "live/1": 1}
+	s.Subscribe(c, c.topics)
+	s.inLoop(func() {})
+	c.topics = map[string]int64{"live/1": 1}
+	s.Subscribe(c, c.topics)
+	s.inLoop(func() {})
+	m5 := &amp.Msg{URI: "live/1", Ts: 2, UpdateType: amp.Diff}
+	m6 := &amp.Msg{URI: "live/2", Ts: 2, UpdateType: amp.Diff}
+	s.Publish(m5)
+	s.Publish(m6)
+	s.wait("live/1")
+	s.wait("live/2")
+	c.Lock()
+	assert.Equal(t, m5, c.messages[len(c.messages)-1])
+	for _, m := range c.messages {
+		assert.NotEqual(t, m6, m)
+	}
+	c.Unlock()
+
+	s.Unsubscribe(c)
+	assert.Len(t, s.patterns, 0)
+}
+
+func TestEvict(t *testing.T) {
+	s := New(nil, nil)
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"1": 0})
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.wait("1")
+
+	ts := s.TopicStats()
+	assert.Len(t, ts, 1)
+	assert.Equal(t, "1", ts[0].Name)
+	assert.Equal(t, 2, ts[0].CacheSize)
+	assert.Len(t, ts[0].Subscribers, 1)
+	assert.False(t, ts[0].UpdatedAt.IsZero())
+
+	// subscribers are kept, cache is cleared
+	assert.True(t, s.Evict("1"))
+	ts = s.TopicStats()
+	require.Len(t, ts, 1)
+	assert.Equal(t, 0, ts[0].CacheSize)
+	assert.Len(t, ts[0].Subscribers, 1)
+	assert.Len(t, s.Replay("1"), 0)
+
+	// and get messages published after evict
+	c.Lock()
+	c.messages = nil
+	c.Unlock()
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.wait("1")
+	c.Lock()
+	require.Len(t, c.messages, 2)
+	assert.Equal(t, int64(1), c.messages[0].Ts)
+	assert.Equal(t, int64(2), c.messages[1].Ts)
+	c.Unlock()
+	assert.Len(t, s.Replay("1"), 2)
+
+	// topic without subscribers is removed
+	s.Unsubscribe(c)
+	assert.True(t, s.Evict("1"))
+	assert.False(t, s.Evict("1"))
+	assert.Len(t, s.TopicStats(), 0)
+}
+
+type authConsumer struct {
+	testConsumer
+	denied map[string]bool
+}
+
+func (c *authConsumer) AllowTopic(name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return !c.denied[name]
+}
+
+func (c *authConsumer) uris() map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	uris := make(map[string]int)
+	for _, m := range c.messages {
+		uris[m.URI]++
+	}
+	return uris
+}
+
+func TestPatternAuthorize(t *testing.T) {
+	s := New(nil, nil)
+	s.Publish(&amp.Msg{URI: "user/1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "user/2", Ts: 1, UpdateType: amp.Full})
+	s.wait("user/1")
+	s.wait("user/2")
+
+	c := &authConsumer{denied: map[string]bool{"user/2": true, "user/3": true}}
+	subs := map[string]int64{"user/>": 0}
+	s.Subscribe(c, subs)
+	s.inLoopWait(func() {})
+	s.wait("user/1")
+	s.wait("user/2")
+	assert.Equal(t, map[string]int{"user/1": 1}, c.uris())
+
+	// topics created later are also authorized
+	s.Publish(&amp.Msg{URI: "user/3", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "user/4", Ts: 1, UpdateType: amp.Full})
+	s.wait("user/3")
+	s.wait("user/4")
+	assert.Equal(t, map[string]int{"user/1": 1, "user/4": 1}, c.uris())
+
+	// authorization changes are applied on the next subscribe
+	c.Lock()
+	c.denied = map[string]bool{"user/1": true}
+	c.Unlock()
+	s.Subscribe(c, subs)
+	s.inLoopWait(func() {})
+	s.Publish(&amp.Msg{URI: "user/1", Ts: 2, UpdateType: amp.Diff})
+	s.wait("user/1")
+	for _, name := range []string{"user/2", "user/3"} {
+		s.wait(name)
+	}
+	assert.Equal(t, map[string]int{"user/1": 1, "user/2": 1, "user/3": 1, "user/4": 1}, c.uris())
+}
+
+func TestPatternSubscribeTs(t *testing.T) {
+	s := New(nil, nil)
+	s.Publish(&amp.Msg{URI: "live/1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "live/1", Ts: 2, UpdateType: amp.Diff})
+	m3 := &amp.Msg{URI: "live/1", Ts: 3, UpdateType: amp.Diff}
+	s.Publish(m3)
+	s.wait("live/1")
+
+	// client has messages up to ts 2
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"live/*": 2})
+	s.inLoopWait(func() {})
+	s.wait("live/1")
+	c.Lock()
+	defer c.Unlock()
+	assert.Equal(t, []*amp.Msg{m3}, c.messages)
+}
@@ -0,0 +1,46 @@
+package broker
+
+import "strings"
+
+// Pattern subscriptions.
+// Topic name is split into segments by /. Subscription name is a pattern if
+// it has any of the wildcard segments. Segment * matches exactly one segment:
+// sportsbook/live/* matches sportsbook/live/1 but not sportsbook/live/1/2.
+// Segment > (only as the last one) matches one or more remaining segments:
+// sportsbook/live/> matches all topics under sportsbook/live/.
+//
+// Consumer subscribed to the pattern receives current state and updates of
+// all matching topics, including those created after the subscription.
+const (
+	segmentWildcard = "*"
+	prefixWildcard  = ">"
+	segmentSep      = "/"
+)
+
+// isPattern returns true if subscription name contains wildcard segment.
+func isPattern(name string) bool {
+	for _, p := range strings.Split(name, segmentSep) {
+		if p == segmentWildcard || p == prefixWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic returns true if topic name matches pattern.
+func matchTopic(pattern, name string) bool {
+	pp := strings.Split(pattern, segmentSep)
+	np := strings.Split(name, segmentSep)
+	for i, p := range pp {
+		if p == prefixWildcard && i == len(pp)-1 {
+			return len(np) > i
+		}
+		if i >= len(np) {
+			return false
+		}
+		if p != segmentWildcard && p != np[i] {
+			return false
+		}
+	}
+	return len(pp) == len(np)
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"sportsbook/live/*", "sportsbook/live/1", true},
+		{"sportsbook/live/*", "sportsbook/live/1/2", false},
+		{"sportsbook/live/*", "sportsbook/live", false},
+		{"sportsbook/*/1", "sportsbook/live/1", true},
+		{"sportsbook/*/1", "sportsbook/live/2", false},
+		{"sportsbook/live/>", "sportsbook/live/1", true},
+		{"sportsbook/live/>", "sportsbook/live/1/2", true},
+		{"sportsbook/live/>", "sportsbook/live", false},
+		{"sportsbook/live/>", "sportsbook/prematch/1", false},
+		{">", "sportsbook", true},
+		{"sportsbook/m", "sportsbook/m", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, matchTopic(tt.pattern, tt.name), "%s %s", tt.pattern, tt.name)
+	}
+	assert.True(t, isPattern("sportsbook/live/*"))
+	assert.True(t, isPattern("sportsbook/>"))
+	assert.False(t, isPattern("sportsbook/m"))
+	assert.False(t, isPattern("sportsbook/a*"))
+}
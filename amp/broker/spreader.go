@@ -41,6 +41,11 @@ func (spr *spreader) findTopic(c amp.Sender) *topic {
 	return t
 }
 
+func (spr *spreader) has(c amp.Sender) bool {
+	_, ok := spr.consumerTopics[c]
+	return ok
+}
+
 func (spr *spreader) subscribe(c amp.Sender, ts int64) {
 	spr.lastUsed = time.Now()
 	t := spr.findTopic(c)
@@ -60,6 +65,12 @@ func (spr *spreader) close() {
 	}
 }
 
+func (spr *spreader) evict() {
+	for _, t := range spr.topics {
+		t.evict()
+	}
+}
+
 func (spr *spreader) unsubscribe(c amp.Sender) {
 	if t := spr.consumerTopics[c]; t != nil {
 		t.unsubscribe(c)
@@ -71,6 +82,10 @@ func (spr *spreader) replay() []*amp.Msg {
 	return spr.topics[0].replay()
 }
 
+func (spr *spreader) stats() (int, time.Time) {
+	return spr.topics[0].stats()
+}
+
 // samo za testove
 func (spr *spreader) wait() {
 	for _, t := range spr.topics {
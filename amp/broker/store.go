@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/file"
+	"github.com/minus5/svckit/log"
+)
+
+// Store persists current state of the topics between broker restarts.
+// Topic state is list of messages: full with diffs after it or append window.
+type Store interface {
+	Save(topics map[string][]*amp.Msg) error
+	Load() (map[string][]*amp.Msg, error)
+}
+
+// WithStore loads topics state from the store on broker start.
+// State is saved every interval and on broker close, diffs are merged
+// into full message before saving.
+// Messages published while the broker was down are lost, so the first
+// diff of the restored topic requests current state (once).
+func WithStore(st Store, interval time.Duration) func(*Broker) {
+	return func(s *Broker) {
+		s.store = st
+		s.storeInterval = interval
+	}
+}
+
+// load publishes stored topics state.
+// Topics are created without current callback, subscribers will get stored
+// state until backend sends new one.
+func (s *Broker) load() {
+	start := time.Now()
+	topics, err := s.store.Load()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s.restored = make(map[string]struct{})
+	msgs := 0
+	for name, ms := range topics {
+		s.restored[name] = struct{}{}
+		spr := s.find(name, false)
+		for _, m := range ms {
+			spr.publish(m.AsReplay())
+		}
+		msgs += len(ms)
+	}
+	log.I("topics", len(topics)).I("msgs", msgs).I("durationMs", int(time.Since(start)/time.Millisecond)).Info("store loaded")
+}
+
+// firstAfterRestore requests current state on the first diff of the
+// restored topic. Diffs published while broker was down are missing,
+// stored state and new diffs could be inconsistent.
+// Should be called from the loop.
+func (s *Broker) firstAfterRestore(name string, m *amp.Msg) {
+	if _, ok := s.restored[name]; !ok {
+		return
+	}
+	delete(s.restored, name)
+	if !m.IsFull() && !m.IsTopicClose() && s.current != nil {
+		log.S("topic", name).Info("restored topic current")
+		go s.current(name)
+	}
+}
+
+// snapshot collects current state of all topics
+// Should be called from the loop.
+func (s *Broker) snapshot() map[string][]*amp.Msg {
+	topics := make(map[string][]*amp.Msg)
+	for name, spr := range s.spreaders {
+		if ms := spr.replay(); len(ms) > 0 {
+			topics[name] = ms
+		}
+	}
+	return topics
+}
+
+// save stores topics state.
+// Saves are serialized, wait tells whether to block until save is finished.
+func (s *Broker) save(topics map[string][]*amp.Msg, wait bool) {
+	save := func() {
+		s.storeLock.Lock()
+		defer s.storeLock.Unlock()
+		start := time.Now()
+		for name, ms := range topics {
+			topics[name] = compact(ms)
+		}
+		if err := s.store.Save(topics); err != nil {
+			log.Error(err)
+			return
+		}
+		metric.Time("store.save", int(time.Since(start).Nanoseconds()))
+	}
+	if wait {
+		save()
+		return
+	}
+	go save()
+}
+
+// compact merges diffs into the full message.
+// Diffs which can't be merged are kept, with all after them.
+func compact(ms []*amp.Msg) []*amp.Msg {
+	if len(ms) < 2 || !ms[0].IsFull() {
+		return ms
+	}
+	full := ms[0]
+	for i, m := range ms[1:] {
+		merged, ok := full.Merge(m)
+		if !ok {
+			return append([]*amp.Msg{full}, ms[i+1:]...)
+		}
+		full = merged
+	}
+	return []*amp.Msg{full}
+}
+
+// FileStore stores topics state into gzipped file.
+// File is written to temporary location and then renamed,
+// so the previous state is kept if save fails.
+type FileStore struct {
+	path string
+	sync.Mutex
+}
+
+// NewFileStore creates store for the file path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Save writes all topics messages into file.
+// Each message is marshaled for backend and prefixed with its length.
+func (f *FileStore) Save(topics map[string][]*amp.Msg) error {
+	f.Lock()
+	defer f.Unlock()
+	tmp := f.path + ".tmp"
+	gw, err := file.NewGzWriter(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(gw)
+	for _, ms := range topics {
+		for _, m := range ms {
+			buf := m.MarshalForBackend()
+			if err := binary.Write(w, binary.BigEndian, uint32(len(buf))); err != nil {
+				gw.Close()
+				return err
+			}
+			if _, err := w.Write(buf); err != nil {
+				gw.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		gw.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Load reads topics messages from the file.
+// Messages are grouped by uri (broker topic name).
+// Missing file is not an error.
+func (f *FileStore) Load() (map[string][]*amp.Msg, error) {
+	f.Lock()
+	defer f.Unlock()
+	topics := make(map[string][]*amp.Msg)
+	gr, err := file.NewGzReader(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return topics, nil
+		}
+		return nil, err
+	}
+	defer gr.Close()
+	r := bufio.NewReader(gr)
+	for {
+		var l uint32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			if err == io.EOF {
+				return topics, nil
+			}
+			return nil, err
+		}
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if m := amp.ParseFromBackend(buf); m != nil {
+			topics[m.URI] = append(topics[m.URI], m)
+		}
+	}
+}
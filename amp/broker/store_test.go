@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	st := NewFileStore(filepath.Join(t.TempDir(), "broker.gz"))
+	topics, err := st.Load()
+	require.NoError(t, err)
+	assert.Len(t, topics, 0)
+
+	err = st.Save(map[string][]*amp.Msg{
+		"1": {
+			amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1}),
+			amp.NewPublish("1", "", 2, amp.Diff, map[string]int{"a": 2}),
+		},
+		"2/p": {
+			{Type: amp.Publish, URI: "2/p", Ts: 3, UpdateType: amp.Append, CacheDepth: 5},
+		},
+	})
+	require.NoError(t, err)
+
+	topics, err = st.Load()
+	require.NoError(t, err)
+	require.Len(t, topics, 2)
+	require.Len(t, topics["1"], 2)
+	assert.Equal(t, int64(2), topics["1"][1].Ts)
+	assert.Equal(t, amp.Diff, topics["1"][1].UpdateType)
+	assert.Equal(t, 5, topics["2/p"][0].CacheDepth)
+	var body map[string]int
+	require.NoError(t, topics["1"][0].BodyTo(&body))
+	assert.Equal(t, 1, body["a"])
+}
+
+func TestWarmRestart(t *testing.T) {
+	log.Discard()
+	st := NewFileStore(filepath.Join(t.TempDir(), "broker.gz"))
+
+	s := New(nil, nil, WithStore(st, time.Hour))
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "2", Ts: 1, UpdateType: amp.Append})
+	s.wait("1")
+	s.wait("2")
+	s.waitClose()
+
+	var currentCalls []string
+	s = New(func(name string) { currentCalls = append(currentCalls, name) }, nil, WithStore(st, time.Hour))
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"1": 0, "2": 0})
+	s.wait("1")
+	s.wait("2")
+	s.inLoopWait(func() {})
+
+	c.Lock()
+	assert.Len(t, c.messages, 3)
+	c.Unlock()
+	assert.Len(t, currentCalls, 0)
+	s.waitClose()
+}
+
+func TestCompact(t *testing.T) {
+	full := amp.NewPublish("1", "", 1, amp.Full, map[string]interface{}{"a": 1, "b": 1})
+	d2 := amp.NewPublish("1", "", 2, amp.Diff, map[string]interface{}{"a": 2})
+	d3 := amp.NewPublish("1", "", 3, amp.Diff, map[string]interface{}{"b": nil})
+	ms := compact([]*amp.Msg{full, d2, d3})
+	require.Len(t, ms, 1)
+	assert.Equal(t, amp.Full, ms[0].UpdateType)
+	assert.Equal(t, int64(3), ms[0].Ts)
+	var body map[string]int
+	require.NoError(t, ms[0].BodyTo(&body))
+	assert.Equal(t, map[string]int{"a": 2}, body)
+
+	// diffs which can't be merged are kept
+	bad := amp.NewPublish("1", "", 4, amp.Diff, []int{1})
+	ms = compact([]*amp.Msg{full, d2, bad, d3})
+	require.Len(t, ms, 3)
+	assert.Equal(t, int64(2), ms[0].Ts)
+	assert.Equal(t, bad, ms[1])
+	assert.Equal(t, d3, ms[2])
+
+	// append window is not changed
+	a := []*amp.Msg{{Type: amp.Publish, URI: "2", Ts: 1, UpdateType: amp.Append}}
+	assert.Equal(t, a, compact(a))
+}
+
+func TestWarmRestartCurrent(t *testing.T) {
+	log.Discard()
+	st := NewFileStore(filepath.Join(t.TempDir(), "broker.gz"))
+
+	s := New(nil, nil, WithStore(st, time.Hour))
+	s.Publish(amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1}))
+	s.Publish(amp.NewPublish("1", "", 2, amp.Diff, map[string]int{"a": 2}))
+	s.wait("1")
+	s.waitClose()
+
+	// diffs are merged into full
+	topics, err := st.Load()
+	require.NoError(t, err)
+	require.Len(t, topics["1"], 1)
+	assert.Equal(t, int64(2), topics["1"][0].Ts)
+
+	currentCalls := make(chan string, 4)
+	s = New(func(name string) { currentCalls <- name }, nil, WithStore(st, time.Hour))
+	// first diff of the restored topic requests current state, once
+	s.Publish(amp.NewPublish("1", "", 5, amp.Diff, map[string]int{"a": 5}))
+	s.Publish(amp.NewPublish("1", "", 6, amp.Diff, map[string]int{"a": 6}))
+	s.wait("1")
+	select {
+	case name := <-currentCalls:
+		assert.Equal(t, "1", name)
+	case <-time.After(time.Second):
+		t.Fatal("current not requested")
+	}
+	s.waitClose()
+	assert.Len(t, currentCalls, 0)
+}
@@ -132,6 +132,19 @@ func (t *topic) unsubscribe(c amp.Sender) {
 	}
 }
 
+// evict clears cache, consumers get the next full message as new ones.
+func (t *topic) evict() {
+	done := make(chan struct{})
+	t.loopWork <- func() {
+		t.cache = nil
+		for c := range t.consumers {
+			t.consumers[c] = tsNone
+		}
+		close(done)
+	}
+	<-done
+}
+
 func burst(ms []*amp.Msg) []*amp.Msg {
 	l := len(ms)
 	if l <= 2 {
@@ -211,6 +224,24 @@ func (t *topic) replay() []*amp.Msg {
 	return rmsgs
 }
 
+// stats returns number of cached messages and time of the last message
+func (t *topic) stats() (int, time.Time) {
+	type stats struct {
+		size      int
+		updatedAt time.Time
+	}
+	ret := make(chan stats, 1)
+	t.loopWork <- func() {
+		st := stats{updatedAt: t.updatedAt}
+		if t.cache != nil {
+			st.size = len(t.cache.Current())
+		}
+		ret <- st
+	}
+	st := <-ret
+	return st.size, st.updatedAt
+}
+
 // func (t *topic) metrics() (diffs, firstDiffTs, lastDiffTs, fullTs int64) {
 // 	done := make(chan struct{})
 // 	t.loopWork <- func() {
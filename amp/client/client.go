@@ -0,0 +1,495 @@
+// Package client is amp websocket client.
+//
+// Client keeps local state of the subscribed topics, sends requests and waits
+// for responses, and reconnects (with re-subscribe) when connection is lost.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/session"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDisconnected is returned for the pending requests when connection is lost.
+	ErrDisconnected = errors.New("disconnected")
+	// ErrClosed is returned when client is closed.
+	ErrClosed = errors.New("client closed")
+	// ErrNotSupported is returned for requests in version 1 protocol.
+	ErrNotSupported = errors.New("not supported in this protocol version")
+
+	maxMessageSize = int64(16 * 1024 * 1024)
+)
+
+// Client is amp websocket client.
+type Client struct {
+	url               string
+	version           uint8
+	deflate           bool
+	msgpack           bool     // request MessagePack encoding
+	compressors       []string // offered application level compressors
+	encoding          uint8    // negotiated encoding
+	compression       uint8    // negotiated application level compression
+	header            ws.HandshakeHeader
+	requestTimeout    time.Duration
+	pingInterval      time.Duration
+	aliveTimeout      time.Duration
+	reconnectInterval time.Duration
+	onConnect         func()
+
+	conn          net.Conn
+	br            *bufio.Reader
+	topics        map[string]*Topic
+	requests      map[uint64]*request
+	correlationID uint64
+	resumeToken   string
+
+	ctx    context.Context
+	cancel func()
+	done   chan struct{}
+	wmu    sync.Mutex // serializes writes
+	sync.Mutex
+}
+
+// V1 uses compatibility version 1 protocol.
+// Only subscriptions to sportsbook/ topics are supported.
+func V1() func(*Client) {
+	return func(c *Client) {
+		c.version = amp.CompatibilityVersion1
+	}
+}
+
+// NoDeflate disables permessage-deflate negotiation.
+func NoDeflate() func(*Client) {
+	return func(c *Client) {
+		c.deflate = false
+	}
+}
+
+// Msgpack requests binary (MessagePack) encoding of the messages.
+// Server which does not support it falls back to json.
+func Msgpack() func(*Client) {
+	return func(c *Client) {
+		c.msgpack = true
+	}
+}
+
+// Compressors offers application level compressors (registered in amp) in
+// the order of preference. Server picks the first one it supports.
+func Compressors(names ...string) func(*Client) {
+	return func(c *Client) {
+		c.compressors = names
+	}
+}
+
+// Header sets http headers sent on connect.
+func Header(h map[string]string) func(*Client) {
+	return func(c *Client) {
+		hh := make(map[string][]string)
+		for k, v := range h {
+			hh[k] = []string{v}
+		}
+		c.header = ws.HandshakeHeaderHTTP(hh)
+	}
+}
+
+// RequestTimeout sets default request timeout.
+func RequestTimeout(d time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.requestTimeout = d
+	}
+}
+
+// PingInterval sets interval for sending ping messages.
+// Connection is considered lost if nothing is received for aliveTimeout.
+func PingInterval(ping, aliveTimeout time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.pingInterval = ping
+		c.aliveTimeout = aliveTimeout
+	}
+}
+
+// ReconnectInterval sets pause between reconnect attempts.
+func ReconnectInterval(d time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.reconnectInterval = d
+	}
+}
+
+// OnConnect sets handler called after each (re)connect.
+func OnConnect(h func()) func(*Client) {
+	return func(c *Client) {
+		c.onConnect = h
+	}
+}
+
+// Dial connects to the amp server on url (ws://host:port/path?meta=value).
+// Query string parameters are session meta.
+// After the first successful connect client reconnects until ctx is done or Close is called.
+func Dial(ctx context.Context, url string, opts ...func(*Client)) (*Client, error) {
+	c := &Client{
+		url:               url,
+		deflate:           true,
+		requestTimeout:    time.Minute,
+		pingInterval:      16 * time.Second,
+		aliveTimeout:      48 * time.Second,
+		reconnectInterval: time.Second,
+		topics:            make(map[string]*Topic),
+		requests:          make(map[uint64]*request),
+		done:              make(chan struct{}),
+	}
+	for _, fn := range opts {
+		fn(c)
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	if err := c.connect(); err != nil {
+		c.cancel()
+		return nil, err
+	}
+	go c.loop()
+	return c, nil
+}
+
+// MustDial raises fatal if unsuccessful
+func MustDial(ctx context.Context, url string, opts ...func(*Client)) *Client {
+	c, err := Dial(ctx, url, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// Close closes connection and stops reconnecting.
+// Blocks until client is finished.
+func (c *Client) Close() {
+	c.cancel()
+	<-c.done
+}
+
+// Done is closed when client is finished.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) dialURL() string {
+	c.Lock()
+	token := c.resumeToken
+	c.Unlock()
+	if token == "" {
+		return c.url
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return c.url
+	}
+	q := u.Query()
+	q.Set(session.ResumeMetaKey, token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *Client) connect() error {
+	d := ws.Dialer{
+		Header:  c.header,
+		Timeout: c.aliveTimeout,
+	}
+	if c.deflate {
+		d.Extensions = []httphead.Option{
+			wsflate.Parameters{
+				ServerNoContextTakeover: true,
+				ClientNoContextTakeover: true,
+			}.Option(),
+		}
+	}
+	d.Protocols = c.subprotocols()
+	conn, br, hs, err := d.Dial(c.ctx, c.dialURL())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	encoding, compression, _ := amp.ParseSubprotocol(hs.Protocol)
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	c.Lock()
+	c.conn, c.br, c.encoding, c.compression = conn, br, encoding, compression
+	c.Unlock()
+	if err := c.resubscribe(); err != nil {
+		conn.Close()
+		return err
+	}
+	if c.onConnect != nil {
+		c.onConnect()
+	}
+	return nil
+}
+
+// subprotocols offered to the server.
+func (c *Client) subprotocols() []string {
+	if c.version != amp.CompatibilityVersionDefault || (!c.msgpack && len(c.compressors) == 0) {
+		return nil
+	}
+	encoding := amp.EncodingJSON
+	if c.msgpack {
+		encoding = amp.EncodingMsgpack
+	}
+	var ps []string
+	for _, name := range c.compressors {
+		ps = append(ps, amp.Subprotocol(encoding, name))
+	}
+	return append(ps, amp.Subprotocol(encoding, ""))
+}
+
+// loop reads from connection and reconnects when connection is lost.
+func (c *Client) loop() {
+	defer close(c.done)
+	defer c.failRequests(ErrClosed)
+	for {
+		c.serve()
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.Lock()
+		resumable := c.resumeToken != ""
+		c.Unlock()
+		if !resumable {
+			c.failRequests(ErrDisconnected)
+		}
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(c.reconnectInterval):
+			}
+			if err := c.connect(); err != nil {
+				log.S("url", c.url).Error(err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// serve reads messages and sends pings until connection is lost.
+func (c *Client) serve() {
+	c.Lock()
+	conn, br, encoding, compression := c.conn, c.br, c.encoding, c.compression
+	c.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.send(&amp.Msg{Type: amp.Ping}); err != nil {
+					conn.Close()
+					return
+				}
+			case <-c.ctx.Done():
+				_ = c.write(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))
+				conn.Close()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(c.aliveTimeout))
+		payload, err := c.read(br)
+		if err != nil {
+			if c.ctx.Err() == nil && errors.Cause(err) != io.EOF {
+				log.S("url", c.url).Error(err)
+			}
+			conn.Close()
+			return
+		}
+		if payload == nil {
+			continue
+		}
+		if amp.IsAppCompression(compression) {
+			if payload, err = decompress(payload, compression); err != nil {
+				log.S("url", c.url).Error(err)
+				continue
+			}
+		}
+		var m *amp.Msg
+		switch {
+		case c.version == amp.CompatibilityVersion1:
+			m = amp.ParseV1FromServer(payload)
+		case encoding == amp.EncodingMsgpack:
+			m = amp.ParseMsgpack(payload)
+		default:
+			m = amp.Parse(payload)
+		}
+		if m != nil {
+			c.receive(m)
+		}
+	}
+}
+
+// decompress removes compression flag and decompresses payload if needed.
+func decompress(payload []byte, compression uint8) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("missing compression flag")
+	}
+	if payload[0] == 0 {
+		return payload[1:], nil
+	}
+	cp := amp.CompressorFor(compression)
+	if cp == nil {
+		return nil, errors.Errorf("unknown compression %d", compression)
+	}
+	return cp.Decompress(payload[1:])
+}
+
+// read reads next data message from the connection.
+// Control frames are handled while reading.
+func (c *Client) read(br *bufio.Reader) ([]byte, error) {
+	var payload []byte
+	compressed := false
+	for {
+		h, err := ws.ReadHeader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if h.Length < 0 || int64(len(payload))+h.Length > maxMessageSize {
+			return nil, errors.Errorf("message too large: %d", h.Length)
+		}
+		buf := make([]byte, h.Length)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if h.Masked {
+			ws.Cipher(buf, h.Mask, 0)
+		}
+		switch h.OpCode {
+		case ws.OpClose:
+			_ = c.write(ws.NewCloseFrame(buf))
+			return nil, errors.WithStack(io.EOF)
+		case ws.OpPing:
+			// control frames can be interleaved with fragments of the data message
+			if err := c.write(ws.NewPongFrame(buf)); err != nil {
+				return nil, err
+			}
+			continue
+		case ws.OpPong:
+			continue
+		case ws.OpText, ws.OpBinary:
+			compressed = h.Rsv1()
+			payload = buf
+		case ws.OpContinuation:
+			payload = append(payload, buf...)
+		}
+		if h.Fin {
+			break
+		}
+	}
+	if compressed {
+		payload = amp.Undeflate(payload)
+	}
+	return payload, nil
+}
+
+func (c *Client) receive(m *amp.Msg) {
+	switch m.Type {
+	case amp.Publish:
+		c.Lock()
+		t := c.topics[m.URI]
+		if t != nil && m.IsTopicClose() {
+			delete(c.topics, m.URI)
+		}
+		c.Unlock()
+		if t != nil {
+			t.apply(m)
+		}
+	case amp.Response:
+		c.response(m)
+	case amp.Ping:
+		_ = c.send(m.Pong())
+	case amp.Meta:
+		if token := m.Meta[session.ResumeMetaKey]; token != "" {
+			c.Lock()
+			c.resumeToken = token
+			c.Unlock()
+		}
+	}
+}
+
+func (c *Client) write(f ws.Frame) error {
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return errors.WithStack(ws.WriteFrame(conn, ws.MaskFrameInPlace(f)))
+}
+
+// send marshals message in the protocol version and writes it to the connection.
+func (c *Client) send(m *amp.Msg) error {
+	c.Lock()
+	conn, encoding := c.conn, c.encoding
+	c.Unlock()
+	var buf []byte
+	op := ws.OpText
+	switch {
+	case c.version == amp.CompatibilityVersion1:
+		buf = marshalV1(m)
+	case encoding == amp.EncodingMsgpack:
+		buf = m.MarshalMsgpack()
+		op = ws.OpBinary
+	default:
+		buf = m.Marshal()
+	}
+	if buf == nil {
+		return nil
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return errors.WithStack(wsutil.WriteClientMessage(conn, op, buf))
+}
+
+// marshalV1 packs client message in version 1 format.
+// Only ping and subscribe are supported.
+func marshalV1(m *amp.Msg) []byte {
+	type subscription struct {
+		Stream string `json:"s,omitempty"`
+		No     int64  `json:"n,omitempty"`
+	}
+	v1 := struct {
+		Type          uint8          `json:"t"`
+		Subscriptions []subscription `json:"u,omitempty"`
+	}{Type: m.Type}
+	switch m.Type {
+	case amp.Ping:
+	case amp.Subscribe:
+		for uri, ts := range m.Subscriptions {
+			v1.Subscriptions = append(v1.Subscriptions, subscription{
+				Stream: strings.TrimPrefix(uri, "sportsbook/"),
+				No:     ts,
+			})
+		}
+	default:
+		return nil
+	}
+	buf, _ := json.Marshal(v1)
+	return buf
+}
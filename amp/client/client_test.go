@@ -0,0 +1,312 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gobwas/ws"
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/session"
+	"github.com/minus5/svckit/amp/ws"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoRequester responds with request body, or with error for the "error" topic
+type echoRequester struct{}
+
+func (echoRequester) Send(s amp.Subscriber, m *amp.Msg) {
+	go func() {
+		if m.Topic() == "error" {
+			s.Send(m.ResponseError(errors.New("failed")))
+			return
+		}
+		var body map[string]interface{}
+		m.BodyTo(&body)
+		s.Send(m.PartialResponse(body))
+		s.Send(m.Response(body))
+	}()
+}
+func (echoRequester) Cancel(amp.Subscriber, *amp.Msg) {}
+func (echoRequester) Unsubscribe(amp.Subscriber)      {}
+func (echoRequester) Wait()                           {}
+
+type server struct {
+	url      string
+	broker   *broker.Broker
+	sessions *session.Sessions
+	in     chan *amp.Msg
+	stop   func()
+}
+
+func init() {
+	log.Discard()
+}
+
+func newServer(t *testing.T, v1 bool) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := broker.New(nil, nil)
+	in := make(chan *amp.Msg)
+	b.Consume(in)
+	ss := session.Factory(ctx, b, echoRequester{}, []string{"echo", "error"})
+	go ws.Listen(ctx, ln, func(c *ws.Conn) {
+		if v1 {
+			ss.ServeV1(c)
+			return
+		}
+		ss.Serve(c)
+	})
+	return &server{
+		url:      fmt.Sprintf("ws://%s/", ln.Addr().String()),
+		broker:   b,
+		sessions: ss,
+		in:     in,
+		stop: func() {
+			cancel()
+			close(in)
+		},
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+	s.in <- amp.NewPublish("t", "p", 1, amp.Full, map[string]interface{}{"a": 1, "b": 2})
+
+	c, err := Dial(context.Background(), s.url)
+	require.NoError(t, err)
+	defer c.Close()
+
+	updates := make(chan *amp.Msg, 16)
+	tp, err := c.Subscribe("t/p", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	assert.Equal(t, amp.Full, (<-updates).UpdateType)
+
+	s.in <- amp.NewPublish("t", "p", 2, amp.Diff, map[string]interface{}{"b": nil, "c": 3})
+	assert.Equal(t, amp.Diff, (<-updates).UpdateType)
+	var state map[string]int
+	ok, err := tp.State(&state)
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "c": 3}, state)
+	assert.Equal(t, int64(2), tp.Ts())
+}
+
+func TestMsgpack(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+	s.in <- amp.NewPublish("t", "p", 1, amp.Full, map[string]interface{}{"a": 1})
+
+	c, err := Dial(context.Background(), s.url, Msgpack())
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, amp.EncodingMsgpack, c.encoding)
+
+	updates := make(chan *amp.Msg, 16)
+	tp, err := c.Subscribe("t/p", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	<-updates
+	var state map[string]int
+	_, err = tp.State(&state)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1}, state)
+
+	rsp, err := c.Request(context.Background(), "echo/m", map[string]string{"b": "c"})
+	require.NoError(t, err)
+	var body map[string]string
+	require.NoError(t, rsp.BodyTo(&body))
+	assert.Equal(t, "c", body["b"])
+}
+
+func TestCompressors(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+	body := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		body[fmt.Sprintf("key%d", i)] = i
+	}
+	s.in <- amp.NewPublish("t", "p", 1, amp.Full, body)
+
+	c, err := Dial(context.Background(), s.url, Compressors("unknown", "deflate-dict"), NoDeflate())
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, amp.CompressionDeflateDict, c.compression)
+	assert.Equal(t, amp.EncodingJSON, c.encoding)
+
+	updates := make(chan *amp.Msg, 16)
+	tp, err := c.Subscribe("t/p", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	<-updates
+	var state map[string]int
+	_, err = tp.State(&state)
+	require.NoError(t, err)
+	assert.Equal(t, body, state)
+
+	// small, not compressed
+	rsp, err := c.Request(context.Background(), "echo/m", map[string]int{"a": 1})
+	require.NoError(t, err)
+	var rb map[string]int
+	require.NoError(t, rsp.BodyTo(&rb))
+	assert.Equal(t, 1, rb["a"])
+}
+
+func TestRequest(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+
+	c, err := Dial(context.Background(), s.url)
+	require.NoError(t, err)
+	defer c.Close()
+
+	parts := 0
+	rsp, err := c.RequestStream(context.Background(), "echo/m", map[string]int{"a": 1}, func(*amp.Msg) { parts++ })
+	require.NoError(t, err)
+	var body map[string]int
+	require.NoError(t, rsp.BodyTo(&body))
+	assert.Equal(t, 1, body["a"])
+	assert.Equal(t, 1, parts)
+
+	_, err = c.Request(context.Background(), "error/m", nil)
+	var er *ErrorResponse
+	require.True(t, errors.As(err, &er))
+	assert.Equal(t, "failed", er.Message)
+	assert.False(t, er.IsTransport())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Request(ctx, "unknown/m", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestReconnect(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+	s.in <- amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1})
+
+	connects := make(chan struct{}, 4)
+	c, err := Dial(context.Background(), s.url,
+		ReconnectInterval(time.Millisecond),
+		OnConnect(func() { connects <- struct{}{} }))
+	require.NoError(t, err)
+	defer c.Close()
+	<-connects
+
+	updates := make(chan *amp.Msg, 16)
+	_, err = c.Subscribe("t", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), (<-updates).Ts)
+
+	// drop connection, client should reconnect and resubscribe from ts 1
+	c.Lock()
+	c.conn.Close()
+	c.Unlock()
+	<-connects
+	s.in <- amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"a": 2})
+	for m := range updates {
+		if m.Ts == 2 {
+			break
+		}
+		assert.Equal(t, int64(1), m.Ts) // current state resent on resubscribe
+	}
+}
+
+func TestV1(t *testing.T) {
+	s := newServer(t, true)
+	defer s.stop()
+	s.in <- amp.NewPublish("sportsbook", "m", 1, amp.Full, map[string]int{"a": 1})
+
+	c, err := Dial(context.Background(), s.url, V1())
+	require.NoError(t, err)
+	defer c.Close()
+
+	updates := make(chan *amp.Msg, 16)
+	tp, err := c.Subscribe("sportsbook/m", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	m := <-updates
+	assert.Equal(t, amp.Full, m.UpdateType)
+	assert.Equal(t, "sportsbook/m", m.URI)
+	assert.NotNil(t, tp.StateJSON())
+
+	_, err = c.Request(context.Background(), "echo/m", nil)
+	assert.Equal(t, ErrNotSupported, err)
+}
+
+func TestReadInterleavedControlFrame(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+	c := &Client{conn: cc}
+	go func() {
+		_ = gws.WriteFrame(sc, gws.Frame{Header: gws.Header{OpCode: gws.OpText, Length: 2}, Payload: []byte("ab")})
+		_ = gws.WriteFrame(sc, gws.NewPingFrame([]byte("p")))
+		_, _ = gws.ReadFrame(sc) // pong
+		_ = gws.WriteFrame(sc, gws.Frame{Header: gws.Header{OpCode: gws.OpContinuation, Fin: true, Length: 2}, Payload: []byte("cd")})
+	}()
+	payload, err := c.read(bufio.NewReader(cc))
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(payload))
+}
+
+func TestTopicDiffBeforeFull(t *testing.T) {
+	var applied []*amp.Msg
+	tp := newTopic("t", 0, func(_ *Topic, m *amp.Msg) { applied = append(applied, m) })
+	tp.apply(amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"a": 2}))
+	ok, err := tp.State(&map[string]int{})
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), tp.Ts())
+	assert.Len(t, applied, 0)
+
+	tp.apply(amp.Parse(amp.NewPublish("t", "", 3, amp.Full, map[string]int{"a": 3}).Marshal()))
+	var state map[string]int
+	ok, err = tp.State(&state)
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 3}, state)
+	assert.Len(t, applied, 1)
+}
+
+// meta set by the client while stats are read from the broker and sessions
+func TestMetaStatsRace(t *testing.T) {
+	s := newServer(t, false)
+	defer s.stop()
+	s.in <- amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1})
+
+	c, err := Dial(context.Background(), s.url)
+	require.NoError(t, err)
+	defer c.Close()
+	updates := make(chan *amp.Msg, 16)
+	_, err = c.Subscribe("t", 0, func(_ *Topic, m *amp.Msg) { updates <- m })
+	require.NoError(t, err)
+	<-updates
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = c.send(&amp.Msg{Type: amp.Meta, Meta: map[string]string{fmt.Sprintf("k%d", i): "v"}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.broker.TopicStats()
+		s.sessions.Stats()
+	}
+	<-done
+	require.Eventually(t, func() bool {
+		for _, st := range s.sessions.Stats() {
+			if st.Meta["k99"] == "v" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
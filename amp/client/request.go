@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ErrorResponse is returned when server responds with error.
+type ErrorResponse struct {
+	Source  uint8
+	Message string
+	Code    int
+}
+
+func newErrorResponse(e *amp.Error) *ErrorResponse {
+	return &ErrorResponse{
+		Source:  e.Source,
+		Message: e.Message,
+		Code:    e.Code,
+	}
+}
+
+func (e *ErrorResponse) Error() string {
+	return e.Message
+}
+
+// IsTransport returns true for errors raised by the transport
+// (timeout, unknown topic...) and not by the application.
+func (e *ErrorResponse) IsTransport() bool {
+	return e.Source == amp.TransportError
+}
+
+type request struct {
+	rsp  chan *amp.Msg
+	part func(*amp.Msg)
+	err  error // set when request is failed without response
+}
+
+// Request sends request to the uri and waits for the response.
+// Timeout is ctx deadline or client default request timeout.
+// Request is canceled on the server if ctx is done before response.
+func (c *Client) Request(ctx context.Context, uri string, o interface{}) (*amp.Msg, error) {
+	return c.RequestStream(ctx, uri, o, nil)
+}
+
+// RequestStream is Request with handler for partial responses.
+// Returns after terminal response.
+func (c *Client) RequestStream(ctx context.Context, uri string, o interface{}, part func(*amp.Msg)) (*amp.Msg, error) {
+	if c.version == amp.CompatibilityVersion1 {
+		return nil, ErrNotSupported
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	m := amp.NewRequest(uri, o)
+	m.Timeout = int64(time.Until(deadline) / time.Millisecond)
+	r := &request{rsp: make(chan *amp.Msg, 1), part: part}
+	c.Lock()
+	c.correlationID++
+	m.CorrelationID = c.correlationID
+	c.requests[m.CorrelationID] = r
+	c.Unlock()
+
+	if err := c.send(m); err != nil {
+		c.removeRequest(m.CorrelationID)
+		return nil, err
+	}
+
+	select {
+	case rsp := <-r.rsp:
+		if rsp == nil {
+			return nil, r.err
+		}
+		if rsp.Error != nil {
+			return rsp, newErrorResponse(rsp.Error)
+		}
+		return rsp, nil
+	case <-ctx.Done():
+		if c.removeRequest(m.CorrelationID) {
+			_ = c.send(m.Cancel())
+		}
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+func (c *Client) removeRequest(correlationID uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.requests[correlationID]
+	delete(c.requests, correlationID)
+	return ok
+}
+
+// response finds request for the response
+func (c *Client) response(m *amp.Msg) {
+	c.Lock()
+	r, ok := c.requests[m.CorrelationID]
+	if ok && !m.IsPartial() {
+		delete(c.requests, m.CorrelationID)
+	}
+	c.Unlock()
+	if !ok {
+		return
+	}
+	if m.IsPartial() {
+		if r.part != nil {
+			r.part(m)
+		}
+		return
+	}
+	r.rsp <- m
+}
+
+// failRequests breaks all pending requests with err.
+func (c *Client) failRequests(err error) {
+	c.Lock()
+	requests := c.requests
+	c.requests = make(map[uint64]*request)
+	c.Unlock()
+	for _, r := range requests {
+		r.err = err
+		r.rsp <- nil
+	}
+}
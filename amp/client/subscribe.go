@@ -0,0 +1,59 @@
+package client
+
+import (
+	"github.com/minus5/svckit/amp"
+)
+
+// Subscribe to the topic uri, starting from ts (0 for the current state).
+// Handler is called for each message after topic state is updated.
+// Returns topic which holds local state.
+func (c *Client) Subscribe(uri string, ts int64, h func(*Topic, *amp.Msg)) (*Topic, error) {
+	c.Lock()
+	t, ok := c.topics[uri]
+	if !ok {
+		t = newTopic(uri, ts, h)
+		c.topics[uri] = t
+	}
+	c.Unlock()
+	if ok {
+		return t, nil
+	}
+	return t, c.resubscribe()
+}
+
+// Unsubscribe from the topic uri.
+func (c *Client) Unsubscribe(uri string) error {
+	c.Lock()
+	_, ok := c.topics[uri]
+	delete(c.topics, uri)
+	c.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.resubscribe()
+}
+
+// Topic returns subscribed topic or nil.
+func (c *Client) Topic(uri string) *Topic {
+	c.Lock()
+	defer c.Unlock()
+	return c.topics[uri]
+}
+
+// resubscribe sends all subscriptions with the last received timestamps.
+func (c *Client) resubscribe() error {
+	m := &amp.Msg{
+		Type:          amp.Subscribe,
+		Subscriptions: make(map[string]int64),
+	}
+	c.Lock()
+	topics := make([]*Topic, 0, len(c.topics))
+	for _, t := range c.topics {
+		topics = append(topics, t)
+	}
+	c.Unlock()
+	for _, t := range topics {
+		m.Subscriptions[t.URI()] = t.Ts()
+	}
+	return c.send(m)
+}
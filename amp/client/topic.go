@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+var defaultAppendDepth = 64
+
+// Topic is local state of the subscribed topic.
+// Full and Diff messages are merged into state, Append and Update messages
+// are kept in the window of the last CacheDepth messages.
+type Topic struct {
+	uri      string
+	ts       int64
+	full     *amp.Msg   // current state (full with all diffs merged)
+	appended []*amp.Msg // append window
+	depth    int
+	closed   bool
+	handler  func(*Topic, *amp.Msg)
+	sync.Mutex
+}
+
+func newTopic(uri string, ts int64, h func(*Topic, *amp.Msg)) *Topic {
+	return &Topic{
+		uri:     uri,
+		ts:      ts,
+		depth:   defaultAppendDepth,
+		handler: h,
+	}
+}
+
+// URI of the topic
+func (t *Topic) URI() string {
+	return t.uri
+}
+
+// Ts of the last received message
+func (t *Topic) Ts() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.ts
+}
+
+// Closed returns true if server closed the topic.
+func (t *Topic) Closed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.closed
+}
+
+// State unmarshals current topic state into v.
+// Returns false if there is no state yet.
+func (t *Topic) State(v interface{}) (bool, error) {
+	t.Lock()
+	full := t.full
+	t.Unlock()
+	if full == nil {
+		return false, nil
+	}
+	return true, full.BodyTo(v)
+}
+
+// StateJSON returns current topic state.
+func (t *Topic) StateJSON() json.RawMessage {
+	var raw json.RawMessage
+	if ok, err := t.State(&raw); !ok || err != nil {
+		return nil
+	}
+	return raw
+}
+
+// Appended returns current append window.
+func (t *Topic) Appended() []*amp.Msg {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*amp.Msg{}, t.appended...)
+}
+
+// apply updates topic state with the message and calls handler.
+func (t *Topic) apply(m *amp.Msg) {
+	t.Lock()
+	switch m.UpdateType {
+	case amp.Full:
+		t.full = m
+	case amp.Diff:
+		if m.Type == amp.Publish {
+			if t.full == nil {
+				// diff without state, wait for the full message
+				t.Unlock()
+				return
+			}
+			if merged, ok := t.full.Merge(m); ok {
+				t.full = merged
+			}
+		}
+	case amp.Append, amp.Update:
+		if m.CacheDepth > 0 {
+			t.depth = m.CacheDepth
+		}
+		t.appended = append(t.appended, m)
+		if l := len(t.appended); l > t.depth {
+			t.appended = t.appended[l-t.depth:]
+		}
+	case amp.Close:
+		t.closed = true
+	}
+	if m.Ts > 0 {
+		t.ts = m.Ts
+	}
+	h := t.handler
+	t.Unlock()
+	if h != nil {
+		h(t, m)
+	}
+}
@@ -0,0 +1,229 @@
+package amp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// Compression other than CompressionDeflate is done on the application level
+// (not by websocket extension) and negotiated with the websocket subprotocol:
+//
+//	amp.<encoding>+<compressor>   for example: amp.json+deflate-dict, amp.msgpack+deflate-dict
+//
+// Each message on such connection is binary frame with one byte prefix:
+// 0 - payload is not compressed, 1 - payload is compressed.
+
+// Compressor compresses message payloads.
+type Compressor interface {
+	Compress(src []byte) []byte
+	Decompress(src []byte) ([]byte, error)
+}
+
+// CompressionDeflateDict is deflate with preset dictionary.
+const CompressionDeflateDict uint8 = CompressionDeflate + 1
+
+type registeredCompressor struct {
+	name string
+	Compressor
+}
+
+var (
+	compressors     = map[uint8]*registeredCompressor{}
+	compressorsLock sync.RWMutex
+	encodingNames   = map[string]uint8{"json": EncodingJSON, "msgpack": EncodingMsgpack}
+)
+
+func init() {
+	RegisterCompressor("deflate-dict", NewDictDeflate(DefaultDictionary))
+}
+
+// RegisterCompressor adds compressor under the name used in negotiation.
+// Returns compression id. Registering existing name replaces compressor and keeps id.
+// Should be called before accepting connections.
+func RegisterCompressor(name string, c Compressor) uint8 {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	for id, rc := range compressors {
+		if rc.name == name {
+			rc.Compressor = c
+			return id
+		}
+	}
+	id := CompressionDeflateDict + uint8(len(compressors))
+	compressors[id] = &registeredCompressor{name: name, Compressor: c}
+	return id
+}
+
+// CompressorFor returns registered compressor for the compression id.
+func CompressorFor(compression uint8) Compressor {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	if rc, ok := compressors[compression]; ok {
+		return rc.Compressor
+	}
+	return nil
+}
+
+// IsAppCompression returns true if compression is done on the application level.
+func IsAppCompression(compression uint8) bool {
+	return compression >= CompressionDeflateDict
+}
+
+// Subprotocol returns websocket subprotocol name for the encoding and compression.
+func Subprotocol(encoding uint8, compressor string) string {
+	enc := "json"
+	if encoding == EncodingMsgpack {
+		enc = "msgpack"
+	}
+	if compressor == "" {
+		if encoding == EncodingMsgpack {
+			return MsgpackSubprotocol
+		}
+		return "amp." + enc
+	}
+	return fmt.Sprintf("amp.%s+%s", enc, compressor)
+}
+
+// ParseSubprotocol returns encoding and compression for the websocket subprotocol.
+// ok is false for unknown encoding or compressor.
+func ParseSubprotocol(p string) (encoding, compression uint8, ok bool) {
+	if !strings.HasPrefix(p, "amp.") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "amp."), "+", 2)
+	encoding, ok = encodingNames[parts[0]]
+	if !ok {
+		return 0, 0, false
+	}
+	if len(parts) == 1 {
+		return encoding, CompressionNone, true
+	}
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	for id, rc := range compressors {
+		if rc.name == parts[1] {
+			return encoding, id, true
+		}
+	}
+	return 0, 0, false
+}
+
+// SetCompressionLenLimit sets size of the payload below which messages are not compressed.
+// Safe to call while connections are served.
+func SetCompressionLenLimit(n int) {
+	atomic.StoreInt64(&compressionLenLimit, int64(n))
+}
+
+// MarshalFor packs message for the client connection with negotiated
+// compression, compatibility version and encoding. Returns true if
+// payload is compressed.
+func (m *Msg) MarshalFor(compression, version, encoding uint8) ([]byte, bool) {
+	return m.marshal(compression, version, encoding, false)
+}
+
+// compress payload and report raw and compressed size for the topic.
+func (m *Msg) compress(compression uint8, payload []byte) []byte {
+	var out []byte
+	if compression == CompressionDeflate {
+		out = deflate(payload)
+	} else if c := CompressorFor(compression); c != nil {
+		out = c.Compress(payload)
+	} else {
+		return payload
+	}
+	name := fmt.Sprintf("amp.compression.%s.%s", compressionName(compression), metricTopic(m.Topic()))
+	metric.Counter(name+".raw", len(payload))
+	metric.Counter(name+".compressed", len(out))
+	return out
+}
+
+func compressionName(compression uint8) string {
+	if compression == CompressionDeflate {
+		return "deflate"
+	}
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	if rc, ok := compressors[compression]; ok {
+		return rc.name
+	}
+	return "unknown"
+}
+
+func metricTopic(topic string) string {
+	if topic == "" {
+		return "none"
+	}
+	return strings.Replace(topic, ".", "_", -1)
+}
+
+// ErrDecompressedTooBig is returned when decompressed payload exceeds the limit.
+var ErrDecompressedTooBig = errors.New("decompressed payload too big")
+
+// DictDeflate is deflate compressor with preset dictionary.
+type DictDeflate struct {
+	dict    []byte
+	limit   int
+	writers sync.Pool
+}
+
+// DecompressLimit sets max size of the decompressed payload (default 16MB).
+func DecompressLimit(n int) func(*DictDeflate) {
+	return func(d *DictDeflate) {
+		d.limit = n
+	}
+}
+
+// NewDictDeflate creates compressor with dictionary dict.
+// Dictionary should contain strings frequent in the payloads,
+// the most frequent at the end. Client must use the same dictionary.
+func NewDictDeflate(dict []byte, opts ...func(*DictDeflate)) *DictDeflate {
+	d := &DictDeflate{dict: dict, limit: 16 * 1024 * 1024}
+	for _, o := range opts {
+		o(d)
+	}
+	d.writers.New = func() interface{} {
+		w, _ := flate.NewWriterDict(nil, flate.DefaultCompression, d.dict)
+		return w
+	}
+	return d
+}
+
+// Compress implements Compressor.
+func (d *DictDeflate) Compress(src []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := d.writers.Get().(*flate.Writer)
+	defer d.writers.Put(w)
+	w.Reset(buf)
+	_, _ = w.Write(src)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// Decompress implements Compressor.
+func (d *DictDeflate) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(src), d.dict)
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(d.limit)+1))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(out) > d.limit {
+		return nil, ErrDecompressedTooBig
+	}
+	return out, nil
+}
+
+// DefaultDictionary contains json fragments frequent in amp messages.
+// Applications should train their own on the topic payloads.
+var DefaultDictionary = []byte(`"error":null"id":"name":"type":"status":"value":"time":"data":` +
+	`"odds":"market":"outcome":"event":"sport":"live":"result":"score":` +
+	`truefalsenull,"t":0,"p":1,"p":2,"s":1,"u":"sportsbook/{"t":0,"u":"`)
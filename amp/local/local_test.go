@@ -0,0 +1,218 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSubscriber struct {
+	messages chan *amp.Msg
+}
+
+func newTestSubscriber() *testSubscriber {
+	return &testSubscriber{messages: make(chan *amp.Msg, 16)}
+}
+
+func (s *testSubscriber) Send(m *amp.Msg) {
+	s.messages <- m
+}
+
+func (s *testSubscriber) SendMsgs(ms []*amp.Msg) {
+	for _, m := range ms {
+		s.Send(m)
+	}
+}
+
+func (s *testSubscriber) Meta() map[string]string {
+	return nil
+}
+
+func (s *testSubscriber) Headers() map[string]string {
+	return nil
+}
+
+// next returns next message as it would be received by the client
+func (s *testSubscriber) next(t *testing.T) *amp.Msg {
+	select {
+	case m := <-s.messages:
+		return amp.Parse(m.Marshal())
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestRequester(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRequester(ctx)
+	r.Handle("math.req", func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		var p struct{ X, Y int }
+		if err := m.Unmarshal(&p); err != nil {
+			return nil, err
+		}
+		if p.X+p.Y == 42 {
+			return nil, errors.New("THE ANSWER")
+		}
+		return m.Response(p.X + p.Y), nil
+	})
+	r.HandleStream("math.stream", func(ctx context.Context, m *amp.Msg, send func(*amp.Msg)) (*amp.Msg, error) {
+		send(m.PartialResponse(1))
+		send(m.PartialResponse(2))
+		return m.Response(3), nil
+	})
+	s := newTestSubscriber()
+
+	request := func(uri string, correlationID uint64, body string) *amp.Msg {
+		return amp.Parse([]byte(fmt.Sprintf(`{"t":2,"i":%d,"u":"%s"}`+"\n%s", correlationID, uri, body)))
+	}
+
+	r.Send(s, request("math.req/add", 1, `{"X":1,"Y":2}`))
+	m := s.next(t)
+	assert.Equal(t, uint64(1), m.CorrelationID)
+	assert.Nil(t, m.Error)
+	var z int
+	require.NoError(t, m.BodyTo(&z))
+	assert.Equal(t, 3, z)
+
+	r.Send(s, request("math.req/add", 2, `{"X":40,"Y":2}`))
+	m = s.next(t)
+	assert.Equal(t, uint64(2), m.CorrelationID)
+	assert.Equal(t, amp.ApplicationError, m.Error.Source)
+
+	r.Send(s, request("unknown.req/add", 3, `{}`))
+	m = s.next(t)
+	assert.Equal(t, amp.TransportError, m.Error.Source)
+
+	r.Send(s, request("math.stream/count", 4, `{}`))
+	for i := 1; i <= 3; i++ {
+		m = s.next(t)
+		assert.Equal(t, uint64(4), m.CorrelationID)
+		assert.Equal(t, i == 3, !m.IsPartial())
+		require.NoError(t, m.BodyTo(&z))
+		assert.Equal(t, i, z)
+	}
+
+	cancel()
+	r.Wait()
+}
+
+func TestRequesterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRequester(ctx, RequestTimeout(50*time.Millisecond))
+	canceled := make(chan struct{}, 1)
+	r.Handle("slow.req", func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		<-ctx.Done()
+		canceled <- struct{}{}
+		return nil, ctx.Err()
+	})
+	s := newTestSubscriber()
+	m := &amp.Msg{Type: amp.Request, URI: "slow.req/wait", CorrelationID: 1}
+
+	// timeout
+	r.Send(s, m)
+	rsp := s.next(t)
+	assert.Equal(t, amp.TransportError, rsp.Error.Source)
+	assert.Equal(t, ErrRequestTimeout.Error(), rsp.Error.Message)
+	<-canceled
+
+	// cancel by the client
+	r.Send(s, m)
+	r.Cancel(s, m)
+	<-canceled
+	select {
+	case <-s.messages:
+		t.Fatal("response to canceled request")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// unsubscribe
+	r.Send(s, m)
+	r.Unsubscribe(s)
+	<-canceled
+}
+
+func TestRequesterLateResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRequester(ctx, RequestTimeout(10*time.Millisecond))
+	r.Handle("slow.req", func(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+		<-ctx.Done()
+		return m.Response("done"), nil
+	})
+	s := newTestSubscriber()
+	r.Send(s, &amp.Msg{Type: amp.Request, URI: "slow.req/wait", CorrelationID: 1})
+	rsp := s.next(t)
+	assert.Nil(t, rsp.Error)
+	var body string
+	require.NoError(t, rsp.Unmarshal(&body))
+	assert.Equal(t, "done", body)
+}
+
+func TestPublisherCloseWhileBlocked(t *testing.T) {
+	defer func(n int) { publisherQueueLen = n }(publisherQueueLen)
+	publisherQueueLen = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	pub := NewPublisher(ctx)
+	pub.Publish(amp.NewPublish("chat/lobby", "", 1, amp.Diff, "diff"))
+	blocked := make(chan struct{})
+	go func() {
+		pub.Publish(amp.NewPublish("chat/lobby", "", 2, amp.Diff, "diff")) // queue is full
+		close(blocked)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked after close")
+	}
+	<-pub.Messages()
+	_, ok := <-pub.Messages()
+	assert.False(t, ok)
+}
+
+func TestPublisherAndCurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRequester(ctx)
+	pub := NewPublisher(ctx)
+	b := broker.New(r.Current, nil)
+	b.Consume(pub.Messages())
+
+	var mu sync.Mutex
+	var currents []string
+	r.HandleCurrent("chat", func(uri string) {
+		mu.Lock()
+		currents = append(currents, uri)
+		mu.Unlock()
+		pub.Publish(amp.NewPublish(uri, "", 1, amp.Full, "state"))
+	})
+
+	c := newTestSubscriber()
+	b.Subscribe(c, map[string]int64{"chat/lobby": 0})
+	m := c.next(t)
+	assert.Equal(t, "chat/lobby", m.URI)
+	assert.Equal(t, int64(1), m.Ts)
+
+	pub.Publish(amp.NewPublish("chat/lobby", "", 2, amp.Diff, "diff"))
+	m = c.next(t)
+	assert.Equal(t, int64(2), m.Ts)
+
+	mu.Lock()
+	assert.Equal(t, []string{"chat/lobby"}, currents)
+	mu.Unlock()
+
+	cancel()
+	b.Wait()
+	r.Wait()
+	pub.Publish(amp.NewPublish("chat/lobby", "", 3, amp.Diff, "diff")) // dropped
+}
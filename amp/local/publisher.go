@@ -0,0 +1,74 @@
+package local
+
+import (
+	"context"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+var publisherQueueLen = 1024
+
+// Publisher passes published messages to the broker.
+// Example:
+//
+//	pub := local.NewPublisher(ctx)
+//	broker.Consume(pub.Messages())
+//	pub.Publish(amp.NewPublish("chat", "", amp.TS(), amp.Append, msg))
+type Publisher struct {
+	out    chan *amp.Msg
+	done   chan struct{}
+	closed bool
+	sync.RWMutex
+}
+
+// NewPublisher creates publisher. Messages channel is closed when ctx is done.
+func NewPublisher(ctx context.Context) *Publisher {
+	p := &Publisher{
+		out:  make(chan *amp.Msg, publisherQueueLen),
+		done: make(chan struct{}),
+	}
+	go func() {
+		<-ctx.Done()
+		p.close()
+	}()
+	return p
+}
+
+// Publish sends message to the broker.
+// Blocks while the queue is full.
+// Messages published after ctx is done are dropped.
+func (p *Publisher) Publish(m *amp.Msg) {
+	p.RLock()
+	defer p.RUnlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.out <- m:
+	case <-p.done:
+	}
+}
+
+// Pipe publishes all messages from in.
+// Returns when in is closed.
+func (p *Publisher) Pipe(in <-chan *amp.Msg) {
+	for m := range in {
+		p.Publish(m)
+	}
+}
+
+// Messages channel for the broker.Consume.
+func (p *Publisher) Messages() <-chan *amp.Msg {
+	return p.out
+}
+
+// close unblocks publishers waiting on the full queue, and closes out
+// when they are gone.
+func (p *Publisher) close() {
+	close(p.done)
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	close(p.out)
+}
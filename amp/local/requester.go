@@ -0,0 +1,248 @@
+// Package local is in-process replacement for amp/nsq.
+//
+// Requester routes requests to the Go handlers registered by topic,
+// Publisher feeds broker directly. Whole amp stack (broker, sessions,
+// backend handlers) can run in a single binary, without nsqd.
+//
+// Example:
+//
+//	requester := local.NewRequester(ctx)
+//	requester.Handle("math.req", handler)
+//	pub := local.NewPublisher(ctx)
+//	broker := broker.New(requester.Current, nil)
+//	broker.Consume(pub.Messages())
+//	sessions := session.Factory(ctx, broker, requester, topics)
+package local
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/trace"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultRequestTimeout is used when request has no timeout set.
+	DefaultRequestTimeout = time.Minute
+	// ErrRequestTimeout is sent to the client (as transport error) when
+	// handler does not finish in time.
+	ErrRequestTimeout = errors.New("request timeout")
+	// ErrNoHandler is sent to the client (as transport error) when there is
+	// no handler registered for the request topic.
+	ErrNoHandler = errors.New("no handler for the topic")
+)
+
+// Handler processes request. It calls send for each partial response and
+// returns terminal response. Context is canceled when the client cancels
+// request, unsubscribes or request timeout expires. Context carries trace
+// of the request (see trace.FromContext).
+type Handler func(ctx context.Context, m *amp.Msg, send func(*amp.Msg)) (*amp.Msg, error)
+
+// Requester routes requests to the handlers registered by topic.
+// Implements requester interface expected by session.Factory.
+type Requester struct {
+	handlers        map[string]Handler
+	currentHandlers map[string]func(string)
+	queue           map[uint64]*request // requests in process
+	correlationNo   uint64
+	timeout         time.Duration
+	closed          chan struct{}
+	wg              sync.WaitGroup
+	sync.Mutex
+}
+
+type request struct {
+	msg    *amp.Msg
+	source amp.Subscriber
+	cancel context.CancelFunc
+}
+
+// RequestTimeout sets default timeout for all requests.
+func RequestTimeout(d time.Duration) func(*Requester) {
+	return func(r *Requester) {
+		r.timeout = d
+	}
+}
+
+// NewRequester creates requester. Requests in process are canceled when ctx is done.
+func NewRequester(ctx context.Context, opts ...func(*Requester)) *Requester {
+	r := &Requester{
+		handlers:        make(map[string]Handler),
+		currentHandlers: make(map[string]func(string)),
+		queue:           make(map[uint64]*request),
+		timeout:         DefaultRequestTimeout,
+		closed:          make(chan struct{}),
+	}
+	for _, fn := range opts {
+		fn(r)
+	}
+	go r.waitDone(ctx)
+	return r
+}
+
+// Handle registers handler for requests on the topic.
+func (r *Requester) Handle(topic string, h func(context.Context, *amp.Msg) (*amp.Msg, error)) {
+	r.HandleStream(topic, func(ctx context.Context, m *amp.Msg, _ func(*amp.Msg)) (*amp.Msg, error) {
+		return h(ctx, m)
+	})
+}
+
+// HandleStream registers handler which can send partial responses.
+func (r *Requester) HandleStream(topic string, h Handler) {
+	r.Lock()
+	defer r.Unlock()
+	r.handlers[topic] = h
+}
+
+// HandleCurrent registers handler called when broker needs current state
+// of the uri on the topic. Handler should publish full message for the uri.
+func (r *Requester) HandleCurrent(topic string, h func(uri string)) {
+	r.Lock()
+	defer r.Unlock()
+	r.currentHandlers[topic] = h
+}
+
+// requestTimeout returns timeout for the message.
+// Timeout set by the client is respected if it is shorter than the default.
+func (r *Requester) requestTimeout(m *amp.Msg) time.Duration {
+	d := r.timeout
+	if m.Timeout > 0 {
+		if cd := time.Duration(m.Timeout) * time.Millisecond; cd < d || d <= 0 {
+			d = cd
+		}
+	}
+	return d
+}
+
+// Send calls handler for the request topic in separate goroutine.
+func (r *Requester) Send(e amp.Subscriber, m *amp.Msg) {
+	r.Lock()
+	h, ok := r.handlers[m.Topic()]
+	r.Unlock()
+	if !ok {
+		e.Send(m.ResponseTransportError(ErrNoHandler))
+		return
+	}
+
+	parent := trace.Continue(context.Background(), m.BackendHeaders)
+	ctx, cancel := context.WithTimeout(parent, r.requestTimeout(m))
+	r.Lock()
+	select {
+	case <-r.closed:
+		r.Unlock()
+		cancel()
+		e.Send(m.ResponseTransportError(context.Canceled))
+		return
+	default:
+	}
+	r.correlationNo++
+	correlationID := r.correlationNo
+	r.queue[correlationID] = &request{msg: m, source: e, cancel: cancel}
+	r.wg.Add(1)
+	r.Unlock()
+
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		r.handle(ctx, h, correlationID, m)
+	}()
+}
+
+func (r *Requester) handle(ctx context.Context, h Handler, correlationID uint64, m *amp.Msg) {
+	send := func(rm *amp.Msg) {
+		rm.ResponseType = amp.Partial
+		r.reply(correlationID, rm)
+	}
+	rm, err := h(ctx, m.Request(), send)
+	// response returned by the handler is sent even if it is late,
+	// timeout is reported only for the failed handler
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		log.Ctx(ctx).S("uri", m.URI).I("correlationID", int(m.CorrelationID)).Info("request timeout")
+		rm, err = m.ResponseTransportError(ErrRequestTimeout), nil
+	}
+	if err != nil {
+		rm = m.ResponseError(err)
+	}
+	if rm == nil {
+		// client waits for the terminal response
+		rm = m.Response(nil)
+	}
+	rm.ResponseType = amp.Terminal
+	r.reply(correlationID, rm)
+}
+
+// reply sends response to the request source.
+// Request is removed from the queue on terminal response.
+func (r *Requester) reply(correlationID uint64, m *amp.Msg) {
+	r.Lock()
+	req, ok := r.queue[correlationID]
+	if ok && !m.IsPartial() {
+		delete(r.queue, correlationID)
+	}
+	r.Unlock()
+	if !ok {
+		return
+	}
+	m.CorrelationID = req.msg.CorrelationID
+	req.source.Send(m)
+}
+
+// Cancel cancels context of the request with the same correlationID sent by e.
+func (r *Requester) Cancel(e amp.Subscriber, m *amp.Msg) {
+	r.Lock()
+	defer r.Unlock()
+	for key, req := range r.queue {
+		if req.source == e && req.msg.CorrelationID == m.CorrelationID {
+			req.cancel()
+			delete(r.queue, key)
+			return
+		}
+	}
+}
+
+// Unsubscribe cancels all requests of the e.
+func (r *Requester) Unsubscribe(e amp.Subscriber) {
+	r.Lock()
+	defer r.Unlock()
+	for key, req := range r.queue {
+		if req.source == e {
+			req.cancel()
+			delete(r.queue, key)
+		}
+	}
+}
+
+// Current calls current handler registered for the uri topic.
+func (r *Requester) Current(uri string) {
+	m := amp.NewCurrent(uri)
+	r.Lock()
+	h, ok := r.currentHandlers[m.Topic()]
+	r.Unlock()
+	if !ok {
+		return
+	}
+	// called from the broker loop, handler publishes back to the broker
+	go h(uri)
+}
+
+func (r *Requester) waitDone(ctx context.Context) {
+	<-ctx.Done()
+	r.Lock()
+	for key, req := range r.queue {
+		req.cancel()
+		delete(r.queue, key)
+	}
+	close(r.closed)
+	r.Unlock()
+	r.wg.Wait()
+}
+
+// Wait blocks until ctx is done and all handlers are finished.
+func (r *Requester) Wait() {
+	<-r.closed
+	r.wg.Wait()
+}
@@ -0,0 +1,95 @@
+package amp
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Merge merges diff message into m.
+// Both messages must be publish messages for the same uri, m of Diff or Full
+// update type and diff of Diff update type.
+// Result keeps update type of m. Null values from the diff are kept when
+// merging two diffs and removed when diff is merged into full.
+// Returns false if messages can't be merged (non json object bodies, or
+// diff sets object which m deletes; client has to delete it before merging
+// new value, so diffs must be sent separately).
+func (m *Msg) Merge(diff *Msg) (*Msg, bool) {
+	if m.Type != Publish || diff.Type != Publish ||
+		m.URI != diff.URI ||
+		diff.UpdateType != Diff ||
+		(m.UpdateType != Diff && m.UpdateType != Full) {
+		return nil, false
+	}
+	dst, ok := m.bodyObject()
+	if !ok {
+		return nil, false
+	}
+	src, ok := diff.bodyObject()
+	if !ok {
+		return nil, false
+	}
+	if !mergeObjects(dst, src, m.UpdateType == Full) {
+		return nil, false
+	}
+	body, err := json.Marshal(dst)
+	if err != nil {
+		return nil, false
+	}
+	return &Msg{
+		Type:       Publish,
+		URI:        m.URI,
+		UpdateType: m.UpdateType,
+		Ts:         diff.Ts,
+		Replay:     diff.Replay,
+		CacheDepth: diff.CacheDepth,
+		body:       body,
+	}, true
+}
+
+// bodyObject unmarshals message body into json object
+func (m *Msg) bodyObject() (map[string]interface{}, bool) {
+	body := m.body
+	if m.src != nil {
+		var err error
+		if body, err = m.src.MarshalJSON(); err != nil {
+			return nil, false
+		}
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var o map[string]interface{}
+	if err := d.Decode(&o); err != nil || o == nil {
+		return nil, false
+	}
+	return o, true
+}
+
+// mergeObjects merges src into dst. Returns false if src sets object on
+// the key deleted in dst (null in dst diff), that can't be expressed in
+// one diff.
+func mergeObjects(dst, src map[string]interface{}, removeNulls bool) bool {
+	for k, sv := range src {
+		if sv == nil && removeNulls {
+			delete(dst, k)
+			continue
+		}
+		so, ok := sv.(map[string]interface{})
+		if !ok {
+			dst[k] = sv
+			continue
+		}
+		dv, found := dst[k]
+		if found && dv == nil && !removeNulls {
+			return false
+		}
+		do, ok := dv.(map[string]interface{})
+		if !ok {
+			do = make(map[string]interface{})
+			dst[k] = do
+		}
+		if !mergeObjects(do, so, removeNulls) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,785 @@
+package amp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// Message is encoded as two MessagePack objects: header map (same keys as
+// in json header) followed by the body. Json body is converted to the
+// MessagePack value, if body is not valid json it is sent as bin.
+// No separator is needed, objects are self delimited.
+//
+// Body is converted between json and MessagePack in one pass, without
+// decoding into interface{}. There is no MessagePack library in the
+// dependencies, format subset used here is small (no ext types).
+
+// Wire encodings
+const (
+	EncodingJSON uint8 = iota
+	EncodingMsgpack
+)
+
+// MsgpackSubprotocol is websocket subprotocol which client uses to request
+// MessagePack encoding.
+const MsgpackSubprotocol = "amp.msgpack"
+
+var (
+	errMsgpackFormat = errors.New("msgpack: malformed")
+	errMsgpackDepth  = errors.New("msgpack: too deep")
+)
+
+// max nesting of maps and arrays
+const msgpackMaxDepth = 64
+
+// MarshalMsgpack packs the message that will be sent to the client in MessagePack encoding.
+func (m *Msg) MarshalMsgpack() []byte {
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, EncodingMsgpack, false)
+	return buf
+}
+
+// MarshalMsgpackDeflate packs and compress message in MessagePack encoding.
+func (m *Msg) MarshalMsgpackDeflate() ([]byte, bool) {
+	return m.marshal(CompressionDeflate, CompatibilityVersionDefault, EncodingMsgpack, false)
+}
+
+// MarshalForBackendMsgpack is binary variant of the MarshalForBackend.
+// ParseFromBackend recognizes both encodings.
+func (m *Msg) MarshalForBackendMsgpack() []byte {
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, EncodingMsgpack, true)
+	return buf
+}
+
+// ParseMsgpack decodes MessagePack encoded Msg received from client.
+func ParseMsgpack(buf []byte) *Msg {
+	return parseMsgpack(buf, false)
+}
+
+// ParseEncoding decodes message from client in the negotiated encoding.
+func ParseEncoding(buf []byte, version, encoding uint8) *Msg {
+	if encoding == EncodingMsgpack {
+		return ParseMsgpack(buf)
+	}
+	return ParseCompatibility(buf, version)
+}
+
+// isMsgpack recognizes MessagePack encoded message by the header map type byte.
+func isMsgpack(buf []byte) bool {
+	if len(buf) == 0 {
+		return false
+	}
+	b := buf[0]
+	return b&0xf0 == 0x80 || b == 0xde || b == 0xdf
+}
+
+func parseMsgpack(buf []byte, backend bool) *Msg {
+	if len(buf) == 0 {
+		return nil
+	}
+	r := &mpReader{buf: buf}
+	m, err := r.header(backend)
+	if err == nil && r.pos < len(buf) {
+		m.body, err = r.body()
+	}
+	if err != nil {
+		log.I("len", len(buf)).Error(err)
+		return nil
+	}
+	return m
+}
+
+// msgpackPayload encodes header and body
+func (m *Msg) msgpackPayload(backend bool) []byte {
+	var w mpWriter
+	m.msgpackHeader(&w, backend)
+	var body []byte
+	if m.body != nil {
+		body = m.body
+	}
+	if m.src != nil {
+		b, _ := m.src.MarshalJSON()
+		body = append(body, b...)
+	}
+	if len(body) > 0 {
+		w.body(body)
+	}
+	return w.buf
+}
+
+func (m *Msg) msgpackHeader(w *mpWriter, backend bool) {
+	type field struct {
+		key   string
+		value func()
+	}
+	var fs []field
+	add := func(ok bool, key string, value func()) {
+		if ok {
+			fs = append(fs, field{key, value})
+		}
+	}
+	add(m.Type != 0, "t", func() { w.uint(uint64(m.Type)) })
+	add(m.ReplyTo != "", "r", func() { w.str(m.ReplyTo) })
+	add(m.CorrelationID != 0, "i", func() { w.uint(m.CorrelationID) })
+	add(m.Error != nil, "e", func() { w.error(m.Error) })
+	add(m.URI != "", "u", func() { w.str(m.URI) })
+	add(m.Ts != 0, "s", func() { w.int(m.Ts) })
+	add(m.UpdateType != 0, "p", func() { w.uint(uint64(m.UpdateType)) })
+	add(m.Replay != 0, "l", func() { w.uint(uint64(m.Replay)) })
+	add(len(m.Subscriptions) > 0, "b", func() {
+		w.mapLen(len(m.Subscriptions))
+		for _, k := range sortedKeys(m.Subscriptions) {
+			w.str(k)
+			w.int(m.Subscriptions[k])
+		}
+	})
+	add(m.CacheDepth != 0, "d", func() { w.int(int64(m.CacheDepth)) })
+	add(m.Timeout != 0, "o", func() { w.int(m.Timeout) })
+	add(m.ResponseType != 0, "a", func() { w.uint(uint64(m.ResponseType)) })
+	add(len(m.Meta) > 0, "m", func() { w.strMap(m.Meta) })
+	add(backend && len(m.BackendHeaders) > 0, "h", func() { w.strMap(m.BackendHeaders) })
+
+	w.mapLen(len(fs))
+	for _, f := range fs {
+		w.str(f.key)
+		f.value()
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mpWriter appends MessagePack encoded values to the buf
+type mpWriter struct {
+	buf []byte
+}
+
+func (w *mpWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+// typed writes type byte followed by size bytes of big endian n
+func (w *mpWriter) typed(b byte, n uint64, size int) {
+	w.buf = append(w.buf, b)
+	for i := size - 1; i >= 0; i-- {
+		w.buf = append(w.buf, byte(n>>(8*uint(i))))
+	}
+}
+
+func (w *mpWriter) uint(n uint64) {
+	switch {
+	case n < 128:
+		w.byte(byte(n))
+	case n <= math.MaxUint8:
+		w.typed(0xcc, n, 1)
+	case n <= math.MaxUint16:
+		w.typed(0xcd, n, 2)
+	case n <= math.MaxUint32:
+		w.typed(0xce, n, 4)
+	default:
+		w.typed(0xcf, n, 8)
+	}
+}
+
+func (w *mpWriter) int(n int64) {
+	switch {
+	case n >= 0:
+		w.uint(uint64(n))
+	case n >= -32:
+		w.byte(byte(n))
+	case n >= math.MinInt8:
+		w.typed(0xd0, uint64(n), 1)
+	case n >= math.MinInt16:
+		w.typed(0xd1, uint64(n), 2)
+	case n >= math.MinInt32:
+		w.typed(0xd2, uint64(n), 4)
+	default:
+		w.typed(0xd3, uint64(n), 8)
+	}
+}
+
+func (w *mpWriter) float(f float64) {
+	w.typed(0xcb, math.Float64bits(f), 8)
+}
+
+func (w *mpWriter) str(s string) {
+	n := uint64(len(s))
+	switch {
+	case n < 32:
+		w.byte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		w.typed(0xd9, n, 1)
+	case n <= math.MaxUint16:
+		w.typed(0xda, n, 2)
+	default:
+		w.typed(0xdb, n, 4)
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *mpWriter) bin(b []byte) {
+	n := uint64(len(b))
+	switch {
+	case n <= math.MaxUint8:
+		w.typed(0xc4, n, 1)
+	case n <= math.MaxUint16:
+		w.typed(0xc5, n, 2)
+	default:
+		w.typed(0xc6, n, 4)
+	}
+	w.buf = append(w.buf, b...)
+}
+
+func (w *mpWriter) arrayLen(l int) {
+	n := uint64(l)
+	switch {
+	case n < 16:
+		w.byte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		w.typed(0xdc, n, 2)
+	default:
+		w.typed(0xdd, n, 4)
+	}
+}
+
+func (w *mpWriter) mapLen(l int) {
+	n := uint64(l)
+	switch {
+	case n < 16:
+		w.byte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		w.typed(0xde, n, 2)
+	default:
+		w.typed(0xdf, n, 4)
+	}
+}
+
+func (w *mpWriter) strMap(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.mapLen(len(keys))
+	for _, k := range keys {
+		w.str(k)
+		w.str(m[k])
+	}
+}
+
+func (w *mpWriter) error(e *Error) {
+	n := 0
+	if e.Source != 0 {
+		n++
+	}
+	if e.Message != "" {
+		n++
+	}
+	if e.Code != 0 {
+		n++
+	}
+	w.mapLen(n)
+	if e.Source != 0 {
+		w.str("s")
+		w.uint(uint64(e.Source))
+	}
+	if e.Message != "" {
+		w.str("m")
+		w.str(e.Message)
+	}
+	if e.Code != 0 {
+		w.str("c")
+		w.int(int64(e.Code))
+	}
+}
+
+// body converts json body to MessagePack value, or bin if it is not json.
+func (w *mpWriter) body(body []byte) {
+	start := len(w.buf)
+	it := jsonSerializer.BorrowIterator(body)
+	defer jsonSerializer.ReturnIterator(it)
+	switch it.WhatIsNext() {
+	case jsoniter.ObjectValue, jsoniter.ArrayValue:
+		ok := w.jsonValue(it, 0) && it.Error == nil
+		// nothing but whitespace after the value
+		it.WhatIsNext()
+		if ok && it.Error == io.EOF {
+			return
+		}
+	default:
+		// scalar is read up to the end of the buffer, validate first
+		if json.Valid(body) && w.jsonValue(it, 0) {
+			return
+		}
+	}
+	w.buf = w.buf[:start]
+	w.bin(body)
+}
+
+// jsonValue converts next json value.
+// Returns false if json is not valid or too deep.
+func (w *mpWriter) jsonValue(it *jsoniter.Iterator, depth int) bool {
+	switch it.WhatIsNext() {
+	case jsoniter.NilValue:
+		it.ReadNil()
+		w.byte(0xc0)
+	case jsoniter.BoolValue:
+		if it.ReadBool() {
+			w.byte(0xc3)
+		} else {
+			w.byte(0xc2)
+		}
+	case jsoniter.NumberValue:
+		w.number(it.ReadNumber())
+	case jsoniter.StringValue:
+		w.str(it.ReadString())
+	case jsoniter.ArrayValue:
+		if depth >= msgpackMaxDepth {
+			return false
+		}
+		pos, n := w.reserveLen(), 0
+		if !it.ReadArrayCB(func(it *jsoniter.Iterator) bool {
+			n++
+			return w.jsonValue(it, depth+1)
+		}) {
+			return false
+		}
+		w.patchLen(pos, n, (*mpWriter).arrayLen)
+	case jsoniter.ObjectValue:
+		if depth >= msgpackMaxDepth {
+			return false
+		}
+		pos, n := w.reserveLen(), 0
+		if !it.ReadMapCB(func(it *jsoniter.Iterator, key string) bool {
+			n++
+			w.str(key)
+			return w.jsonValue(it, depth+1)
+		}) {
+			return false
+		}
+		w.patchLen(pos, n, (*mpWriter).mapLen)
+	default:
+		return false
+	}
+	return true
+}
+
+func (w *mpWriter) number(n json.Number) {
+	if i, err := n.Int64(); err == nil {
+		w.int(i)
+	} else if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		w.uint(u)
+	} else {
+		f, _ := n.Float64()
+		w.float(f)
+	}
+}
+
+// reserveLen reserves space for the largest map or array header,
+// length is not known until all elements are written.
+func (w *mpWriter) reserveLen() int {
+	pos := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0, 0)
+	return pos
+}
+
+// patchLen writes header at the reserved position and removes unused space.
+func (w *mpWriter) patchLen(pos, n int, header func(*mpWriter, int)) {
+	h := mpWriter{buf: make([]byte, 0, 5)}
+	header(&h, n)
+	if l := len(h.buf); l < 5 {
+		copy(w.buf[pos+l:], w.buf[pos+5:])
+		w.buf = w.buf[:len(w.buf)-5+l]
+	}
+	copy(w.buf[pos:], h.buf)
+}
+
+// mpReader decodes MessagePack values from buf
+type mpReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *mpReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errMsgpackFormat
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *mpReader) uintN(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// mapLen reads map header if next value is map.
+func (r *mpReader) mapLen() (int, bool, error) {
+	if r.pos >= len(r.buf) {
+		return 0, false, nil
+	}
+	c := r.buf[r.pos]
+	switch {
+	case c&0xf0 == 0x80:
+		r.pos++
+		return int(c & 0x0f), true, nil
+	case c == 0xde, c == 0xdf:
+		r.pos++
+		n, err := r.uintN(2 << (c - 0xde))
+		return int(n), true, err
+	}
+	return 0, false, nil
+}
+
+// arrayLen reads array header if next value is array.
+func (r *mpReader) arrayLen() (int, bool, error) {
+	if r.pos >= len(r.buf) {
+		return 0, false, nil
+	}
+	c := r.buf[r.pos]
+	switch {
+	case c&0xf0 == 0x90:
+		r.pos++
+		return int(c & 0x0f), true, nil
+	case c == 0xdc, c == 0xdd:
+		r.pos++
+		n, err := r.uintN(2 << (c - 0xdc))
+		return int(n), true, err
+	}
+	return 0, false, nil
+}
+
+// value decodes next value.
+// Integers are returned as int64 (or uint64 if they don't fit), maps as
+// map[string]interface{}, bin as []byte.
+func (r *mpReader) value(depth int) (interface{}, error) {
+	if n, ok, err := r.mapLen(); ok {
+		if err != nil {
+			return nil, err
+		}
+		return r.mapValue(n, depth+1)
+	}
+	if n, ok, err := r.arrayLen(); ok {
+		if err != nil {
+			return nil, err
+		}
+		return r.arrayValue(n, depth+1)
+	}
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return r.strValue(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uintN(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(n))
+		return append([]byte{}, b...), err
+	case 0xca:
+		n, err := r.uintN(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := r.uintN(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := r.uintN(1 << (c - 0xcc))
+		if n <= math.MaxInt64 {
+			return int64(n), err
+		}
+		return n, err
+	case 0xd0:
+		n, err := r.uintN(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := r.uintN(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := r.uintN(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := r.uintN(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uintN(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.strValue(int(n))
+	}
+	return nil, errors.Errorf("msgpack: unsupported type 0x%x", c)
+}
+
+func (r *mpReader) strValue(n int) (string, error) {
+	b, err := r.next(n)
+	return string(b), err
+}
+
+func (r *mpReader) arrayValue(n, depth int) ([]interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgpackDepth
+	}
+	if n > len(r.buf)-r.pos {
+		return nil, errMsgpackFormat
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := r.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (r *mpReader) mapValue(n, depth int) (map[string]interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgpackDepth
+	}
+	if n > len(r.buf)-r.pos {
+		return nil, errMsgpackFormat
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := r.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
+
+// header decodes message header map.
+func (r *mpReader) header(backend bool) (*Msg, error) {
+	v, err := r.value(0)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMsgpackFormat
+	}
+	m := &Msg{}
+	for k, v := range h {
+		switch k {
+		case "t":
+			m.Type = uint8(toInt(v))
+		case "r":
+			m.ReplyTo = toString(v)
+		case "i":
+			m.CorrelationID = uint64(toInt(v))
+		case "e":
+			e := &Error{}
+			if em, ok := v.(map[string]interface{}); ok {
+				e.Source = uint8(toInt(em["s"]))
+				e.Message = toString(em["m"])
+				e.Code = int(toInt(em["c"]))
+			}
+			m.Error = e
+		case "u":
+			m.URI = toString(v)
+		case "s":
+			m.Ts = toInt(v)
+		case "p":
+			m.UpdateType = uint8(toInt(v))
+		case "l":
+			m.Replay = uint8(toInt(v))
+		case "b":
+			if vm, ok := v.(map[string]interface{}); ok {
+				m.Subscriptions = make(map[string]int64, len(vm))
+				for sk, sv := range vm {
+					m.Subscriptions[sk] = toInt(sv)
+				}
+			}
+		case "d":
+			m.CacheDepth = int(toInt(v))
+		case "o":
+			m.Timeout = toInt(v)
+		case "a":
+			m.ResponseType = uint8(toInt(v))
+		case "m":
+			m.Meta = toStringMap(v)
+		case "h":
+			if backend {
+				m.BackendHeaders = toStringMap(v)
+			}
+		}
+	}
+	return m, nil
+}
+
+// body decodes message body back to json.
+func (r *mpReader) body() ([]byte, error) {
+	if c := r.buf[r.pos]; c >= 0xc4 && c <= 0xc6 {
+		v, err := r.value(0)
+		if err != nil {
+			return nil, err
+		}
+		return v.([]byte), nil
+	}
+	s := jsonSerializer.BorrowStream(nil)
+	defer jsonSerializer.ReturnStream(s)
+	if err := r.json(s, 0); err != nil {
+		return nil, err
+	}
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	return append([]byte(nil), s.Buffer()...), nil
+}
+
+// json writes next value as json.
+// Map keys are converted to string, bin to base64 string.
+func (r *mpReader) json(s *jsoniter.Stream, depth int) error {
+	if depth > msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	if n, ok, err := r.mapLen(); ok {
+		if err != nil {
+			return err
+		}
+		if n > len(r.buf)-r.pos {
+			return errMsgpackFormat
+		}
+		s.WriteObjectStart()
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				s.WriteMore()
+			}
+			k, err := r.value(depth + 1)
+			if err != nil {
+				return err
+			}
+			s.WriteObjectField(fmt.Sprint(k))
+			if err := r.json(s, depth+1); err != nil {
+				return err
+			}
+		}
+		s.WriteObjectEnd()
+		return nil
+	}
+	if n, ok, err := r.arrayLen(); ok {
+		if err != nil {
+			return err
+		}
+		if n > len(r.buf)-r.pos {
+			return errMsgpackFormat
+		}
+		s.WriteArrayStart()
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				s.WriteMore()
+			}
+			if err := r.json(s, depth+1); err != nil {
+				return err
+			}
+		}
+		s.WriteArrayEnd()
+		return nil
+	}
+	v, err := r.value(depth)
+	if err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case nil:
+		s.WriteNil()
+	case bool:
+		s.WriteBool(t)
+	case int64:
+		s.WriteInt64(t)
+	case uint64:
+		s.WriteUint64(t)
+	case float64:
+		s.WriteFloat64(t)
+	case string:
+		s.WriteString(t)
+	case []byte:
+		s.WriteString(base64.StdEncoding.EncodeToString(t))
+	}
+	return nil
+}
+
+func toInt(v interface{}) int64 {
+	switch t := v.(type) {
+	case int64:
+		return t
+	case uint64:
+		return int64(t)
+	case float64:
+		return int64(t)
+	}
+	return 0
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+	return ""
+}
+
+func toStringMap(v interface{}) map[string]string {
+	vm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	m := make(map[string]string, len(vm))
+	for k, v := range vm {
+		m[k] = toString(v)
+	}
+	return m
+}
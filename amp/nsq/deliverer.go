@@ -0,0 +1,111 @@
+package nsq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/nsq"
+	"github.com/pkg/errors"
+)
+
+// BackendHeaders with the target of the delivery message.
+const (
+	DeliverKeyHeader   = "deliver-key"
+	DeliverValueHeader = "deliver-value"
+)
+
+type deliverer interface {
+	Deliver(key, value string, m *amp.Msg) int
+}
+
+// Delivered is the response body sent to the delivery message ReplyTo topic.
+type Delivered struct {
+	Sessions int    `json:"sessions"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// NewDelivery creates message for the sessions with meta key set to value.
+// Publish it to the topic consumed by Deliver.
+// If ReplyTo is set each amp instance responds with Delivered.
+func NewDelivery(key, value string, m *amp.Msg) *amp.Msg {
+	h := make(map[string]string, len(m.BackendHeaders)+2)
+	for k, v := range m.BackendHeaders {
+		h[k] = v
+	}
+	h[DeliverKeyHeader] = key
+	h[DeliverValueHeader] = value
+	m.BackendHeaders = h
+	return m
+}
+
+// Deliverer consumes delivery messages from nsq topic and sends them to the sessions.
+type Deliverer struct {
+	sub      *nsq.Consumer
+	pub      producer
+	sessions deliverer
+	instance string
+	msgs     sync.WaitGroup
+	done     chan struct{}
+}
+
+// Deliver starts consuming delivery messages (see NewDelivery) on the topic.
+// Each amp instance must use different nsq channel (default channel is per instance).
+// sessions is usually *session.Sessions with indexed meta keys.
+func Deliver(ctx context.Context, topic, instance string, sessions deliverer) (*Deliverer, error) {
+	d := &Deliverer{
+		sessions: sessions,
+		instance: instance,
+		done:     make(chan struct{}),
+	}
+	pub, err := nsq.NewProducer("")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d.pub = pub
+	sub, err := nsq.NewConsumer(topic, d.onMessage)
+	if err != nil {
+		pub.Close()
+		return nil, errors.WithStack(err)
+	}
+	d.sub = sub
+	go d.waitClose(ctx)
+	return d, nil
+}
+
+func (d *Deliverer) onMessage(nm *nsq.Message) error {
+	d.msgs.Add(1)
+	defer d.msgs.Done()
+	m := amp.ParseFromBackend(nm.Body)
+	if m == nil {
+		return nil
+	}
+	key, value := m.BackendHeaders[DeliverKeyHeader], m.BackendHeaders[DeliverValueHeader]
+	if key == "" || value == "" {
+		log.S("uri", m.URI).Info("delivery message without target")
+		return nil
+	}
+	n := d.sessions.Deliver(key, value, m)
+	if m.ReplyTo != "" {
+		rm := m.Response(Delivered{Sessions: n, Instance: d.instance})
+		rm.URI = m.URI
+		if err := d.pub.PublishTo(m.ReplyTo, marshal(rm)); err != nil {
+			log.S("replyTo", m.ReplyTo).Error(err)
+		}
+	}
+	return nil
+}
+
+func (d *Deliverer) waitClose(ctx context.Context) {
+	<-ctx.Done()
+	d.sub.Close()
+	d.msgs.Wait()
+	d.pub.Close()
+	close(d.done)
+}
+
+// Wait for clean exit.
+func (d *Deliverer) Wait() {
+	<-d.done
+}
@@ -0,0 +1,57 @@
+package nsq
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/nsq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type delivery struct {
+	key, value string
+	msg        *amp.Msg
+}
+
+type mockDeliverer struct {
+	deliveries []delivery
+	sessions   int
+}
+
+func (d *mockDeliverer) Deliver(key, value string, m *amp.Msg) int {
+	d.deliveries = append(d.deliveries, delivery{key: key, value: value, msg: m})
+	return d.sessions
+}
+
+func TestDelivererOnMessage(t *testing.T) {
+	p := newMockProducer()
+	s := &mockDeliverer{sessions: 2}
+	d := &Deliverer{pub: p, sessions: s, instance: "amp1"}
+
+	m := NewDelivery("userId", "42", amp.NewPublish("user/42", "", 1, amp.Event, map[string]int{"a": 1}))
+	m.ReplyTo = "deliver.rsp"
+	require.NoError(t, d.onMessage(&nsq.Message{Body: marshal(m)}))
+
+	require.Len(t, s.deliveries, 1)
+	dm := s.deliveries[0]
+	assert.Equal(t, "userId", dm.key)
+	assert.Equal(t, "42", dm.value)
+	assert.Equal(t, "user/42", dm.msg.URI)
+	assert.Equal(t, amp.Event, dm.msg.UpdateType)
+
+	rsp := p.next(t)
+	assert.Equal(t, "deliver.rsp", rsp.topic)
+	assert.Equal(t, amp.Response, rsp.msg.Type)
+	var body Delivered
+	require.NoError(t, rsp.msg.BodyTo(&body))
+	assert.Equal(t, Delivered{Sessions: 2, Instance: "amp1"}, body)
+
+	// without target or reply to
+	m = amp.NewPublish("user/42", "", 2, amp.Event, nil)
+	require.NoError(t, d.onMessage(&nsq.Message{Body: marshal(m)}))
+	m = NewDelivery("userId", "42", amp.NewPublish("user/42", "", 3, amp.Event, nil))
+	require.NoError(t, d.onMessage(&nsq.Message{Body: marshal(m)}))
+	assert.Len(t, s.deliveries, 2)
+	assert.Len(t, p.out, 0)
+}
@@ -0,0 +1,15 @@
+package nsq
+
+import "github.com/minus5/svckit/amp"
+
+// BackendEncoding of the messages published to nsq.
+// Consumers (ParseFromBackend) recognize both encodings, switch to
+// amp.EncodingMsgpack when all consumers of the topics are upgraded.
+var BackendEncoding = amp.EncodingJSON
+
+func marshal(m *amp.Msg) []byte {
+	if BackendEncoding == amp.EncodingMsgpack {
+		return m.MarshalForBackendMsgpack()
+	}
+	return m.MarshalForBackend()
+}
@@ -0,0 +1,81 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/minus5/svckit/amp/presence"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/nsq"
+	"github.com/pkg/errors"
+)
+
+// PresenceTransport exchanges presence reports between amp instances through nsq topic.
+// Every instance consumes topic on its own channel (default channel is per instance).
+type PresenceTransport struct {
+	topic  string
+	pub    *nsq.Producer
+	sub    *nsq.Consumer
+	ctx    context.Context
+	closed bool
+	sync.Mutex
+}
+
+// NewPresenceTransport creates transport for presence.Aggregate.
+// Transport is closed when ctx is done.
+func NewPresenceTransport(ctx context.Context, topic string) (*PresenceTransport, error) {
+	pub, err := nsq.NewProducer(topic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	t := &PresenceTransport{topic: topic, pub: pub, ctx: ctx}
+	go func() {
+		<-ctx.Done()
+		t.close()
+	}()
+	return t, nil
+}
+
+// Send implements presence.Transport.
+func (t *PresenceTransport) Send(r *presence.Report) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return t.pub.Publish(buf)
+}
+
+// Receive implements presence.Transport.
+func (t *PresenceTransport) Receive(receive func(*presence.Report)) {
+	sub, err := nsq.NewConsumer(t.topic, func(m *nsq.Message) error {
+		var r presence.Report
+		if err := json.Unmarshal(m.Body, &r); err != nil {
+			log.S("topic", t.topic).Error(err)
+			return nil
+		}
+		receive(&r)
+		return nil
+	})
+	if err != nil {
+		log.S("topic", t.topic).Error(err)
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		sub.Close()
+		return
+	}
+	t.sub = sub
+}
+
+func (t *PresenceTransport) close() {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	if t.sub != nil {
+		t.sub.Close()
+	}
+	t.pub.Close()
+}
@@ -3,49 +3,128 @@ package nsq
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
 	"github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/trace"
 	"github.com/pkg/errors"
 )
 
+var (
+	// DefaultRequestTimeout is used for topics without configured timeout.
+	DefaultRequestTimeout = time.Minute
+	// ErrRequestTimeout is sent to the client (as transport error) when
+	// response is not received in time.
+	ErrRequestTimeout = errors.New("request timeout")
+)
+
+// producer is implemented by nsq.Producer.
+type producer interface {
+	PublishTo(topic string, msg []byte) error
+	Close()
+}
+
 type Requester struct {
 	topic         string
-	producer      *nsq.Producer
+	producer      producer
 	consumer      *nsq.Consumer
 	queue         map[uint64]*request // requests in process
 	correlationNo uint64
 	closed        chan struct{}
+	timeout       time.Duration            // default request timeout
+	topicTimeouts map[string]time.Duration // request timeout per topic
 	sync.Mutex
 }
 
 type request struct {
-	msg    *amp.Msg
-	source amp.Subscriber
+	msg        *amp.Msg
+	source     amp.Subscriber
+	timeout    time.Duration
+	timer      *time.Timer      // fires when request deadline passes, nil without timeout
+	next       int              // sequence number of the next response
+	early      map[int]*amp.Msg // responses received before the previous ones
+	done       bool             // terminal response is sent to the source
+	sync.Mutex                  // orders responses sent to the source
+}
+
+func (q *request) stop() {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+}
+
+func (q *request) reset() {
+	if q.timer != nil {
+		q.timer.Reset(q.timeout)
+	}
+}
+
+// sequence returns responses which can be sent to the source, in order.
+// Response received before the previous ones is held until they arrive.
+// Responses without sequence number are not ordered.
+func (q *request) sequence(seq int, m *amp.Msg) []*amp.Msg {
+	if seq == 0 {
+		return []*amp.Msg{m}
+	}
+	if seq != q.next {
+		if seq > q.next {
+			if q.early == nil {
+				q.early = make(map[int]*amp.Msg)
+			}
+			q.early[seq] = m
+		}
+		return nil
+	}
+	msgs := []*amp.Msg{m}
+	q.next++
+	for {
+		em, ok := q.early[q.next]
+		if !ok {
+			break
+		}
+		delete(q.early, q.next)
+		msgs = append(msgs, em)
+		q.next++
+	}
+	return msgs
+}
+
+// RequestTimeout sets default timeout for all requests, 0 disables timeout.
+func RequestTimeout(d time.Duration) func(*Requester) {
+	return func(r *Requester) {
+		r.timeout = d
+	}
 }
 
-func MustRequester(ctx context.Context) *Requester {
-	r, err := NewRequester(ctx)
+// TopicTimeout sets request timeout for the topic, 0 disables timeout.
+func TopicTimeout(topic string, d time.Duration) func(*Requester) {
+	return func(r *Requester) {
+		r.topicTimeouts[topic] = d
+	}
+}
+
+func MustRequester(ctx context.Context, opts ...func(*Requester)) *Requester {
+	r, err := NewRequester(ctx, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return r
 }
 
-func NewRequester(ctx context.Context) (*Requester, error) {
+func NewRequester(ctx context.Context, opts ...func(*Requester)) (*Requester, error) {
 	p, err := nsq.NewProducer("")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	r := &Requester{
-		producer: p,
-		queue:    make(map[uint64]*request),
-		topic:    resposesTopicName(),
-		closed:   make(chan struct{}),
-	}
+	r := newRequester(p, opts...)
+	// responses are ordered per request by the sequence number
 	c, err := nsq.NewConsumer(r.topic, r.responses)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -55,6 +134,21 @@ func NewRequester(ctx context.Context) (*Requester, error) {
 	return r, nil
 }
 
+func newRequester(p producer, opts ...func(*Requester)) *Requester {
+	r := &Requester{
+		producer:      p,
+		queue:         make(map[uint64]*request),
+		topic:         resposesTopicName(),
+		closed:        make(chan struct{}),
+		timeout:       DefaultRequestTimeout,
+		topicTimeouts: make(map[string]time.Duration),
+	}
+	for _, fn := range opts {
+		fn(r)
+	}
+	return r
+}
+
 func resposesTopicName() string {
 	return fmt.Sprintf("z...rsp-%s-%s", env.AppName(), env.InstanceId())
 }
@@ -65,33 +159,113 @@ func (r *Requester) responses(nm *nsq.Message) error {
 	return nil
 }
 
+// SequenceHeader is BackendHeaders key with the sequence number of the
+// response, set by the responder. Requester sends responses of the request
+// to the client in that order.
+const SequenceHeader = "response-seq"
+
+func responseSeq(m *amp.Msg) int {
+	seq, _ := strconv.Atoi(m.BackendHeaders[SequenceHeader])
+	return seq
+}
+
+// reply sends response to the request source.
+// Request stays in the queue until terminal response is received,
+// each partial response extends request deadline for the request timeout.
 func (r *Requester) reply(correlationID uint64, m *amp.Msg) {
 	r.Lock()
 	req, ok := r.queue[correlationID]
-	if ok {
-		delete(r.queue, correlationID)
-	}
 	r.Unlock()
+	if !ok {
+		return
+	}
 
+	req.Lock()
+	defer req.Unlock()
+	for _, m := range req.sequence(responseSeq(m), m) {
+		if req.done {
+			return
+		}
+		if m.IsPartial() {
+			req.reset()
+		} else {
+			r.Lock()
+			delete(r.queue, correlationID)
+			r.Unlock()
+			req.stop()
+			req.done = true
+		}
+		m.CorrelationID = req.msg.CorrelationID
+		req.source.Send(m)
+	}
+}
+
+// requestTimeout returns timeout for the message.
+// Timeout set by the client is respected if it is shorter than the one
+// configured for the topic.
+func (r *Requester) requestTimeout(m *amp.Msg) time.Duration {
+	d := r.timeout
+	if td, ok := r.topicTimeouts[m.Topic()]; ok {
+		d = td
+	}
+	if m.Timeout > 0 {
+		if cd := time.Duration(m.Timeout) * time.Millisecond; cd < d || d <= 0 {
+			d = cd
+		}
+	}
+	return d
+}
+
+// expire removes request from the queue and sends transport error to the client.
+// Backend is notified so it can stop processing the request.
+// Nothing is done if the request is not pending any more.
+func (r *Requester) expire(correlationID uint64, m *amp.Msg) {
+	r.Lock()
+	req, ok := r.queue[correlationID]
+	r.Unlock()
 	if !ok {
 		return
 	}
-	m.CorrelationID = req.msg.CorrelationID
-	req.source.Send(m)
-	return
+	req.Lock()
+	defer req.Unlock()
+	// terminal response, cancel or unsubscribe could remove it in the meantime
+	r.Lock()
+	_, pending := r.queue[correlationID]
+	delete(r.queue, correlationID)
+	r.Unlock()
+	if !pending {
+		return
+	}
+	req.done = true
+
+	metric.Counter("requester.timeout")
+	metric.Counter(fmt.Sprintf("requester.timeout.%s", metricName(m.Topic())))
+	ctx := trace.Continue(context.Background(), m.BackendHeaders)
+	log.Ctx(ctx).S("uri", m.URI).I("correlationID", int(correlationID)).Info("request timeout")
+	rm := m.ResponseTransportError(ErrRequestTimeout)
+	rm.CorrelationID = m.CorrelationID
+	req.source.Send(rm)
+	r.cancelBackend(correlationID, m)
 }
 
 func (r *Requester) Send(e amp.Subscriber, m *amp.Msg) {
+	timeout := r.requestTimeout(m)
+
 	r.Lock()
 	r.correlationNo++
 	correlationID := r.correlationNo
-	r.queue[correlationID] = &request{msg: m, source: e}
+	req := &request{msg: m, source: e, timeout: timeout, next: 1}
+	if timeout > 0 {
+		req.timer = time.AfterFunc(timeout, func() { r.expire(correlationID, m) })
+	}
+	r.queue[correlationID] = req
 	r.Unlock()
 
 	rm := m.Request()
 	rm.CorrelationID = correlationID
 	rm.ReplyTo = r.topic
-	buf := rm.MarshalForBackend()
+	rm.Timeout = int64(timeout / time.Millisecond)
+	buf := marshal(rm)
 
 	go func() {
 		err := r.producer.PublishTo(m.Topic(), buf)
@@ -101,6 +275,49 @@ func (r *Requester) Send(e amp.Subscriber, m *amp.Msg) {
 	}()
 }
 
+// Cancel stops waiting for the response on the request with the same
+// correlationID sent by e. Cancellation is forwarded to the cancel topic
+// of the backend (see CancelTopic) so the responder can stop processing the request.
+func (r *Requester) Cancel(e amp.Subscriber, m *amp.Msg) {
+	r.Lock()
+	var correlationID uint64
+	var req *request
+	for key, q := range r.queue {
+		if q.source == e && q.msg.CorrelationID == m.CorrelationID {
+			correlationID, req = key, q
+			q.stop()
+			delete(r.queue, key)
+			break
+		}
+	}
+	r.Unlock()
+	if req == nil {
+		return
+	}
+	metric.Counter("requester.cancel")
+	r.cancelBackend(correlationID, req.msg)
+}
+
+// CancelTopic is topic on which requester sends cancellations for the
+// requests sent to the topic. Cancellations are not mixed with requests,
+// so responders which don't support them are not affected.
+func CancelTopic(topic string) string {
+	return topic + ".cancel"
+}
+
+// cancelBackend sends cancellation envelope to the cancel topic of the request backend.
+func (r *Requester) cancelBackend(correlationID uint64, m *amp.Msg) {
+	cm := m.Cancel()
+	cm.CorrelationID = correlationID
+	cm.ReplyTo = r.topic
+	buf := marshal(cm)
+	go func() {
+		if err := r.producer.PublishTo(CancelTopic(m.Topic()), buf); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
 // Current send current message for the uri
 func (r *Requester) Current(uri string) {
 	m := amp.NewCurrent(uri)
@@ -113,6 +330,7 @@ func (r *Requester) Unsubscribe(e amp.Subscriber) {
 	defer r.Unlock()
 	for key, req := range r.queue {
 		if req.source == e {
+			req.stop()
 			delete(r.queue, key)
 		}
 	}
@@ -125,6 +343,9 @@ func (r *Requester) waitDone(ctx context.Context) {
 	r.consumer.Close()
 	r.Lock()
 	defer r.Unlock()
+	for _, req := range r.queue {
+		req.stop()
+	}
 	r.queue = make(map[uint64]*request)
 	close(r.closed)
 }
@@ -132,3 +353,8 @@ func (r *Requester) waitDone(ctx context.Context) {
 func (r *Requester) Wait() {
 	<-r.closed
 }
+
+// metricName replaces dots in topic name so it can be used as part of the metric name.
+func metricName(topic string) string {
+	return strings.Replace(topic, ".", "_", -1)
+}
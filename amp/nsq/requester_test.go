@@ -0,0 +1,243 @@
+package nsq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	log.Discard()
+}
+
+type published struct {
+	topic string
+	msg   *amp.Msg
+}
+
+type mockProducer struct {
+	out chan published
+}
+
+func newMockProducer() *mockProducer {
+	return &mockProducer{out: make(chan published, 16)}
+}
+
+func (p *mockProducer) PublishTo(topic string, buf []byte) error {
+	p.out <- published{topic: topic, msg: amp.ParseFromBackend(buf)}
+	return nil
+}
+
+func (p *mockProducer) Close() {}
+
+func (p *mockProducer) next(t *testing.T) published {
+	select {
+	case pm := <-p.out:
+		return pm
+	case <-time.After(time.Second):
+		require.Fail(t, "nothing published")
+	}
+	return published{}
+}
+
+type mockSubscriber struct {
+	out chan *amp.Msg
+}
+
+func newMockSubscriber() *mockSubscriber {
+	return &mockSubscriber{out: make(chan *amp.Msg, 16)}
+}
+
+func (s *mockSubscriber) Send(m *amp.Msg) {
+	s.out <- m
+}
+
+func testRequest(correlationID uint64) *amp.Msg {
+	m := amp.NewRequest("math.req/add", map[string]int{"x": 1})
+	m.CorrelationID = correlationID
+	return m
+}
+
+func TestRequestExpire(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p, RequestTimeout(time.Minute), TopicTimeout("math.req", 20*time.Millisecond))
+	s := newMockSubscriber()
+
+	r.Send(s, testRequest(7))
+	req := p.next(t)
+	assert.Equal(t, "math.req", req.topic)
+	assert.Equal(t, int64(20), req.msg.Timeout)
+
+	select {
+	case rsp := <-s.out:
+		assert.Equal(t, amp.Response, rsp.Type)
+		assert.Equal(t, uint64(7), rsp.CorrelationID)
+		require.NotNil(t, rsp.Error)
+		assert.Equal(t, amp.TransportError, rsp.Error.Source)
+		assert.Equal(t, ErrRequestTimeout.Error(), rsp.Error.Message)
+	case <-time.After(time.Second):
+		require.Fail(t, "request not expired")
+	}
+	assert.Len(t, r.queue, 0)
+
+	// backend is notified on the cancel topic
+	cancel := p.next(t)
+	assert.Equal(t, "math.req.cancel", cancel.topic)
+	assert.True(t, cancel.msg.IsCancel())
+	assert.Equal(t, req.msg.CorrelationID, cancel.msg.CorrelationID)
+}
+
+func TestRequestCancel(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p)
+	s := newMockSubscriber()
+	other := newMockSubscriber()
+
+	r.Send(s, testRequest(7))
+	req := p.next(t)
+
+	// only source of the request can cancel it
+	r.Cancel(other, testRequest(7))
+	assert.Len(t, r.queue, 1)
+
+	r.Cancel(s, testRequest(7))
+	assert.Len(t, r.queue, 0)
+	cancel := p.next(t)
+	assert.Equal(t, "math.req.cancel", cancel.topic)
+	assert.Equal(t, amp.Cancel, cancel.msg.Type)
+	assert.Equal(t, req.msg.CorrelationID, cancel.msg.CorrelationID)
+	assert.Equal(t, r.topic, cancel.msg.ReplyTo)
+	assert.Equal(t, "math.req/add", cancel.msg.URI)
+
+	// late response is not delivered to the client
+	r.reply(req.msg.CorrelationID, req.msg.Response(nil))
+	select {
+	case m := <-s.out:
+		require.Fail(t, "response after cancel", m.Type)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRequestClientTimeout(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p, RequestTimeout(time.Minute))
+	m := testRequest(1)
+	m.Timeout = 30
+	assert.Equal(t, 30*time.Millisecond, r.requestTimeout(m))
+	r.topicTimeouts["math.req"] = 0
+	assert.Equal(t, 30*time.Millisecond, r.requestTimeout(m))
+}
+
+func TestRequestWithoutTimeout(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p, RequestTimeout(0))
+	s := newMockSubscriber()
+
+	r.Send(s, testRequest(1))
+	req := p.next(t)
+	assert.Equal(t, int64(0), req.msg.Timeout)
+	select {
+	case <-s.out:
+		require.Fail(t, "request without timeout expired")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// response is still delivered
+	rsp := req.msg.Response(map[string]int{"sum": 1})
+	r.reply(req.msg.CorrelationID, rsp)
+	m := <-s.out
+	assert.Equal(t, uint64(1), m.CorrelationID)
+	assert.Len(t, r.queue, 0)
+}
+
+func testResponse(req *amp.Msg, seq int, partial bool) *amp.Msg {
+	var rm *amp.Msg
+	if partial {
+		rm = req.PartialResponse(seq)
+	} else {
+		rm = req.Response(seq)
+	}
+	rm.BackendHeaders = withSequence(nil, seq)
+	return amp.ParseFromBackend(rm.MarshalForBackend())
+}
+
+func responseBody(t *testing.T, m *amp.Msg) int {
+	var v int
+	require.NoError(t, m.BodyTo(&v))
+	return v
+}
+
+func TestRequestResponsesOrder(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p)
+	s := newMockSubscriber()
+
+	r.Send(s, testRequest(7))
+	req := p.next(t).msg
+
+	// responses received out of order are sent in sequence order
+	r.reply(req.CorrelationID, testResponse(req, 2, true))
+	r.reply(req.CorrelationID, testResponse(req, 4, false))
+	assert.Len(t, s.out, 0)
+	r.reply(req.CorrelationID, testResponse(req, 1, true))
+	assert.Len(t, s.out, 2)
+	assert.Len(t, r.queue, 1)
+	r.reply(req.CorrelationID, testResponse(req, 3, true))
+	require.Len(t, s.out, 4)
+	for i := 1; i <= 4; i++ {
+		m := <-s.out
+		assert.Equal(t, uint64(7), m.CorrelationID)
+		assert.Equal(t, i < 4, m.IsPartial())
+		assert.Equal(t, i, responseBody(t, m))
+	}
+	assert.Len(t, r.queue, 0)
+}
+
+func TestRequestResponsesConcurrent(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p)
+	s := &mockSubscriber{out: make(chan *amp.Msg, 128)}
+
+	r.Send(s, testRequest(7))
+	req := p.next(t).msg
+	n := 100
+	var wg sync.WaitGroup
+	for i := n; i >= 1; i-- {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			r.reply(req.CorrelationID, testResponse(req, seq, seq < n))
+		}(i)
+	}
+	wg.Wait()
+	require.Len(t, s.out, n)
+	for i := 1; i <= n; i++ {
+		assert.Equal(t, i, responseBody(t, <-s.out))
+	}
+}
+
+func TestRequestExpireAfterResponse(t *testing.T) {
+	p := newMockProducer()
+	r := newRequester(p)
+	s := newMockSubscriber()
+
+	m := testRequest(7)
+	r.Send(s, m)
+	req := p.next(t).msg
+	r.reply(req.CorrelationID, req.Response(nil))
+	<-s.out
+
+	// timer fired while response was delivered
+	r.expire(req.CorrelationID, m)
+	assert.Len(t, s.out, 0)
+	select {
+	case pm := <-p.out:
+		require.Fail(t, "cancel after response", pm.topic)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -2,10 +2,16 @@ package nsq
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/log"
 	"github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/trace"
 )
 
 type Responder struct {
@@ -34,6 +40,9 @@ func (r *Responder) loop(in <-chan *amp.Msg) {
 	defer pub.Close()
 
 	for m := range in {
+		if m.IsCancel() {
+			continue
+		}
 		rm, err := r.handler(m)
 		if err != nil {
 			rm = m.ResponseError(err)
@@ -41,7 +50,7 @@ func (r *Responder) loop(in <-chan *amp.Msg) {
 		if rm == nil || m.ReplyTo == "" {
 			continue
 		}
-		if err := pub.PublishTo(m.ReplyTo, rm.MarshalForBackend()); err != nil {
+		if err := pub.PublishTo(m.ReplyTo, marshal(rm)); err != nil {
 			log.Error(err)
 		}
 	}
@@ -50,3 +59,231 @@ func (r *Responder) loop(in <-chan *amp.Msg) {
 func (r *Responder) Wait() {
 	<-r.done
 }
+
+// cancelRetention is how long cancellation of the request which is not
+// in process is remembered, in case request arrives after cancellation.
+var cancelRetention = time.Minute
+
+// ContextResponder calls handler for each request in separate goroutine.
+// Handler context is canceled when the client cancels request or when
+// request timeout expires. Cancellations are received on the cancel
+// topic of each request topic (see CancelTopic), on the channel of the
+// responder instance, so each instance gets all cancellations.
+type ContextResponder struct {
+	done      chan struct{}
+	handler   func(context.Context, *amp.Msg, func(*amp.Msg)) (*amp.Msg, error)
+	stream    bool                          // handler sends partial responses
+	inFlight  map[string]context.CancelFunc // cancel functions of requests in process
+	cancelled map[string]time.Time          // cancellations of requests not in process, with expiration
+	wg        sync.WaitGroup
+	sync.Mutex
+}
+
+// NewContextResponder creates responder with context aware handler.
+func NewContextResponder(ctx context.Context,
+	handler func(context.Context, *amp.Msg) (*amp.Msg, error),
+	topics []string) *ContextResponder {
+
+	h := func(ctx context.Context, m *amp.Msg, _ func(*amp.Msg)) (*amp.Msg, error) {
+		return handler(ctx, m)
+	}
+	return newContextResponder(ctx, h, false, topics)
+}
+
+// NewStreamResponder creates responder for requests with many responses.
+// Handler calls send for each partial response, and returns terminal response.
+// Request timeout is not applied to the handler context, it is canceled
+// when the client cancels request or requester stops waiting for the responses.
+//
+// Example:
+//
+//	func handler(ctx context.Context, m *amp.Msg, send func(*amp.Msg)) (*amp.Msg, error) {
+//		for _, chunk := range chunks {
+//			send(m.PartialResponse(chunk))
+//		}
+//		return m.Response(summary), nil
+//	}
+func NewStreamResponder(ctx context.Context,
+	handler func(context.Context, *amp.Msg, func(*amp.Msg)) (*amp.Msg, error),
+	topics []string) *ContextResponder {
+
+	return newContextResponder(ctx, handler, true, topics)
+}
+
+func newContextResponder(ctx context.Context,
+	handler func(context.Context, *amp.Msg, func(*amp.Msg)) (*amp.Msg, error),
+	stream bool,
+	topics []string) *ContextResponder {
+
+	r := &ContextResponder{
+		done:      make(chan struct{}),
+		handler:   handler,
+		stream:    stream,
+		inFlight:  make(map[string]context.CancelFunc),
+		cancelled: make(map[string]time.Time),
+	}
+
+	r.subscribeCancels(ctx, topics)
+	in := Subscribe(ctx, topics)
+	go r.loop(in)
+	return r
+}
+
+// subscribeCancels consumes cancel topics on the ephemeral channel of
+// this instance. Request is processed by one of the responder instances,
+// so all of them must get the cancellation.
+func (r *ContextResponder) subscribeCancels(ctx context.Context, topics []string) {
+	channel := fmt.Sprintf("%s-%s#ephemeral", env.AppName(), env.InstanceId())
+	var subs []*nsq.Consumer
+	for _, topic := range topics {
+		subs = append(subs, nsq.MustNewConsumer(CancelTopic(topic), r.onCancel, nsq.Channel(channel)))
+	}
+	go func() {
+		<-ctx.Done()
+		for _, sub := range subs {
+			sub.Close()
+		}
+	}()
+}
+
+func (r *ContextResponder) onCancel(nm *nsq.Message) error {
+	if m := amp.ParseFromBackend(nm.Body); m != nil && m.IsCancel() {
+		r.cancel(m)
+	}
+	return nil
+}
+
+func requestKey(m *amp.Msg) string {
+	return fmt.Sprintf("%s|%d", m.ReplyTo, m.CorrelationID)
+}
+
+func (r *ContextResponder) loop(in <-chan *amp.Msg) {
+	defer close(r.done)
+
+	pub := nsq.Pub("")
+	defer pub.Close()
+
+	for m := range in {
+		if m.IsCancel() {
+			continue
+		}
+		ctx, cancel := r.start(m)
+		if ctx.Err() != nil {
+			// canceled before it arrived
+			continue
+		}
+		r.wg.Add(1)
+		go func(m *amp.Msg) {
+			defer r.wg.Done()
+			defer r.finish(m, cancel)
+			r.handle(ctx, pub, m)
+		}(m)
+	}
+	r.wg.Wait()
+}
+
+// start creates context for the request and registers it's cancel function.
+// Context carries trace from the request BackendHeaders.
+// Returned context is canceled if cancellation arrived before the request.
+func (r *ContextResponder) start(m *amp.Msg) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	parent := trace.Continue(context.Background(), m.BackendHeaders)
+	if m.Timeout > 0 && !r.stream {
+		ctx, cancel = context.WithTimeout(parent, time.Duration(m.Timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	if m.ReplyTo != "" {
+		key := requestKey(m)
+		r.Lock()
+		if _, ok := r.cancelled[key]; ok {
+			delete(r.cancelled, key)
+			cancel()
+		} else {
+			r.inFlight[key] = cancel
+		}
+		r.Unlock()
+	}
+	return ctx, cancel
+}
+
+// finish releases request context.
+func (r *ContextResponder) finish(m *amp.Msg, cancel context.CancelFunc) {
+	if m.ReplyTo != "" {
+		r.Lock()
+		delete(r.inFlight, requestKey(m))
+		r.Unlock()
+	}
+	cancel()
+}
+
+func (r *ContextResponder) handle(ctx context.Context, pub *nsq.Producer, m *amp.Msg) {
+	seq := 0
+	publish := func(rm *amp.Msg) {
+		if m.ReplyTo == "" || ctx.Err() != nil {
+			// requester is not waiting for the response any more
+			return
+		}
+		seq++
+		rm.BackendHeaders = withSequence(rm.BackendHeaders, seq)
+		if err := pub.PublishTo(m.ReplyTo, marshal(rm)); err != nil {
+			log.Error(err)
+		}
+	}
+	send := func(rm *amp.Msg) {
+		rm.ResponseType = amp.Partial
+		publish(rm)
+	}
+
+	rm, err := r.handler(ctx, m, send)
+	if err != nil {
+		log.Ctx(ctx).S("uri", m.URI).Error(err)
+		rm = m.ResponseError(err)
+	}
+	if rm == nil {
+		if !r.stream {
+			return
+		}
+		// requester waits for the terminal response
+		rm = m.Response(nil)
+	}
+	rm.ResponseType = amp.Terminal
+	publish(rm)
+}
+
+// withSequence returns copy of the headers with the response sequence number.
+// Response headers are shared with the request.
+func withSequence(headers map[string]string, seq int) map[string]string {
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h[SequenceHeader] = strconv.Itoa(seq)
+	return h
+}
+
+// cancel cancels request in process, or remembers cancellation
+// if the request is not received yet.
+func (r *ContextResponder) cancel(m *amp.Msg) {
+	key := requestKey(m)
+	r.Lock()
+	cancel, ok := r.inFlight[key]
+	if !ok {
+		now := time.Now()
+		for k, exp := range r.cancelled {
+			if now.After(exp) {
+				delete(r.cancelled, k)
+			}
+		}
+		r.cancelled[key] = now.Add(cancelRetention)
+	}
+	r.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (r *ContextResponder) Wait() {
+	<-r.done
+}
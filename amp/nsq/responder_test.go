@@ -0,0 +1,64 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContextResponder() *ContextResponder {
+	return &ContextResponder{
+		inFlight:  make(map[string]context.CancelFunc),
+		cancelled: make(map[string]time.Time),
+	}
+}
+
+func testBackendRequest(correlationID uint64) *amp.Msg {
+	m := testRequest(correlationID)
+	m.ReplyTo = "rsp"
+	return m
+}
+
+// testBackendCancel creates cancellation as sent by the requester
+func testBackendCancel(m *amp.Msg) *amp.Msg {
+	cm := m.Cancel()
+	cm.ReplyTo = m.ReplyTo
+	return cm
+}
+
+func TestResponderCancel(t *testing.T) {
+	r := testContextResponder()
+	m := testBackendRequest(1)
+	ctx, cancel := r.start(m)
+	assert.NoError(t, ctx.Err())
+
+	r.cancel(testBackendCancel(m))
+	assert.Error(t, ctx.Err())
+	r.finish(m, cancel)
+	assert.Len(t, r.inFlight, 0)
+	assert.Len(t, r.cancelled, 0)
+}
+
+func TestResponderCancelBeforeRequest(t *testing.T) {
+	r := testContextResponder()
+	m := testBackendRequest(1)
+	r.cancel(testBackendCancel(m))
+	assert.Len(t, r.cancelled, 1)
+
+	// other request is not affected
+	ctx, _ := r.start(testBackendRequest(2))
+	assert.NoError(t, ctx.Err())
+
+	ctx, _ = r.start(m)
+	assert.Error(t, ctx.Err())
+	assert.Len(t, r.cancelled, 0)
+
+	// expired cancellations are removed
+	r.cancelled["old"] = time.Now().Add(-time.Second)
+	r.cancel(testBackendCancel(testBackendRequest(3)))
+	assert.NotContains(t, r.cancelled, "old")
+	assert.Len(t, r.cancelled, 1)
+}
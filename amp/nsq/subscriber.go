@@ -31,12 +31,14 @@ func (s *subscriber) onMessage(m *nsq.Message) error {
 	return nil
 }
 
-func Subscribe(ctx context.Context, topics []string) <-chan *amp.Msg {
+// Subscribe consumes amp messages from nsq topics.
+// Middlewares wrap handler of each topic consumer.
+func Subscribe(ctx context.Context, topics []string, mws ...nsq.Middleware) <-chan *amp.Msg {
 	out := make(chan *amp.Msg, 16)
 	s := &subscriber{
 		out: out,
 	}
-	if err := s.subscribe(topics); err != nil {
+	if err := s.subscribe(topics, mws); err != nil {
 		log.Fatal(err)
 	}
 	go s.waitClose(ctx)
@@ -50,9 +52,9 @@ func (s *subscriber) waitClose(ctx context.Context) {
 	close(s.out)
 }
 
-func (s *subscriber) subscribe(topics []string) error {
+func (s *subscriber) subscribe(topics []string, mws []nsq.Middleware) error {
 	for _, topic := range topics {
-		sub, err := nsq.NewConsumer(topic, s.onMessage, nsq.Ordered())
+		sub, err := nsq.NewConsumer(topic, s.onMessage, nsq.Ordered(), nsq.Middlewares(mws...))
 		if err != nil {
 			return errors.WithStack(err)
 		}
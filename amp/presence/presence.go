@@ -0,0 +1,361 @@
+// Package presence publishes number of subscribers of the broker topics
+// as regular amp topics.
+//
+// For each topic with one of the configured prefixes presence publishes
+// full message on the uri "presence/<topic>" with the Counts body.
+// Clients subscribe to it as to any other topic ("N people are watching").
+//
+// With Aggregate option each instance sends its local counts to the other
+// instances (amp/nsq.PresenceTransport) and sums reports of all instances,
+// so every broker publishes the same totals.
+//
+// Example:
+//
+//	transport, err := nsq.NewPresenceTransport(ctx, "amp.presence")
+//	presence.New(ctx, broker, broker.Publish,
+//		presence.Prefixes("sportsbook/m/"),
+//		presence.DistinctMeta("userId"),
+//		presence.Aggregate(transport))
+package presence
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/env"
+	"github.com/minus5/svckit/log"
+)
+
+// Topic is the amp topic with presence messages.
+const Topic = "presence"
+
+var (
+	// DefaultInterval between two presence reports.
+	DefaultInterval = 10 * time.Second
+	// DefaultDistinctLimit is max number of distinct meta values sent in report.
+	DefaultDistinctLimit = 1000
+	// reports of the instances not heard for expireIntervals are removed
+	expireIntervals = 3
+)
+
+type topicStatser interface {
+	TopicStats() []*broker.TopicStats
+}
+
+// Transport exchanges reports between instances.
+type Transport interface {
+	Send(*Report) error    // send report to all instances
+	Receive(func(*Report)) // receive reports of all instances
+}
+
+// Counts is the body of the presence message.
+type Counts struct {
+	Topic       string         `json:"topic"`
+	Subscribers int            `json:"subscribers"`
+	Distinct    map[string]int `json:"distinct,omitempty"` // number of distinct values of the meta keys
+}
+
+// Report contains subscriber counts of one instance.
+type Report struct {
+	Instance string                  `json:"instance"`
+	Ts       int64                   `json:"ts"`
+	Topics   map[string]*TopicReport `json:"topics"`
+}
+
+// TopicReport contains subscribers of one topic in instance.
+// Distinct values of the meta key are sent up to the distinct limit,
+// above it only their number. Values are merged across instances,
+// numbers are added.
+type TopicReport struct {
+	Subscribers int                 `json:"subscribers"`
+	Values      map[string][]string `json:"values,omitempty"`   // distinct values of the meta keys
+	Distinct    map[string]int      `json:"distinct,omitempty"` // number of distinct values over the limit
+}
+
+// Presence collects and publishes subscriber counts.
+type Presence struct {
+	broker    topicStatser
+	publish   func(*amp.Msg)
+	prefixes  []string
+	metaKeys  []string
+	limit     int // max distinct values in report
+	interval  time.Duration
+	instance  string
+	transport Transport
+	reports   map[string]*Report // last report by instance
+	published map[string]*Counts // last published counts by topic
+	done      chan struct{}
+	sync.Mutex
+}
+
+// Prefixes sets topic prefixes for which presence is published.
+// Without prefixes presence is not published for any topic.
+func Prefixes(prefixes ...string) func(*Presence) {
+	return func(p *Presence) {
+		p.prefixes = prefixes
+	}
+}
+
+// DistinctMeta adds number of distinct values of the session meta keys
+// (for example userId) to the counts.
+func DistinctMeta(keys ...string) func(*Presence) {
+	return func(p *Presence) {
+		p.metaKeys = keys
+	}
+}
+
+// DistinctLimit sets max number of distinct meta values of the topic sent
+// to the other instances (default DefaultDistinctLimit). Above the limit
+// only the number of values is sent, and values seen on more instances
+// are counted more than once.
+func DistinctLimit(n int) func(*Presence) {
+	return func(p *Presence) {
+		p.limit = n
+	}
+}
+
+// Interval sets how often counts are calculated and published.
+func Interval(d time.Duration) func(*Presence) {
+	return func(p *Presence) {
+		p.interval = d
+	}
+}
+
+// Instance sets name of the instance in reports. Default is env.InstanceId.
+func Instance(name string) func(*Presence) {
+	return func(p *Presence) {
+		p.instance = name
+	}
+}
+
+// Aggregate enables aggregation of counts across instances.
+func Aggregate(t Transport) func(*Presence) {
+	return func(p *Presence) {
+		p.transport = t
+	}
+}
+
+// New starts presence publishing for the broker.
+// publish is usually broker.Publish.
+func New(ctx context.Context, brk topicStatser, publish func(*amp.Msg), opts ...func(*Presence)) *Presence {
+	p := newPresence(brk, publish, opts...)
+	if p.transport != nil {
+		p.transport.Receive(p.receive)
+	}
+	go p.loop(ctx)
+	return p
+}
+
+func newPresence(brk topicStatser, publish func(*amp.Msg), opts ...func(*Presence)) *Presence {
+	p := &Presence{
+		broker:    brk,
+		publish:   publish,
+		interval:  DefaultInterval,
+		limit:     DefaultDistinctLimit,
+		instance:  env.InstanceId(),
+		reports:   make(map[string]*Report),
+		published: make(map[string]*Counts),
+		done:      make(chan struct{}),
+	}
+	for _, fn := range opts {
+		fn(p)
+	}
+	return p
+}
+
+func (p *Presence) loop(ctx context.Context) {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.tick()
+		}
+	}
+}
+
+// tick reports local counts and publishes changed totals.
+func (p *Presence) tick() {
+	r := p.local()
+	p.receive(r)
+	if p.transport != nil {
+		if err := p.transport.Send(r); err != nil {
+			log.Error(err)
+		}
+	}
+	for _, m := range p.changed() {
+		p.publish(m)
+	}
+}
+
+// Wait for clean exit.
+func (p *Presence) Wait() {
+	<-p.done
+}
+
+func (p *Presence) wanted(topic string) bool {
+	if strings.HasPrefix(topic, Topic+"/") {
+		return false
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// local counts subscribers of this instance.
+func (p *Presence) local() *Report {
+	r := &Report{
+		Instance: p.instance,
+		Ts:       time.Now().UnixNano() / int64(time.Millisecond),
+		Topics:   make(map[string]*TopicReport),
+	}
+	for _, ts := range p.broker.TopicStats() {
+		if !p.wanted(ts.Name) || len(ts.Subscribers) == 0 {
+			continue
+		}
+		tr := &TopicReport{Subscribers: len(ts.Subscribers)}
+		for _, key := range p.metaKeys {
+			values := make(map[string]struct{})
+			for _, s := range ts.Subscribers {
+				if v := s.Meta[key]; v != "" {
+					values[v] = struct{}{}
+				}
+			}
+			if len(values) > p.limit {
+				if tr.Distinct == nil {
+					tr.Distinct = make(map[string]int)
+				}
+				tr.Distinct[key] = len(values)
+				continue
+			}
+			if tr.Values == nil {
+				tr.Values = make(map[string][]string)
+			}
+			tr.Values[key] = sortedKeys(values)
+		}
+		r.Topics[ts.Name] = tr
+	}
+	return r
+}
+
+// receive stores report of the instance.
+func (p *Presence) receive(r *Report) {
+	p.Lock()
+	defer p.Unlock()
+	if old, ok := p.reports[r.Instance]; ok && old.Ts > r.Ts {
+		return
+	}
+	p.reports[r.Instance] = r
+}
+
+// totals sums reports of all live instances.
+func (p *Presence) totals() map[string]*Counts {
+	p.Lock()
+	defer p.Unlock()
+	expired := time.Now().Add(-time.Duration(expireIntervals)*p.interval).UnixNano() / int64(time.Millisecond)
+	values := make(map[string]map[string]map[string]struct{}) // topic -> key -> values
+	totals := make(map[string]*Counts)
+	add := func(topic, key string) map[string]struct{} {
+		set, ok := values[topic][key]
+		if !ok {
+			set = make(map[string]struct{})
+			values[topic][key] = set
+		}
+		return set
+	}
+	for instance, r := range p.reports {
+		if r.Ts < expired {
+			delete(p.reports, instance)
+			continue
+		}
+		for topic, tr := range r.Topics {
+			c, ok := totals[topic]
+			if !ok {
+				c = &Counts{Topic: topic}
+				totals[topic] = c
+				values[topic] = make(map[string]map[string]struct{})
+			}
+			c.Subscribers += tr.Subscribers
+			for key, vs := range tr.Values {
+				set := add(topic, key)
+				for _, v := range vs {
+					set[v] = struct{}{}
+				}
+			}
+			for key, n := range tr.Distinct {
+				add(topic, key)
+				if c.Distinct == nil {
+					c.Distinct = make(map[string]int)
+				}
+				c.Distinct[key] += n
+			}
+		}
+	}
+	for topic, keys := range values {
+		if len(keys) == 0 {
+			continue
+		}
+		if totals[topic].Distinct == nil {
+			totals[topic].Distinct = make(map[string]int)
+		}
+		for key, set := range keys {
+			totals[topic].Distinct[key] += len(set)
+		}
+	}
+	return totals
+}
+
+// changed returns presence messages for the topics with changed counts.
+// Topic without subscribers gets zero counts once.
+func (p *Presence) changed() []*amp.Msg {
+	totals := p.totals()
+	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	var msgs []*amp.Msg
+	for topic, c := range totals {
+		if old, ok := p.published[topic]; ok && equal(old, c) {
+			continue
+		}
+		p.published[topic] = c
+		msgs = append(msgs, amp.NewPublish(Topic, topic, ts, amp.Full, c))
+	}
+	for topic := range p.published {
+		if _, ok := totals[topic]; ok {
+			continue
+		}
+		delete(p.published, topic)
+		msgs = append(msgs, amp.NewPublish(Topic, topic, ts, amp.Full, &Counts{Topic: topic}))
+	}
+	return msgs
+}
+
+func equal(a, b *Counts) bool {
+	if a.Subscribers != b.Subscribers || len(a.Distinct) != len(b.Distinct) {
+		return false
+	}
+	for k, v := range a.Distinct {
+		if b.Distinct[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	s := make([]string, 0, len(m))
+	for k := range m {
+		s = append(s, k)
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,173 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockBroker struct {
+	stats []*broker.TopicStats
+}
+
+func (b *mockBroker) TopicStats() []*broker.TopicStats { return b.stats }
+
+func subscribers(userIDs ...string) []*broker.TopicSubscriber {
+	var ss []*broker.TopicSubscriber
+	for _, id := range userIDs {
+		ss = append(ss, &broker.TopicSubscriber{Meta: map[string]string{"userId": id}})
+	}
+	return ss
+}
+
+func counts(t *testing.T, msgs []*amp.Msg) map[string]*Counts {
+	cs := make(map[string]*Counts)
+	for _, m := range msgs {
+		m = amp.Parse(m.Marshal())
+		assert.Equal(t, Topic, m.Topic())
+		assert.True(t, m.IsFull())
+		var c Counts
+		require.NoError(t, m.BodyTo(&c))
+		assert.Equal(t, m.Path(), c.Topic)
+		cs[c.Topic] = &c
+	}
+	return cs
+}
+
+func TestLocalCounts(t *testing.T) {
+	brk := &mockBroker{stats: []*broker.TopicStats{
+		{Name: "sportsbook/m/1", Subscribers: subscribers("1", "2", "2")},
+		{Name: "sportsbook/m/2"},
+		{Name: "chat", Subscribers: subscribers("1")},
+		{Name: "presence/sportsbook/m/1", Subscribers: subscribers("1")},
+	}}
+	p := newPresence(brk, nil, Prefixes("sportsbook/m/"), DistinctMeta("userId"), Instance("a"))
+	r := p.local()
+	assert.Len(t, r.Topics, 1)
+	assert.Equal(t, 3, r.Topics["sportsbook/m/1"].Subscribers)
+	assert.Equal(t, []string{"1", "2"}, r.Topics["sportsbook/m/1"].Values["userId"])
+
+	p.receive(r)
+	cs := counts(t, p.changed())
+	assert.Len(t, cs, 1)
+	assert.Equal(t, 3, cs["sportsbook/m/1"].Subscribers)
+	assert.Equal(t, 2, cs["sportsbook/m/1"].Distinct["userId"])
+
+	// unchanged
+	p.receive(p.local())
+	assert.Len(t, p.changed(), 0)
+
+	// no more subscribers
+	brk.stats = nil
+	p.receive(p.local())
+	cs = counts(t, p.changed())
+	assert.Equal(t, 0, cs["sportsbook/m/1"].Subscribers)
+	assert.Len(t, p.changed(), 0)
+}
+
+func TestAggregate(t *testing.T) {
+	brk := &mockBroker{stats: []*broker.TopicStats{
+		{Name: "m/1", Subscribers: subscribers("1", "2")},
+	}}
+	p := newPresence(brk, nil, Prefixes("m/"), DistinctMeta("userId"), Instance("a"))
+	p.receive(p.local())
+
+	// report of the other instance, through nsq
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var other Report
+	buf, _ := json.Marshal(&Report{
+		Instance: "b",
+		Ts:       now,
+		Topics: map[string]*TopicReport{
+			"m/1": {Subscribers: 2, Values: map[string][]string{"userId": {"2", "3"}}},
+			"m/2": {Subscribers: 1, Values: map[string][]string{"userId": {"4"}}},
+		},
+	})
+	require.NoError(t, json.Unmarshal(buf, &other))
+	p.receive(&other)
+
+	cs := counts(t, p.changed())
+	assert.Equal(t, 4, cs["m/1"].Subscribers)
+	assert.Equal(t, 3, cs["m/1"].Distinct["userId"])
+	assert.Equal(t, 1, cs["m/2"].Subscribers)
+
+	// older report is ignored
+	p.receive(&Report{Instance: "b", Ts: now - 1})
+	assert.Len(t, p.changed(), 0)
+
+	// expired instance
+	p.Lock()
+	p.reports["b"].Ts = now - int64(expireIntervals)*int64(p.interval/time.Millisecond) - 1000
+	p.Unlock()
+	cs = counts(t, p.changed())
+	assert.Equal(t, 2, cs["m/1"].Subscribers)
+	assert.Equal(t, 0, cs["m/2"].Subscribers)
+}
+
+func TestDistinctLimit(t *testing.T) {
+	brk := &mockBroker{stats: []*broker.TopicStats{
+		{Name: "m/1", Subscribers: subscribers("1", "2", "3")},
+	}}
+	p := newPresence(brk, nil, Prefixes("m/"), DistinctMeta("userId"), DistinctLimit(2), Instance("a"))
+	r := p.local()
+	assert.Nil(t, r.Topics["m/1"].Values)
+	assert.Equal(t, 3, r.Topics["m/1"].Distinct["userId"])
+	p.receive(r)
+	p.receive(&Report{
+		Instance: "b",
+		Ts:       r.Ts,
+		Topics: map[string]*TopicReport{
+			"m/1": {Subscribers: 1, Values: map[string][]string{"userId": {"4"}}},
+		},
+	})
+	cs := counts(t, p.changed())
+	assert.Equal(t, 4, cs["m/1"].Subscribers)
+	assert.Equal(t, 4, cs["m/1"].Distinct["userId"])
+}
+
+func TestPublishToBroker(t *testing.T) {
+	brk := broker.New(nil, nil)
+	in := make(chan *amp.Msg, 16)
+	brk.Consume(in)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(ctx, brk, brk.Publish, Prefixes("m/"), Interval(10*time.Millisecond))
+
+	watcher := &sender{msgs: make(chan *amp.Msg, 16)}
+	brk.Subscribe(watcher, map[string]int64{"m/1": 0, "presence/m/1": 0})
+
+	for m := range watcher.msgs {
+		if m.Topic() != Topic {
+			continue
+		}
+		var c Counts
+		require.NoError(t, m.BodyTo(&c))
+		assert.Equal(t, 1, c.Subscribers)
+		break
+	}
+	cancel()
+	p.Wait()
+	close(in)
+	brk.Wait()
+}
+
+type sender struct {
+	msgs chan *amp.Msg
+}
+
+func (s *sender) Meta() map[string]string    { return nil }
+func (s *sender) Headers() map[string]string { return nil }
+func (s *sender) Send(m *amp.Msg) {
+	s.msgs <- amp.Parse(m.Marshal())
+}
+func (s *sender) SendMsgs(ms []*amp.Msg) {
+	for _, m := range ms {
+		s.Send(m)
+	}
+}
@@ -0,0 +1,199 @@
+// Package record writes amp messages to the file and replays them.
+//
+// Recording is gzipped file with one json line per message:
+//
+//	{"ts":1581085600000000000,"m":"<base64 of the message marshaled for backend>"}
+//
+// Message is base64 encoded because body is not necessarily valid UTF-8.
+// ts is unix nano time when message was received. Replay keeps original
+// intervals between messages, divided by speed factor.
+// Recordings can be used as test fixtures (see Load).
+package record
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/file"
+	"github.com/minus5/svckit/log"
+	"github.com/pkg/errors"
+)
+
+// max size of the one recorded message
+var maxLineSize = 64 * 1024 * 1024
+
+// Record is one recorded message.
+type Record struct {
+	Ts  int64    // unix nano time when message was received
+	Msg *amp.Msg // recorded message
+}
+
+type line struct {
+	Ts  int64  `json:"ts"`
+	Msg []byte `json:"m"`
+}
+
+// Writer writes messages to the recording.
+type Writer struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewWriter creates recording file at path.
+func NewWriter(path string) (*Writer, error) {
+	w, err := file.NewGzWriter(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Writer{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Write writes message with the current time.
+func (w *Writer) Write(m *amp.Msg) error {
+	return w.WriteAt(time.Now().UnixNano(), m)
+}
+
+// WriteAt writes message received at ts (unix nano).
+func (w *Writer) WriteAt(ts int64, m *amp.Msg) error {
+	return errors.WithStack(w.enc.Encode(line{Ts: ts, Msg: m.MarshalForBackend()}))
+}
+
+// Close flushes and closes file.
+func (w *Writer) Close() error {
+	return errors.WithStack(w.w.Close())
+}
+
+// Save writes all messages from in to the file at path.
+// Returns when in is closed or ctx is done.
+func Save(ctx context.Context, path string, in <-chan *amp.Msg) error {
+	w, err := NewWriter(path)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return w.Close()
+		case m, ok := <-in:
+			if !ok {
+				return w.Close()
+			}
+			if err := w.Write(m); err != nil {
+				_ = w.Close()
+				return err
+			}
+		}
+	}
+}
+
+// Reader reads recording.
+type Reader struct {
+	r       io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// NewReader opens recording at path.
+func NewReader(path string) (*Reader, error) {
+	r, err := file.NewGzReader(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	return &Reader{r: r, scanner: s}, nil
+}
+
+// Next returns next record, io.EOF at the end of the recording.
+func (r *Reader) Next() (*Record, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return nil, io.EOF
+	}
+	var l line
+	if err := json.Unmarshal(r.scanner.Bytes(), &l); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m := amp.ParseFromBackend(l.Msg)
+	if m == nil {
+		return nil, errors.Errorf("malformed message at %d", l.Ts)
+	}
+	return &Record{Ts: l.Ts, Msg: m}, nil
+}
+
+// Close closes file.
+func (r *Reader) Close() error {
+	return errors.WithStack(r.r.Close())
+}
+
+// Load reads all records from the recording.
+func Load(path string) ([]*Record, error) {
+	r, err := NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var rs []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return rs, nil
+		}
+		if err != nil {
+			return rs, err
+		}
+		rs = append(rs, rec)
+	}
+}
+
+// Replay sends messages from the recording to the returned channel.
+// Intervals between messages are divided by speed, speed <= 0 replays
+// without waiting. Channel is closed at the end of the recording or
+// when ctx is done.
+// Channel can be consumed by broker.Consume or amp/nsq.NewPublisher.
+func Replay(ctx context.Context, path string, speed float64) (<-chan *amp.Msg, error) {
+	r, err := NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan *amp.Msg)
+	go func() {
+		defer close(out)
+		defer r.Close()
+		var first int64
+		start := time.Now()
+		for {
+			rec, err := r.Next()
+			if err != nil {
+				if err != io.EOF {
+					log.S("path", path).Error(err)
+				}
+				return
+			}
+			if first == 0 {
+				first = rec.Ts
+			}
+			if speed > 0 {
+				at := start.Add(time.Duration(float64(rec.Ts-first) / speed))
+				if d := time.Until(at); d > 0 {
+					select {
+					case <-time.After(d):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case out <- rec.Msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,107 @@
+package record
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMessages() []*amp.Msg {
+	return []*amp.Msg{
+		amp.NewPublish("sportsbook/m", "1", 1, amp.Full, map[string]int{"a": 1, "b": 2}),
+		amp.NewPublish("sportsbook/m", "1", 2, amp.Diff, map[string]interface{}{"b": nil}),
+		amp.NewPublish("sportsbook/m", "1", 3, amp.Diff, map[string]int{"c": 3}),
+	}
+}
+
+func writeTestRecording(t *testing.T, interval time.Duration) string {
+	path := filepath.Join(t.TempDir(), "rec.gz")
+	w, err := NewWriter(path)
+	require.NoError(t, err)
+	ts := time.Now().UnixNano()
+	for i, m := range testMessages() {
+		require.NoError(t, w.WriteAt(ts+int64(i)*int64(interval), m))
+	}
+	require.NoError(t, w.Close())
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeTestRecording(t, time.Second)
+	rs, err := Load(path)
+	require.NoError(t, err)
+	require.Len(t, rs, 3)
+	for i, m := range testMessages() {
+		assert.Equal(t, m.URI, rs[i].Msg.URI)
+		assert.Equal(t, m.Ts, rs[i].Msg.Ts)
+		assert.Equal(t, m.UpdateType, rs[i].Msg.UpdateType)
+		assert.Equal(t, string(m.MarshalForBackend()), string(rs[i].Msg.MarshalForBackend()))
+	}
+	assert.Equal(t, int64(time.Second), rs[1].Ts-rs[0].Ts)
+}
+
+func TestBinaryBody(t *testing.T) {
+	raw := append(amp.NewPublish("bin", "", 1, amp.Full, nil).MarshalForBackend(), 0xff, 0xfe, 0x00, '\n')
+	m := amp.ParseFromBackend(raw)
+	require.NotNil(t, m)
+	path := filepath.Join(t.TempDir(), "rec.gz")
+	w, err := NewWriter(path)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(m))
+	require.NoError(t, w.Close())
+
+	rs, err := Load(path)
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	assert.Equal(t, m.MarshalForBackend(), rs[0].Msg.MarshalForBackend())
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.gz")
+	in := make(chan *amp.Msg, 3)
+	for _, m := range testMessages() {
+		in <- m
+	}
+	close(in)
+	require.NoError(t, Save(context.Background(), path, in))
+
+	out, err := Replay(context.Background(), path, 0)
+	require.NoError(t, err)
+	var ts []int64
+	for m := range out {
+		ts = append(ts, m.Ts)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, ts)
+}
+
+func TestReplaySpeed(t *testing.T) {
+	path := writeTestRecording(t, 100*time.Millisecond)
+
+	start := time.Now()
+	out, err := Replay(context.Background(), path, 4) // 200ms recording in 50ms
+	require.NoError(t, err)
+	n := 0
+	for range out {
+		n++
+	}
+	assert.Equal(t, 3, n)
+	d := time.Since(start)
+	assert.True(t, d >= 50*time.Millisecond, d)
+	assert.True(t, d < 200*time.Millisecond, d)
+}
+
+func TestReplayCancel(t *testing.T) {
+	path := writeTestRecording(t, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := Replay(ctx, path, 1)
+	require.NoError(t, err)
+	<-out
+	cancel()
+	_, ok := <-out
+	assert.False(t, ok)
+}
@@ -7,6 +7,7 @@ const messageType = {
     pong: 5,
     alive: 6,
     meta: 9,
+    cancel: 10,
 };
 
 const updateType = {
@@ -20,6 +21,11 @@ const updateType = {
   event: 8,
 };
 
+const responseType = {
+  terminal: 0,
+  partial: 1,
+};
+
 const keys = {
   "t": "type",
   "i": "correlationID",
@@ -29,6 +35,7 @@ const keys = {
   "p": "updateType",
   "b": "subscriptions",
   "m": "meta",
+  "a": "responseType",
 };
 
 const keysV1 = {
@@ -144,6 +151,7 @@ function now() {
 module.exports = {
   messageType: messageType,
   updateType: updateType,
+  responseType: responseType,
   unpack: unpack,
   unpackMsg: unpackMsg,
   pack: pack,
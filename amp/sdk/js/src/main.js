@@ -87,6 +87,11 @@ module.exports = function(config) {
       case amp.messageType.pong:
         pongReceived = true;
         break;
+      case amp.messageType.meta:
+        if (m.meta && m.meta.resume) { // resume token, used on reconnect
+          urls.meta.resume = m.meta.resume;
+        }
+        break;
       }
     }
     return pongReceived;
@@ -109,7 +114,7 @@ module.exports = function(config) {
     }
   }
 
-  transport.ws = Ws(urls.ws(), onMessage, onWsChange, config.v1);
+  transport.ws = Ws(urls.ws, onMessage, onWsChange, config.v1, config.compression);
   let sub    = Sub(subscribe, config.v1, config.transformBody, config.skipLists);
   let req    = Req();
 
@@ -131,11 +136,20 @@ module.exports = function(config) {
     send(msg, failHandlers.ignore);
   }
 
-  function request(uri, payload, ok, fail) {
+  function request(uri, payload, ok, fail, part) {
     ok = ok ||  function(){};
     fail = fail || failHandlers.default;
-    let msg = req.request(uri, payload, ok, fail);
+    let msg = req.request(uri, payload, ok, fail, part);
     send(msg, fail);
+    return msg.correlationID;
+  }
+
+  // cancel request, id is the value returned from request
+  function cancel(id) {
+    let msg = req.cancel(id);
+    if (msg) {
+      send(msg, failHandlers.ignore);
+    }
   }
 
   function setMeta(meta) {
@@ -155,6 +169,7 @@ module.exports = function(config) {
 
   return {
     request: request,
+    cancel: cancel,
     setMeta: setMeta,
     subscribe: sub.add,
     unSubscribe: sub.remove,
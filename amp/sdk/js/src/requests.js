@@ -10,6 +10,13 @@ module.exports = function() {
   function response(m) {
     let r = requests[m.correlationID];
     if (!r) {
+      return;
+    }
+    if (m.responseType === amp.responseType.partial) {
+      if (r.part) {
+        r.part(m.body);
+      }
+      return;
     }
 
     delete requests[m.correlationID];
@@ -21,7 +28,8 @@ module.exports = function() {
   }
 
   // create request message and store handlers (ok, fail) into requests
-  function request(uri, payload, ok, fail) {
+  // part is optional handler for partial responses
+  function request(uri, payload, ok, fail, part) {
     correlationID++;
     let msg = {
       type: amp.messageType.request,
@@ -29,13 +37,26 @@ module.exports = function() {
       correlationID: correlationID,
       body: payload
     };
-    requests[correlationID] = {ok: ok, fail: fail};
+    requests[correlationID] = {ok: ok, fail: fail, part: part};
     return msg;
   }
 
+  // create cancel message for the request and forget its handlers
+  function cancel(id) {
+    if (!requests[id]) {
+      return null;
+    }
+    delete requests[id];
+    return {
+      type: amp.messageType.cancel,
+      correlationID: id
+    };
+  }
+
   return {
     request: request,
-    response: response
+    response: response,
+    cancel: cancel
   };
   
 };
@@ -5,7 +5,9 @@ function now() {
   return (new Date()).getTime();
 }
 
-module.exports = function(uri, onMessage_, onChange_, v1) { // TODO get rid of this suffix_
+// compression is optional application level compression {name, decompress},
+// decompress gets Uint8Array payload and returns Uint8Array or string.
+module.exports = function(uri, onMessage_, onChange_, v1, compression) { // TODO get rid of this suffix_
 
   function onChange(status) {
     try{
@@ -24,6 +26,34 @@ module.exports = function(uri, onMessage_, onChange_, v1) { // TODO get rid of t
     return false;
   };
 
+  let decoder = (typeof TextDecoder !== "undefined") ? new TextDecoder() : null;
+
+  // decode binary frame: one byte flag (0 - plain, 1 - compressed) and payload
+  function decode(data) {
+    if (typeof data === "string") {
+      return data;
+    }
+    let buf = new Uint8Array(data);
+    if (buf.length === 0) {
+      return null;
+    }
+    let payload = buf.subarray(1);
+    if (buf[0] === 1) {
+      payload = compression.decompress(payload);
+      if (typeof payload === "string") {
+        return payload;
+      }
+    }
+    return decoder.decode(payload);
+  }
+
+  function protocols() {
+    if (!compression || !compression.name || !decoder) {
+      return undefined;
+    }
+    return ["amp.json+" + compression.name, "amp.json"];
+  }
+
   function createOpenGuard() {
     let resolve;
     return {
@@ -179,7 +209,8 @@ module.exports = function(uri, onMessage_, onChange_, v1) { // TODO get rid of t
     status.startConnect = now();
 
     try {
-      ws = new WebSocket(uri);
+      ws = new WebSocket(typeof uri === "function" ? uri() : uri, protocols());
+      ws.binaryType = "arraybuffer";
     } catch (e) {
       reconnect();
       status.event("wsError", e);
@@ -204,7 +235,14 @@ module.exports = function(uri, onMessage_, onChange_, v1) { // TODO get rid of t
     };
 
     ws.onmessage = function(e) {
-      let isPong = onMessage(e.data);
+      let data;
+      try {
+        data = decode(e.data);
+      } catch(err) {
+        status.event("decodeError", err);
+        return;
+      }
+      let isPong = onMessage(data);
       status.onMessage(isPong);
       ping.onMessage(isPong);
       pong.onMessage(isPong);
@@ -0,0 +1,301 @@
+package session
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// Authorization decisions
+const (
+	Allowed  uint8 = iota // client can use the topic
+	Denied                // client can't use the topic, and it is notified about that
+	Filtered              // topic is silently removed from the client message
+)
+
+// ErrForbidden is sent to the client on denied request or subscription.
+var ErrForbidden = errors.New("forbidden")
+
+const forbiddenCode = 403
+
+// Credentials of the client connection, used for authorization.
+type Credentials struct {
+	Meta     map[string]string // session metadata
+	Headers  map[string]string // http headers from the connection open request
+	Cookie   string
+	RemoteIP string
+}
+
+// Authorizer decides whether client can subscribe (msgType is amp.Subscribe)
+// or send request (amp.Request) to the topic.
+// For subscriptions topic is full subscription name, it can be a pattern.
+// Pattern subscription is authorized by the pattern and then by each topic
+// it matches; topics which are not Allowed are skipped silently. Matched
+// topics are authorized outside of the broker loop, and delivered after
+// the decision.
+// Decisions are cached per session until session metadata changes.
+type Authorizer interface {
+	Authorize(c Credentials, msgType uint8, topic string) uint8
+}
+
+// AuthorizerFunc is an adapter to use ordinary function as Authorizer.
+type AuthorizerFunc func(c Credentials, msgType uint8, topic string) uint8
+
+// Authorize calls f(c, msgType, topic).
+func (f AuthorizerFunc) Authorize(c Credentials, msgType uint8, topic string) uint8 {
+	return f(c, msgType, topic)
+}
+
+type authKey struct {
+	msgType uint8
+	topic   string
+}
+
+// authorize returns cached decision for the topic or asks authorizer.
+func (s *session) authorize(msgType uint8, topic string) uint8 {
+	if s.authorizer == nil {
+		return Allowed
+	}
+	key := authKey{msgType: msgType, topic: topic}
+	s.authLock.Lock()
+	d, ok := s.authCache[key]
+	s.authLock.Unlock()
+	if ok {
+		return d
+	}
+	d = s.authorizer.Authorize(s.credentials(), msgType, topic)
+	s.authLock.Lock()
+	if s.authCache == nil {
+		s.authCache = make(map[authKey]uint8)
+	}
+	s.authCache[key] = d
+	s.authLock.Unlock()
+	return d
+}
+
+// AllowTopic authorizes topic matched by the pattern subscription.
+// Called by the broker, from its loop, so authorizer is not called here.
+// Not yet authorized topic is authorized in the background, and the
+// session subscribes again when it becomes allowed.
+func (s *session) AllowTopic(name string) bool {
+	if s.authorizer == nil {
+		return true
+	}
+	return s.topicAuth().allow(name)
+}
+
+func (s *session) topicAuth() *patternAuth {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.patternAuth == nil {
+		s.patternAuth = newPatternAuth(func(topic string) uint8 {
+			return s.authorizer.Authorize(s.credentials(), amp.Subscribe, topic)
+		})
+	}
+	return s.patternAuth
+}
+
+func (s *session) credentials() Credentials {
+	conn := s.connection()
+	return Credentials{
+		Meta:     conn.Meta(),
+		Headers:  conn.Headers(),
+		Cookie:   conn.GetCookie(),
+		RemoteIP: connIP(conn),
+	}
+}
+
+// patternAuth authorizes topics matched by the pattern subscriptions.
+// Broker asks for decisions from its loop, so they are made in the
+// background; unknown topic is not allowed until authorizer decides.
+// sig is signaled when some topic becomes allowed, consumer should
+// subscribe again then and the broker will ask again.
+type patternAuth struct {
+	authorize func(topic string) uint8 // calls authorizer, can block
+	sig       chan struct{}
+	decisions map[string]uint8
+	pending   map[string]struct{} // topics waiting for the decision
+	running   bool                // background authorization is running
+	gen       int                 // incremented on reset, stale decisions are dropped
+	sync.Mutex
+}
+
+func newPatternAuth(authorize func(topic string) uint8) *patternAuth {
+	return &patternAuth{
+		authorize: authorize,
+		sig:       make(chan struct{}, 1),
+		decisions: make(map[string]uint8),
+		pending:   make(map[string]struct{}),
+	}
+}
+
+// allow returns cached decision for the topic.
+// Unknown topic is scheduled for authorization and not allowed.
+func (a *patternAuth) allow(topic string) bool {
+	a.Lock()
+	defer a.Unlock()
+	if d, ok := a.decisions[topic]; ok {
+		return d == Allowed
+	}
+	a.pending[topic] = struct{}{}
+	if !a.running {
+		a.running = true
+		go a.run()
+	}
+	return false
+}
+
+func (a *patternAuth) run() {
+	for {
+		a.Lock()
+		if len(a.pending) == 0 {
+			a.running = false
+			a.Unlock()
+			return
+		}
+		topics, gen := a.pending, a.gen
+		a.pending = make(map[string]struct{})
+		a.Unlock()
+
+		decisions := make(map[string]uint8)
+		for topic := range topics {
+			decisions[topic] = a.authorize(topic)
+		}
+
+		allowed := false
+		a.Lock()
+		if gen == a.gen {
+			for topic, d := range decisions {
+				a.decisions[topic] = d
+				allowed = allowed || d == Allowed
+			}
+		}
+		a.Unlock()
+		if allowed {
+			select {
+			case a.sig <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// reset clears decisions, after credentials change.
+func (a *patternAuth) reset() {
+	a.Lock()
+	defer a.Unlock()
+	a.decisions = make(map[string]uint8)
+	a.gen++
+}
+
+// authorizeSubscriptions removes not allowed topics from subscriptions.
+// Client is notified with topic close message for each denied topic.
+func (s *session) authorizeSubscriptions(subs map[string]int64) {
+	for name := range subs {
+		switch s.authorize(amp.Subscribe, name) {
+		case Allowed:
+			continue
+		case Denied:
+			s.Send(forbiddenClose(name))
+		}
+		delete(subs, name)
+	}
+}
+
+// reauthorize is called after session metadata change.
+// Clears decisions cache and authorizes all subscriptions requested by the
+// client again. Subscriptions which are no longer allowed are removed (client
+// is notified if denied), and those which became allowed are added.
+func (s *session) reauthorize() {
+	if s.authorizer == nil {
+		return
+	}
+	s.authLock.Lock()
+	s.authCache = nil
+	s.authLock.Unlock()
+	s.topicAuth().reset()
+	if len(s.requested) == 0 {
+		return
+	}
+	subs := make(map[string]int64)
+	for name := range s.requested {
+		ts, subscribed := s.subscriptions[name]
+		switch s.authorize(amp.Subscribe, name) {
+		case Allowed:
+			subs[name] = ts // 0 for the new one, client doesn't have any message
+		case Denied:
+			if subscribed {
+				s.Send(forbiddenClose(name))
+			}
+		}
+	}
+	s.setSubscriptions(subs)
+	// broker also authorizes again topics matched by patterns
+	s.broker.Subscribe(s, copySubscriptions(subs))
+}
+
+func copySubscriptions(o map[string]int64) map[string]int64 {
+	n := make(map[string]int64)
+	for k, v := range o {
+		n[k] = v
+	}
+	return n
+}
+
+// forbiddenClose creates topic close message for the denied subscription.
+func forbiddenClose(topic string) *amp.Msg {
+	return &amp.Msg{
+		Type:       amp.Publish,
+		URI:        topic,
+		UpdateType: amp.Close,
+		Error: &amp.Error{
+			Source:  amp.TransportError,
+			Message: ErrForbidden.Error(),
+			Code:    forbiddenCode,
+		},
+	}
+}
+
+// forbiddenResponse creates error response for the denied request.
+func forbiddenResponse(m *amp.Msg) *amp.Msg {
+	rm := m.ResponseTransportError(ErrForbidden)
+	rm.Error.Code = forbiddenCode
+	return rm
+}
+
+// authorizePool checks long pooling message.
+// There is no session so decisions are not cached.
+// Returns false if request should not be processed, and topic close
+// messages for denied subscriptions.
+func (s *Sessions) authorizePool(c Credentials, m *amp.Msg) (bool, []*amp.Msg) {
+	if s.authorizer == nil {
+		return true, nil
+	}
+	switch m.Type {
+	case amp.Request:
+		return s.authorizer.Authorize(c, amp.Request, m.Topic()) == Allowed, nil
+	case amp.Subscribe:
+		var closes []*amp.Msg
+		for name := range m.Subscriptions {
+			switch s.authorizer.Authorize(c, amp.Subscribe, name) {
+			case Allowed:
+				continue
+			case Denied:
+				closes = append(closes, forbiddenClose(name))
+			}
+			delete(m.Subscriptions, name)
+		}
+		return true, closes
+	}
+	return true, nil
+}
+
+// AllowTopic authorizes topic matched by the pattern subscription.
+// Called by the broker, decisions are made in the background as for the session.
+func (p *pooler) AllowTopic(name string) bool {
+	if p.patternAuth == nil {
+		return true
+	}
+	return p.patternAuth.allow(name)
+}
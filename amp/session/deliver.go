@@ -0,0 +1,112 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// MetaVerifier confirms that the client with credentials c owns meta value
+// (for example userId matches the authentication cookie).
+type MetaVerifier func(c Credentials, key, value string) bool
+
+// IndexMeta indexes connected sessions by the values of meta keys
+// (for example "userId", "deviceId"). Indexed sessions can be targeted with Deliver.
+// Meta is set by the client, so only values confirmed by verify are indexed.
+func IndexMeta(verify MetaVerifier, keys ...string) func(*Sessions) {
+	return func(s *Sessions) {
+		s.index = newMetaIndex(verify, keys)
+	}
+}
+
+// Deliver sends message directly to all connected sessions with meta key set to value.
+// Key must be one of the keys set by IndexMeta.
+// Returns number of sessions which received message.
+func (f *Sessions) Deliver(key, value string, m *amp.Msg) int {
+	if f.index == nil || value == "" {
+		return 0
+	}
+	ss := f.index.find(key, value)
+	for _, s := range ss {
+		s.Send(m)
+	}
+	metric.Counter("deliver."+key, len(ss))
+	return len(ss)
+}
+
+// metaIndex maps meta key and value to the sessions.
+type metaIndex struct {
+	keys     []string
+	verify   MetaVerifier
+	sessions map[string]map[string]map[*session]struct{} // key -> value -> sessions
+	values   map[*session]map[string]string              // indexed values of the session
+	sync.Mutex
+}
+
+func newMetaIndex(verify MetaVerifier, keys []string) *metaIndex {
+	i := &metaIndex{
+		keys:     keys,
+		verify:   verify,
+		sessions: make(map[string]map[string]map[*session]struct{}),
+		values:   make(map[*session]map[string]string),
+	}
+	for _, k := range keys {
+		i.sessions[k] = make(map[string]map[*session]struct{})
+	}
+	return i
+}
+
+// add indexes session by the current verified meta values.
+func (i *metaIndex) add(s *session) {
+	c := s.credentials()
+	values := make(map[string]string)
+	for _, k := range i.keys {
+		v := c.Meta[k]
+		if v == "" || i.verify == nil || !i.verify(c, k, v) {
+			continue
+		}
+		values[k] = v
+	}
+	i.Lock()
+	defer i.Unlock()
+	for k, v := range values {
+		vs, ok := i.sessions[k][v]
+		if !ok {
+			vs = make(map[*session]struct{})
+			i.sessions[k][v] = vs
+		}
+		vs[s] = struct{}{}
+	}
+	i.values[s] = values
+}
+
+// remove removes session from the index.
+func (i *metaIndex) remove(s *session) {
+	i.Lock()
+	defer i.Unlock()
+	for k, v := range i.values[s] {
+		vs := i.sessions[k][v]
+		delete(vs, s)
+		if len(vs) == 0 {
+			delete(i.sessions[k], v)
+		}
+	}
+	delete(i.values, s)
+}
+
+// update reindexes session after meta change.
+func (i *metaIndex) update(s *session) {
+	i.remove(s)
+	i.add(s)
+}
+
+func (i *metaIndex) find(key, value string) []*session {
+	i.Lock()
+	defer i.Unlock()
+	var ss []*session
+	for s := range i.sessions[key][value] {
+		ss = append(ss, s)
+	}
+	return ss
+}
@@ -9,15 +9,17 @@ import (
 )
 
 type requester interface {
-	Send(amp.Subscriber, *amp.Msg) // send request
-	Unsubscribe(amp.Subscriber)    // stop waiting for responses
-	Wait()                         // wait for clean exit
+	Send(amp.Subscriber, *amp.Msg)   // send request
+	Cancel(amp.Subscriber, *amp.Msg) // cancel request
+	Unsubscribe(amp.Subscriber)      // stop waiting for responses
+	Wait()                           // wait for clean exit
 }
 
 type broker interface {
 	Created(sender amp.Sender)
 	Subscribe(amp.Sender, map[string]int64) // subscribe to the topics
 	Unsubscribe(amp.Sender)                 // unsubscribe from all topics
+	Replay(string) []*amp.Msg               // current messages for the topic
 	Wait()                                  // wait for clean exit
 }
 
@@ -30,12 +32,56 @@ type connection interface {
 	GetBackendHeaders() map[string]string        // get BackendHeaders
 	No() uint64                                  // connection identifier (for grouping logs)
 	Close() error                                // close connection
-	Meta() map[string]string                     // session metadata, set by the client
-	SetMeta(map[string]string)                   // set session metadata
+	Meta() map[string]string                     // copy of session metadata, set by the client
+	SetMeta(map[string]string)                   // set session metadata, empty value removes key
 	GetRemoteIp() string
 	GetCookie() string
 }
 
+// encoder is implemented by connections which negotiate wire encoding
+type encoder interface {
+	Encoding() uint8 // amp.EncodingJSON or amp.EncodingMsgpack
+}
+
+// compressor is implemented by connections which negotiate compression
+type compressor interface {
+	Compression() uint8 // amp.CompressionNone, amp.CompressionDeflate, or application level
+}
+
+// ipResolver is implemented by connections which resolve client ip
+// from trusted proxies headers or tcp remote address
+type ipResolver interface {
+	ClientIP() string
+}
+
+// connIP returns client ip of the connection, or empty string if unknown.
+// GetRemoteIp is raw X-Forwarded-For header which client can set, so it is not used.
+func connIP(conn connection) string {
+	if r, ok := conn.(ipResolver); ok {
+		return r.ClientIP()
+	}
+	return ""
+}
+
+// connCompression returns compression supported by the connection.
+func connCompression(conn connection) uint8 {
+	if c, ok := conn.(compressor); ok {
+		return c.Compression()
+	}
+	if conn.DeflateSupported() {
+		return amp.CompressionDeflate
+	}
+	return amp.CompressionNone
+}
+
+// connEncoding returns wire encoding of the connection.
+func connEncoding(conn connection) uint8 {
+	if e, ok := conn.(encoder); ok {
+		return e.Encoding()
+	}
+	return amp.EncodingJSON
+}
+
 type counter struct {
 	value int
 	max   int
@@ -80,10 +126,19 @@ type Sessions struct {
 	// topicWhitelist is a list of topics that clients can send requests to.
 	// Empty value means block all.
 	topicWhitelist []string
+	authorizer     Authorizer
+	overflowPolicy *overflowPolicy
+	resume         *resumeConfig
+	parked         map[string]*parkedSession // sessions waiting for resume by token
+	live           map[*session]struct{}     // sessions with connected client
+	index          *metaIndex                // connected sessions by meta values, optional
+	limits         *rateLimits               // client messages rate limits, optional
+	sync.Mutex
 }
 
 // Factory creates new Sessions factory.
-func Factory(ctx context.Context, broker broker, requester requester, topicWhitelist []string) *Sessions {
+// opts are functions to set additional options.
+func Factory(ctx context.Context, broker broker, requester requester, topicWhitelist []string, opts ...func(*Sessions)) *Sessions {
 	cancelSig, cancelSessions := context.WithCancel(context.Background())
 	s := &Sessions{
 		broker:         broker,
@@ -91,18 +146,29 @@ func Factory(ctx context.Context, broker broker, requester requester, topicWhite
 		cancelSig:      cancelSig,
 		closed:         make(chan struct{}),
 		topicWhitelist: topicWhitelist,
+		live:           make(map[*session]struct{}),
+	}
+	for _, fn := range opts {
+		fn(s)
 	}
 
 	go s.waitDone(ctx, cancelSessions)
 	return s
 }
 
+// UseAuthorizer sets authorizer for client subscriptions and requests.
+func UseAuthorizer(a Authorizer) func(*Sessions) {
+	return func(s *Sessions) {
+		s.authorizer = a
+	}
+}
+
 // Serve creates new session for connection.
 // Blocks until connection is closed
 func (s *Sessions) Serve(conn connection) {
 	s.wg.Add(1)
 	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, s.topicWhitelist, amp.CompatibilityVersionDefault)
+	s.serve(conn, amp.CompatibilityVersionDefault)
 	s.wg.Done()
 	s.wsConnections.Down()
 }
@@ -112,7 +178,7 @@ func (s *Sessions) Serve(conn connection) {
 func (s *Sessions) ServeV1(conn connection) {
 	s.wg.Add(1)
 	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, s.topicWhitelist, amp.CompatibilityVersion1)
+	s.serve(conn, amp.CompatibilityVersion1)
 	s.wg.Done()
 	s.wsConnections.Down()
 }
@@ -136,28 +202,47 @@ var (
 	waitManyInterval = 2 * time.Millisecond
 )
 
-// Pool gets response messages for long pooling interface
+// Pool gets response messages for long pooling interface.
+// Authorizer gets only message meta, use PoolWithCredentials
+// to authorize by the http request.
 func (s *Sessions) Pool(m *amp.Msg) []*amp.Msg {
+	return s.PoolWithCredentials(m, Credentials{})
+}
+
+// PoolWithCredentials gets response messages for long pooling interface.
+// Credentials are taken from the http request (headers, cookie, remote ip),
+// meta is set from the message.
+func (s *Sessions) PoolWithCredentials(m *amp.Msg, c Credentials) []*amp.Msg {
 	s.wg.Add(1)
 	s.poolingConnections.Up()
 	defer s.wg.Done()
 	defer s.poolingConnections.Down()
 
+	c.Meta = m.Meta
+	ok, closes := s.authorizePool(c, m)
+	if !ok {
+		return []*amp.Msg{forbiddenResponse(m)}
+	}
 	switch m.Type {
 	case amp.Ping:
 		return []*amp.Msg{m.Pong()}
 	case amp.Request:
-		p := newPooler(m.Meta)
+		p := s.newPooler(c)
 		s.requester.Send(p, m)
 		p.waitOne(s.cancelSig, poolInterval)
 		s.requester.Unsubscribe(p)
 		return p.msgs
 	case amp.Subscribe:
-		p := newPooler(m.Meta)
+		if len(m.Subscriptions) == 0 && len(closes) > 0 {
+			return closes
+		}
+		p := s.newPooler(c)
 		s.broker.Subscribe(p, m.Subscriptions)
-		p.wait(s.cancelSig, poolInterval)
+		p.wait(s.cancelSig, poolInterval, func() {
+			s.broker.Subscribe(p, m.Subscriptions)
+		})
 		s.broker.Unsubscribe(p)
-		return p.msgs
+		return append(closes, p.msgs...)
 	}
 	return nil
 }
@@ -166,19 +251,27 @@ func (s *Sessions) ConnectionsCount() (int, int) {
 	return s.wsConnections.Count(), s.poolingConnections.Count()
 }
 
-func newPooler(meta map[string]string) *pooler {
+func (s *Sessions) newPooler(c Credentials) *pooler {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &pooler{
-		msgWait: ctx,
-		onMsg:   cancel,
+	p := &pooler{
+		credentials: c,
+		msgWait:     ctx,
+		onMsg:       cancel,
 	}
+	if a := s.authorizer; a != nil {
+		p.patternAuth = newPatternAuth(func(topic string) uint8 {
+			return a.Authorize(c, amp.Subscribe, topic)
+		})
+	}
+	return p
 }
 
 type pooler struct {
-	meta    map[string]string
-	msgs    []*amp.Msg
-	onMsg   func()
-	msgWait context.Context
+	credentials Credentials
+	patternAuth *patternAuth // authorizes topics matched by the patterns
+	msgs        []*amp.Msg
+	onMsg       func()
+	msgWait     context.Context
 	sync.Mutex
 }
 
@@ -186,6 +279,10 @@ func (p *pooler) Send(m *amp.Msg) {
 	p.Lock()
 	p.msgs = append(p.msgs, m)
 	p.Unlock()
+	if m.IsPartial() {
+		// wait for the terminal response
+		return
+	}
 	p.onMsg()
 }
 
@@ -197,11 +294,11 @@ func (p *pooler) SendMsgs(m []*amp.Msg) {
 }
 
 func (p *pooler) Meta() map[string]string {
-	return p.meta
+	return p.credentials.Meta
 }
 
 func (p *pooler) Headers() map[string]string {
-	return nil
+	return p.credentials.Headers
 }
 
 func (p *pooler) waitOne(app context.Context, interval time.Duration) {
@@ -212,14 +309,27 @@ func (p *pooler) waitOne(app context.Context, interval time.Duration) {
 	}
 }
 
-func (p *pooler) wait(app context.Context, interval time.Duration) {
-	select {
-	case <-app.Done():
-	case <-time.After(interval):
-	case <-p.msgWait.Done():
+// wait for the messages, resubscribe is called when topics matched
+// by patterns become allowed.
+func (p *pooler) wait(app context.Context, interval time.Duration, resubscribe func()) {
+	var authSig chan struct{}
+	if p.patternAuth != nil {
+		authSig = p.patternAuth.sig
+	}
+	timeout := time.After(interval)
+	for {
 		select {
 		case <-app.Done():
-		case <-time.After(waitManyInterval):
+		case <-timeout:
+		case <-authSig:
+			resubscribe()
+			continue
+		case <-p.msgWait.Done():
+			select {
+			case <-app.Done():
+			case <-time.After(waitManyInterval):
+			}
 		}
+		return
 	}
 }
@@ -0,0 +1,219 @@
+package session
+
+import (
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// Out queue overflow strategies.
+// Applied in the configured order until backlog fits into the limit.
+// If none of them helps client connection is closed.
+const (
+	OverflowCoalesce   uint8 = iota // merge queued diffs for the same uri
+	OverflowReplace                 // replace queued topic messages with the current state from the broker
+	OverflowDropEvents              // drop queued event messages
+)
+
+type overflowPolicy struct {
+	limit      int     // max number of messages in backlog
+	strategies []uint8 // applied in order
+}
+
+// OverflowPolicy sets strategies for slow clients.
+// When out queue is full messages are kept in backlog.
+// If backlog grows over limit strategies are applied in order to reduce it.
+// Connection is closed only if backlog is still over limit.
+// Without policy connection is closed as soon as out queue is full.
+func OverflowPolicy(limit int, strategies ...uint8) func(*Sessions) {
+	return func(s *Sessions) {
+		s.overflowPolicy = &overflowPolicy{
+			limit:      limit,
+			strategies: strategies,
+		}
+	}
+}
+
+// queue puts messages into backlog and applies overflow strategies.
+// Should be called during s.Lock
+func (s *session) queue(msgs []*amp.Msg) {
+	for _, m := range msgs {
+		if _, ok := s.replace[m.URI]; ok && m.Type == amp.Publish && !isEvent(m) {
+			s.overflowStats.replaced++ // will be replaced with current state
+			continue
+		}
+		s.backlog = append(s.backlog, m)
+	}
+	select {
+	case s.backlogSig <- struct{}{}:
+	default:
+	}
+
+	p := s.overflowPolicy
+	if p == nil || len(s.backlog) <= p.limit {
+		return
+	}
+	for _, st := range p.strategies {
+		switch st {
+		case OverflowCoalesce:
+			s.coalesce()
+		case OverflowReplace:
+			s.markReplace()
+		case OverflowDropEvents:
+			s.dropEvents()
+		}
+		if len(s.backlog) <= p.limit {
+			return
+		}
+	}
+	if s.overflowStats.disconnected {
+		return
+	}
+	s.overflowStats.disconnected = true
+	s.logOutQueueOverflow()
+	s.signalOverflow()
+}
+
+// signalOverflow requests closing of the client connection
+func (s *session) signalOverflow() {
+	select {
+	case s.overflow <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce merges consecutive diffs for the same uri
+func (s *session) coalesce() {
+	type last struct {
+		uri string
+		idx int
+	}
+	lasts := make(map[string]last) // mergeable message position by topic
+	backlog := s.backlog[:0]
+	for _, m := range s.backlog {
+		if m.Type != amp.Publish {
+			backlog = append(backlog, m)
+			continue
+		}
+		topic := m.Topic()
+		if l, ok := lasts[topic]; ok && l.uri == m.URI {
+			if mm, ok := backlog[l.idx].Merge(m); ok {
+				backlog[l.idx] = mm
+				s.overflowStats.coalesced++
+				continue
+			}
+		}
+		backlog = append(backlog, m)
+		if m.UpdateType == amp.Diff || m.UpdateType == amp.Full {
+			lasts[topic] = last{uri: m.URI, idx: len(backlog) - 1}
+		} else {
+			delete(lasts, topic)
+		}
+	}
+	s.backlog = backlog
+}
+
+// markReplace removes topic messages from backlog.
+// Current topic state will be sent instead (see flushBacklog).
+// Topics with close message are not replaced.
+// Events are kept, broker doesn't cache them so they can't be replayed.
+// Broker topic name is message uri.
+func (s *session) markReplace() {
+	closed := make(map[string]struct{})
+	for _, m := range s.backlog {
+		if m.Type == amp.Publish && m.IsTopicClose() {
+			closed[m.URI] = struct{}{}
+		}
+	}
+	if s.replace == nil {
+		s.replace = make(map[string]struct{})
+	}
+	backlog := s.backlog[:0]
+	for _, m := range s.backlog {
+		if m.Type == amp.Publish && !isEvent(m) {
+			if _, ok := closed[m.URI]; !ok {
+				s.replace[m.URI] = struct{}{}
+				s.overflowStats.replaced++
+				continue
+			}
+		}
+		backlog = append(backlog, m)
+	}
+	s.backlog = backlog
+}
+
+// dropEvents removes event messages from backlog
+func (s *session) dropEvents() {
+	backlog := s.backlog[:0]
+	for _, m := range s.backlog {
+		if isEvent(m) {
+			s.overflowStats.dropped++
+			continue
+		}
+		backlog = append(backlog, m)
+	}
+	s.backlog = backlog
+}
+
+// isEvent checks for event stream message published by the broker
+func isEvent(m *amp.Msg) bool {
+	return m.Type == amp.Publish && m.UpdateType == amp.Event
+}
+
+// flushBacklog sends queued messages to the client.
+// Messages from out queue are sent first to keep the order.
+func (s *session) flushBacklog() {
+	for {
+		select {
+		case msgs := <-s.outMessages:
+			for _, msg := range msgs {
+				s.connWrite(msg)
+			}
+			s.stats.outMessages += len(msgs)
+			continue
+		default:
+		}
+		break
+	}
+
+	s.Lock()
+	backlog, replace := s.backlog, s.replace
+	s.backlog, s.replace = nil, nil
+	s.overflowStats.flushes++
+	s.Unlock()
+
+	for topic := range replace {
+		msgs := s.broker.Replay(topic)
+		for _, msg := range msgs {
+			s.connWrite(msg)
+		}
+		s.stats.outMessages += len(msgs)
+	}
+	for _, msg := range backlog {
+		s.connWrite(msg)
+	}
+	s.stats.outMessages += len(backlog)
+}
+
+func (s *session) logOverflowStats() {
+	if s.overflowPolicy == nil {
+		return
+	}
+	s.Lock()
+	st := s.overflowStats
+	s.Unlock()
+	if st.flushes == 0 {
+		return
+	}
+	s.log().I("flushes", st.flushes).
+		I("coalesced", st.coalesced).
+		I("replaced", st.replaced).
+		I("dropped", st.dropped).
+		Debug("overflow stats")
+	metric.Time("overflow.flushes", st.flushes)
+	metric.Time("overflow.coalesced", st.coalesced)
+	metric.Time("overflow.replaced", st.replaced)
+	metric.Time("overflow.dropped", st.dropped)
+	if st.disconnected {
+		metric.Counter("overflow.disconnected")
+	}
+}
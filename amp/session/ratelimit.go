@@ -0,0 +1,238 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// Policies for the client messages over the rate limit.
+const (
+	RateLimitDrop       uint8 = iota // ignore message
+	RateLimitDelay                   // stop reading from the client until message is allowed
+	RateLimitDisconnect              // close client connection
+)
+
+var (
+	ipBucketsSweepInterval = time.Minute
+	typeNames              = map[uint8]string{
+		amp.Publish:   "publish",
+		amp.Subscribe: "subscribe",
+		amp.Request:   "request",
+		amp.Response:  "response",
+		amp.Ping:      "ping",
+		amp.Pong:      "pong",
+		amp.Alive:     "alive",
+		amp.Meta:      "meta",
+		amp.Cancel:    "cancel",
+	}
+)
+
+type rateLimit struct {
+	rate  float64 // tokens per second
+	burst float64 // bucket size
+}
+
+type rateLimits struct {
+	types   map[uint8]rateLimit
+	ip      *rateLimit
+	policy  uint8
+	ips     map[string]*bucket // shared by all sessions from the ip
+	ipSweep time.Time
+	sync.Mutex
+}
+
+// RateLimit limits number of client messages of the type to rate per
+// second with burst. Limit is per session.
+func RateLimit(msgType uint8, rate float64, burst int) func(*Sessions) {
+	return func(s *Sessions) {
+		s.rateLimits().types[msgType] = rateLimit{rate: rate, burst: float64(burst)}
+	}
+}
+
+// RateLimitIP limits number of client messages (all types) from all
+// sessions with the same client ip.
+// Applies to connections which resolve client ip (ws.Conn ClientIP).
+func RateLimitIP(rate float64, burst int) func(*Sessions) {
+	return func(s *Sessions) {
+		s.rateLimits().ip = &rateLimit{rate: rate, burst: float64(burst)}
+	}
+}
+
+// RateLimitPolicy sets what happens with the messages over limit.
+// Default is RateLimitDrop.
+func RateLimitPolicy(policy uint8) func(*Sessions) {
+	return func(s *Sessions) {
+		s.rateLimits().policy = policy
+	}
+}
+
+func (f *Sessions) rateLimits() *rateLimits {
+	if f.limits == nil {
+		f.limits = &rateLimits{
+			types: make(map[uint8]rateLimit),
+			ips:   make(map[string]*bucket),
+		}
+	}
+	return f.limits
+}
+
+// ipBucket returns bucket shared by the sessions from the ip.
+// Full buckets (idle ips) are removed periodically.
+func (l *rateLimits) ipBucket(ip string) *bucket {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.ipSweep) > ipBucketsSweepInterval {
+		for k, b := range l.ips {
+			if b.full(now) {
+				delete(l.ips, k)
+			}
+		}
+		l.ipSweep = now
+	}
+	b, ok := l.ips[ip]
+	if !ok {
+		b = newBucket(*l.ip)
+		l.ips[ip] = b
+	}
+	return b
+}
+
+// limiter holds session token buckets.
+type limiter struct {
+	limits     *rateLimits
+	types      map[uint8]*bucket
+	violations int
+}
+
+func newLimiter(l *rateLimits) *limiter {
+	if l == nil {
+		return nil
+	}
+	lm := &limiter{
+		limits: l,
+		types:  make(map[uint8]*bucket),
+	}
+	for typ, rl := range l.types {
+		lm.types[typ] = newBucket(rl)
+	}
+	return lm
+}
+
+// wait returns how long message must wait for the tokens.
+// Zero means that message is allowed.
+// Tokens are reserved only for allowed or delayed messages.
+func (lm *limiter) wait(m *amp.Msg, ip string) time.Duration {
+	now := time.Now()
+	var d time.Duration
+	var taken []*bucket
+	take := func(b *bucket) {
+		if bd := b.take(now); bd > d {
+			d = bd
+		}
+		taken = append(taken, b)
+	}
+	if b, ok := lm.types[m.Type]; ok {
+		take(b)
+	}
+	if lm.limits.ip != nil && ip != "" {
+		take(lm.limits.ipBucket(ip))
+	}
+	if d > 0 && lm.limits.policy != RateLimitDelay {
+		for _, b := range taken {
+			b.refund()
+		}
+	}
+	return d
+}
+
+// allow applies rate limits policy to the client message.
+// Returns false if message should be ignored, and true for disconnect.
+// Blocks on RateLimitDelay.
+func (s *session) allow(m *amp.Msg) (allowed bool, disconnect bool) {
+	if s.limiter == nil {
+		return true, false
+	}
+	ip := connIP(s.connection())
+	d := s.limiter.wait(m, ip)
+	if d == 0 {
+		return true, false
+	}
+	policy := s.limiter.limits.policy
+	s.limiter.violations++
+	metric.Counter("ratelimit." + typeNames[m.Type] + "." + policyNames[policy])
+	if s.limiter.violations == 1 || policy == RateLimitDisconnect {
+		s.log().S("type", typeNames[m.Type]).
+			S("policy", policyNames[policy]).
+			S("ip", ip).
+			Info("rate limit exceeded")
+	}
+	switch policy {
+	case RateLimitDelay:
+		time.Sleep(d)
+		return true, false
+	case RateLimitDisconnect:
+		return false, true
+	}
+	return false, false
+}
+
+var policyNames = map[uint8]string{
+	RateLimitDrop:       "drop",
+	RateLimitDelay:      "delay",
+	RateLimitDisconnect: "disconnect",
+}
+
+// bucket is token bucket.
+type bucket struct {
+	rateLimit
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newBucket(rl rateLimit) *bucket {
+	return &bucket{rateLimit: rl, tokens: rl.burst, last: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes one token. If there is no token available returns time until
+// it will be. Taken token is reserved so delayed message doesn't have to
+// take it again.
+func (b *bucket) take(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	if b.rate <= 0 {
+		return time.Hour // no refill
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund returns token taken for the message which is not sent.
+func (b *bucket) refund() {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens++
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
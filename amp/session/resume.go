@@ -0,0 +1,194 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/metric"
+)
+
+// ResumeMetaKey is the session meta key (query string parameter on connect)
+// with the resume token.
+const ResumeMetaKey = "resume"
+
+// ResumedMetaKey is set in the meta message sent to the client after successful resume.
+const ResumedMetaKey = "resumed"
+
+type resumeConfig struct {
+	window    time.Duration // how long session is kept after disconnect
+	retention int           // max number of messages buffered while client is disconnected
+}
+
+// ResumeWindow enables session resume.
+// On connect client gets token in the meta message (ResumeMetaKey).
+// After disconnect session is kept for window duration, still subscribed
+// to the broker and waiting for pending responses. Up to retention messages
+// are buffered. Client which connects with the token within window gets the
+// same session and all buffered messages.
+// Session which buffers more than retention messages can't be resumed.
+func ResumeWindow(window time.Duration, retention int) func(*Sessions) {
+	return func(s *Sessions) {
+		s.resume = &resumeConfig{
+			window:    window,
+			retention: retention,
+		}
+		s.parked = make(map[string]*parkedSession)
+	}
+}
+
+type parkedSession struct {
+	s       *session
+	resumed chan struct{}
+}
+
+func newResumeToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// resumeMsg informs client about resume token.
+func resumeMsg(token string, resumed bool) *amp.Msg {
+	m := &amp.Msg{
+		Type: amp.Meta,
+		Meta: map[string]string{ResumeMetaKey: token},
+	}
+	if resumed {
+		m.Meta[ResumedMetaKey] = "true"
+	}
+	return m
+}
+
+// resumeToken removes resume token from the connection meta,
+// so it isn't copied into backend requests and logs.
+func (f *Sessions) resumeToken(conn connection) string {
+	if f.resume == nil {
+		return ""
+	}
+	token := conn.Meta()[ResumeMetaKey]
+	if token != "" {
+		conn.SetMeta(map[string]string{ResumeMetaKey: ""})
+	}
+	return token
+}
+
+// unpark finds parked session for the token.
+// Returns nil if there is no session to resume.
+func (f *Sessions) unpark(conn connection, token string) *session {
+	f.Lock()
+	p, ok := f.parked[token]
+	if ok {
+		delete(f.parked, token)
+	}
+	f.Unlock()
+	if !ok {
+		metric.Counter("resume.miss")
+		return nil
+	}
+	close(p.resumed)
+	if !p.s.attach(conn) {
+		metric.Counter("resume.expired")
+		f.release(p.s)
+		return nil
+	}
+	metric.Counter("resume.hit")
+	return p.s
+}
+
+// park keeps disconnected session for the resume window.
+// Session is released when window passes or it retains too many messages.
+func (f *Sessions) park(s *session) {
+	expired := s.park()
+
+	p := &parkedSession{s: s, resumed: make(chan struct{})}
+	f.Lock()
+	f.parked[s.token] = p
+	f.Unlock()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		timer := time.NewTimer(f.resume.window)
+		defer timer.Stop()
+		select {
+		case <-p.resumed:
+			return
+		case <-timer.C:
+		case <-expired:
+		case <-f.cancelSig.Done():
+		}
+		f.Lock()
+		_, ok := f.parked[s.token]
+		delete(f.parked, s.token)
+		f.Unlock()
+		if !ok {
+			return // resumed in the meantime
+		}
+		f.release(s)
+	}()
+}
+
+// resumable returns true if session can be parked after connection is closed.
+func (s *session) resumable() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.token != "" && !s.overflowStats.disconnected
+}
+
+// park starts buffering messages for the client.
+// Messages already waiting in the out queue are counted into retention.
+// Returns channel which is closed when session expires.
+func (s *session) park() chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+	s.parked = true
+	s.expiredSig = make(chan struct{})
+	s.retained = len(s.backlog)
+	for i := len(s.outMessages); i > 0; i-- {
+		msgs := <-s.outMessages
+		s.retained += len(msgs)
+		s.outMessages <- msgs
+	}
+	return s.expiredSig
+}
+
+// retain buffers messages while session is parked.
+// Should be called during s.Lock
+func (s *session) retain(msgs []*amp.Msg) {
+	if s.expired {
+		return
+	}
+	if s.retained+len(msgs) > s.retention {
+		s.expired = true
+		s.backlog = nil
+		close(s.expiredSig)
+		return
+	}
+	s.retained += len(msgs)
+	s.backlog = append(s.backlog, msgs...)
+}
+
+// attach connects parked session to the new client connection.
+// Returns false if session has expired.
+func (s *session) attach(conn connection) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.expired {
+		return false
+	}
+	s.connLock.Lock()
+	s.conn = conn
+	s.connLock.Unlock()
+	s.parked = false
+	s.stats.resumes++
+	s.backlog = append([]*amp.Msg{resumeMsg(s.token, true)}, s.backlog...)
+	select {
+	case s.backlogSig <- struct{}{}:
+	default:
+	}
+	return true
+}
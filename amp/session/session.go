@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
 	"github.com/minus5/svckit/metric"
+	"github.com/minus5/svckit/trace"
 )
 
 var (
@@ -18,6 +20,7 @@ var (
 
 type session struct {
 	conn        connection      // client websocket connection
+	connLock    sync.RWMutex    // guards conn, replaced on resume
 	broker      broker          // broker for subscribe on published messages
 	requester   requester       // requester for request / response messages
 	outMessages chan []*amp.Msg // output messages queue
@@ -27,40 +30,94 @@ type session struct {
 		inMessages    int
 		aliveMessages int
 		maxQueueLen   int
+		resumes       int
 	}
 	topicWhitelist       []string
 	compatibilityVersion uint8
 	overflow             chan struct{}
 	overflowRead         chan struct{}
+	authorizer           Authorizer        // decides on subscriptions and requests, optional
+	authCache            map[authKey]uint8 // authorizer decisions
+	authLock             sync.Mutex        // guards authCache and patternAuth
+	patternAuth          *patternAuth      // decisions for the topics matched by patterns
+	subscriptions        map[string]int64  // current (authorized) subscriptions
+	requested            map[string]int64  // subscriptions requested by the client
+
+	overflowPolicy *overflowPolicy     // out queue overflow handling, nil means disconnect
+	backlog        []*amp.Msg          // messages which didn't fit into out queue
+	backlogSig     chan struct{}       // signals non empty backlog
+	replace        map[string]struct{} // topics to replace with current state
+	overflowStats  struct {            // overflow strategies counters
+		flushes      int
+		coalesced    int
+		replaced     int
+		dropped      int
+		disconnected bool
+	}
+	index      *metaIndex    // meta index of the factory, optional
+	limiter    *limiter      // client messages rate limiter, optional
+	token      string        // resume token
+	retention  int           // max number of messages buffered while parked
+	retained   int           // number of messages buffered while parked
+	parked     bool          // client is disconnected, waiting for resume
+	expired    bool          // too many messages while parked, can't be resumed
+	expiredSig chan struct{} // closed when parked session expires
+	sync.Mutex
 }
 
-// serve starts new session
+// serve starts new session or resumes parked one
 // Blocks until session is finished.
-func serve(
-	cancelSig context.Context,
-	conn connection,
-	req requester,
-	brk broker,
-	topicWhitelist []string,
-	compatibilityVersion uint8,
-) {
+func (f *Sessions) serve(conn connection, compatibilityVersion uint8) {
+	var s *session
+	if token := f.resumeToken(conn); token != "" && compatibilityVersion == amp.CompatibilityVersionDefault {
+		s = f.unpark(conn, token)
+	}
+	if s != nil {
+		s.reauthorize() // credentials of the new connection
+	} else {
+		s = f.newSession(conn, compatibilityVersion)
+	}
+	s.stats.start = time.Now()
+	f.register(s)
+	s.loop(f.cancelSig)
+	f.unregister(s)
+	if f.resume != nil && f.cancelSig.Err() == nil && s.resumable() {
+		f.park(s)
+		return
+	}
+	f.release(s)
+}
+
+func (f *Sessions) newSession(conn connection, compatibilityVersion uint8) *session {
 	overflow := make(chan struct{}, 1)
 	s := &session{
-		topicWhitelist:       topicWhitelist,
+		topicWhitelist:       f.topicWhitelist,
 		conn:                 conn,
-		requester:            req,
-		broker:               brk,
+		requester:            f.requester,
+		broker:               f.broker,
 		outMessages:          make(chan []*amp.Msg, 256),
 		compatibilityVersion: compatibilityVersion,
 		overflow:             overflow,
 		overflowRead:         overflow, // read once and set to nil
+		authorizer:           f.authorizer,
+		overflowPolicy:       f.overflowPolicy,
+		backlogSig:           make(chan struct{}, 1),
+		index:                f.index,
+		limiter:              newLimiter(f.limits),
 	}
-	s.stats.start = time.Now()
-	s.loop(cancelSig)
+	if f.resume != nil && compatibilityVersion == amp.CompatibilityVersionDefault {
+		s.token = newResumeToken()
+		s.retention = f.resume.retention
+		s.Send(resumeMsg(s.token, false))
+	}
+	return s
 }
 
 func (s *session) loop(cancelSig context.Context) {
-	s.broker.Created(s)
+	resumed := s.stats.resumes > 0
+	if !resumed {
+		s.broker.Created(s)
+	}
 	inMessages := s.readLoop()  // messages from the client
 	exitSig := cancelSig.Done() // aplication exit signal
 
@@ -72,11 +129,18 @@ func (s *session) loop(cancelSig context.Context) {
 		s.stats.aliveMessages++
 	}
 
+	// signals that topics matched by patterns became allowed
+	var authSig chan struct{}
+	if s.authorizer != nil {
+		authSig = s.topicAuth().sig
+	}
+
 	defer s.logStats()
+	defer s.logOverflowStats()
 
-	if preSub := s.Meta()["preSub"]; preSub != "" {
+	if preSub := s.Meta()["preSub"]; preSub != "" && !resumed {
 		chanName := fmt.Sprintf("sportsbook/%s", preSub)
-		s.broker.Subscribe(s, map[string]int64{
+		s.subscribe(map[string]int64{
 			chanName: 0,
 		})
 	}
@@ -91,9 +155,14 @@ func (s *session) loop(cancelSig context.Context) {
 			}
 			s.stats.outMessages += len(msgs)
 			alive.Reset(aliveInterval)
+		case <-s.backlogSig:
+			s.flushBacklog()
+			alive.Reset(aliveInterval)
+		case <-authSig:
+			// broker asks again for the topics matched by patterns
+			s.broker.Subscribe(s, copySubscriptions(s.subscriptions))
 		case msg, ok := <-inMessages:
 			if !ok {
-				s.unsubscribe()
 				return
 			}
 			s.receive(msg)
@@ -129,17 +198,28 @@ func (s *session) unsubscribe() {
 
 func (s *session) readLoop() chan *amp.Msg {
 	in := make(chan *amp.Msg)
+	conn := s.connection()
 	go func() {
 		defer close(in)
+		encoding := connEncoding(conn)
 		for {
-			buf, err := s.conn.Read()
+			buf, err := conn.Read()
 			if err != nil {
 				if strings.HasPrefix(err.Error(), "malformed") {
 					log.Error(err)
 				}
 				return
 			}
-			if m := amp.ParseCompatibility(buf, s.compatibilityVersion); m != nil {
+			m := amp.ParseEncoding(buf, s.compatibilityVersion, encoding)
+			if m == nil {
+				continue
+			}
+			allowed, disconnect := s.allow(m)
+			if disconnect {
+				conn.Close()
+				return
+			}
+			if allowed {
 				in <- m
 			}
 		}
@@ -156,19 +236,61 @@ func (s *session) receive(m *amp.Msg) {
 		if !s.isMessageTopicWhitelisted(m) {
 			return
 		}
-		m.Meta = s.conn.Meta()
-		m.BackendHeaders = s.conn.GetBackendHeaders()
+		switch s.authorize(amp.Request, m.Topic()) {
+		case Denied:
+			s.Send(forbiddenResponse(m))
+			return
+		case Filtered:
+			return
+		}
+		ctx := s.requestTrace(m)
+		m.Meta = s.connection().Meta()
+		m.BackendHeaders = trace.Inject(ctx, s.connection().GetBackendHeaders())
+		log.Ctx(ctx).S("uri", m.URI).I("correlationID", int(m.CorrelationID)).Debug("request")
 		s.requester.Send(s, m)
+	case amp.Cancel:
+		s.requester.Cancel(s, m)
 	case amp.Subscribe:
 		if preSub := s.Meta()["preSub"]; preSub != "" {
 			chanName := fmt.Sprintf("sportsbook/%s", preSub)
 			m.Subscriptions[chanName] = 0
 		}
-		s.broker.Subscribe(s, m.Subscriptions)
+		s.subscribe(m.Subscriptions)
 	case amp.Meta:
-		s.conn.SetMeta(m.Meta)
-		s.Send(m.MetaResponse(s.conn.Meta()))
+		s.connection().SetMeta(m.Meta)
+		if s.index != nil {
+			s.index.update(s)
+		}
+		s.reauthorize()
+		s.Send(m.MetaResponse(s.connection().Meta()))
+	}
+}
+
+// requestTrace returns context with the trace for the client request.
+// Trace sent by the client in the request meta, or in the connection
+// headers, is continued. Otherwise new trace is started.
+func (s *session) requestTrace(m *amp.Msg) context.Context {
+	if tc, ok := trace.FromHeaders(m.Meta); ok {
+		return trace.NewContext(context.Background(), tc.Child())
 	}
+	return trace.Continue(context.Background(), s.connection().Headers())
+}
+
+// subscribe authorizes and subscribes to the topics
+func (s *session) subscribe(subs map[string]int64) {
+	if subs == nil {
+		subs = make(map[string]int64)
+	}
+	s.requested = copySubscriptions(subs)
+	s.authorizeSubscriptions(subs)
+	s.setSubscriptions(subs)
+	s.broker.Subscribe(s, subs)
+}
+
+func (s *session) setSubscriptions(subs map[string]int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.subscriptions = copySubscriptions(subs)
 }
 
 // Send message to the clinet
@@ -178,6 +300,28 @@ func (s *session) Send(m *amp.Msg) {
 }
 
 func (s *session) SendMsgs(msgs []*amp.Msg) {
+	if s.overflowPolicy != nil || s.token != "" {
+		s.Lock()
+		defer s.Unlock()
+		if s.parked {
+			s.retain(msgs)
+			return
+		}
+		if len(s.backlog) == 0 && len(s.replace) == 0 {
+			select {
+			case s.outMessages <- msgs:
+				return
+			default:
+			}
+			if s.overflowPolicy == nil {
+				s.overflowStats.disconnected = true
+				s.signalOverflow()
+				return
+			}
+		}
+		s.queue(msgs)
+		return
+	}
 	select {
 	case s.outMessages <- msgs:
 	default:
@@ -200,46 +344,48 @@ func (s *session) logOutQueueOverflow() {
 }
 
 func (s *session) connWrite(m *amp.Msg) {
-	var payload []byte
-	deflated := false
-	if s.conn.DeflateSupported() {
-		payload, deflated = m.MarshalDeflateCompatiblity(s.compatibilityVersion)
-	} else {
-		payload = m.MarshalCompatiblity(s.compatibilityVersion)
-	}
+	conn := s.connection()
+	payload, deflated := m.MarshalFor(connCompression(conn), s.compatibilityVersion, connEncoding(conn))
 	if payload == nil {
 		return
 	}
-	err := s.conn.Write(payload, deflated)
+	err := conn.Write(payload, deflated)
 	if err != nil {
 		s.connClose()
 	}
 }
 
 func (s *session) log() *log.Agregator {
-	return log.I("no", int(s.conn.No()))
+	return log.I("no", int(s.connection().No()))
 }
 
 func (s *session) connClose() {
 	metric.Timing("connClose", func() {
-		s.conn.Close()
+		s.connection().Close()
 	})
 }
 
+// connection returns current client connection.
+func (s *session) connection() connection {
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	return s.conn
+}
+
 func (s *session) Meta() map[string]string {
-	return s.conn.Meta()
+	return s.connection().Meta()
 }
 
 func (s *session) GetRemoteIp() string {
-	return s.conn.GetRemoteIp()
+	return s.connection().GetRemoteIp()
 }
 
 func (s *session) GetCookie() string {
-	return s.conn.GetCookie()
+	return s.connection().GetCookie()
 }
 
 func (s *session) Headers() map[string]string {
-	return s.conn.Headers()
+	return s.connection().Headers()
 }
 
 func (s *session) isMessageTopicWhitelisted(msg *amp.Msg) bool {
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/minus5/svckit/amp"
+	ampbroker "github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/trace"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -77,12 +79,30 @@ func (c *mockConn) Assert(t *testing.T) {
 	require.Equal(t, c.WantMetaCalls, c.gotMetaCalls)
 }
 
+// metaConn is mockConn which doesn't count Meta calls,
+// for tests which run session loop (reads meta on start).
+type metaConn struct {
+	mockConn
+}
+
+func (c *metaConn) Meta() map[string]string { return c.ReturnMeta }
+func (c *metaConn) SetMeta(m map[string]string) {
+	for k, v := range m {
+		if v == "" {
+			delete(c.ReturnMeta, k)
+			continue
+		}
+		c.ReturnMeta[k] = v
+	}
+}
+
 type mockBroker struct{}
 
 func (b *mockBroker) Subscribe(amp.Sender, map[string]int64) {}
 func (b *mockBroker) Unsubscribe(amp.Sender)                 {}
 func (b *mockBroker) Created(amp.Sender)                     {}
 func (b *mockBroker) Wait()                                  {}
+func (b *mockBroker) Replay(string) []*amp.Msg               { return nil }
 
 type mockRequester struct {
 	t *testing.T
@@ -90,6 +110,9 @@ type mockRequester struct {
 	WantSendCalls int
 	gotSendCalls  int
 	WantMsgs      []*amp.Msg
+
+	WantCancelCalls int
+	gotCancelCalls  int
 }
 
 func (r *mockRequester) Send(_ amp.Subscriber, msg *amp.Msg) {
@@ -110,7 +133,21 @@ func (r *mockRequester) Send(_ amp.Subscriber, msg *amp.Msg) {
 	require.Equal(r.t, want.Subscriptions, msg.Subscriptions)
 	require.Equal(r.t, want.CacheDepth, msg.CacheDepth)
 	require.Equal(r.t, want.Meta, msg.Meta)
-	require.Equal(r.t, want.BackendHeaders, msg.BackendHeaders)
+	// session adds trace context to the backend headers
+	_, ok := trace.FromHeaders(msg.BackendHeaders)
+	require.True(r.t, ok)
+	headers := make(map[string]string)
+	for k, v := range msg.BackendHeaders {
+		if k != trace.Header {
+			headers[k] = v
+		}
+	}
+	require.Equal(r.t, want.BackendHeaders, headers)
+}
+
+func (r *mockRequester) Cancel(_ amp.Subscriber, msg *amp.Msg) {
+	r.gotCancelCalls++
+	require.True(r.t, r.WantCancelCalls >= r.gotCancelCalls)
 }
 
 func (r *mockRequester) Unsubscribe(amp.Subscriber) {}
@@ -119,6 +156,7 @@ func (r *mockRequester) Wait() {}
 
 func (r *mockRequester) Assert(t *testing.T) {
 	require.Equal(t, r.WantSendCalls, r.gotSendCalls)
+	require.Equal(t, r.WantCancelCalls, r.gotCancelCalls)
 }
 
 func testSession(outLen, inLen int) (chan []byte, chan []byte, func(), chan struct{}, func(*amp.Msg)) {
@@ -126,7 +164,7 @@ func testSession(outLen, inLen int) (chan []byte, chan []byte, func(), chan stru
 	in := make(chan []byte, inLen)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	conn := &mockConn{out: out, in: in}
+	conn := &metaConn{mockConn{out: out, in: in}}
 	done := make(chan struct{})
 
 	s := &session{
@@ -201,7 +239,7 @@ func TestQueueDrain(t *testing.T) {
 	out := make(chan []byte, 1000)
 	in := make(chan []byte, 1000)
 	done := make(chan struct{})
-	conn := &mockConn{out: out, in: in}
+	conn := &metaConn{mockConn{out: out, in: in}}
 	s := &session{
 		conn:        conn,
 		outMessages: make(chan []*amp.Msg, 256),
@@ -289,6 +327,19 @@ func Test_session_receive(t *testing.T) {
 				URI:  "blacklisted.req/method",
 			},
 		},
+		{
+			name: "it should call Cancel on requester",
+			fields: fields{
+				requester: mockRequester{
+					t:               t,
+					WantCancelCalls: 1,
+				},
+			},
+			in: &amp.Msg{
+				Type:          amp.Cancel,
+				CorrelationID: 4,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -306,3 +357,706 @@ func Test_session_receive(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestTrace(t *testing.T) {
+	backendHeaders := map[string]string{"foo": "bar"}
+	r := &tracingRequester{}
+	s := &session{
+		conn:           &mockConn{t: t, ReturnBackendHeaders: backendHeaders, WantBackendHeaders: 3, WantMetaCalls: 3},
+		requester:      r,
+		topicWhitelist: []string{"math.req"},
+	}
+
+	// new trace for each request
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 1})
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 2})
+	require.Len(t, r.msgs, 2)
+	tc1, ok := trace.FromHeaders(r.msgs[0].BackendHeaders)
+	require.True(t, ok)
+	tc2, ok := trace.FromHeaders(r.msgs[1].BackendHeaders)
+	require.True(t, ok)
+	assert.NotEqual(t, tc1.TraceID, tc2.TraceID)
+	assert.Equal(t, "bar", r.msgs[0].BackendHeaders["foo"])
+	// connection headers are not changed
+	assert.Len(t, backendHeaders, 1)
+
+	// trace sent by the client is continued
+	parent := trace.New()
+	r.msgs = nil
+	s.receive(&amp.Msg{Type: amp.Request, URI: "math.req/add", CorrelationID: 3,
+		Meta: map[string]string{trace.Header: parent.String()}})
+	tc, ok := trace.FromHeaders(r.msgs[0].BackendHeaders)
+	require.True(t, ok)
+	assert.Equal(t, parent.TraceID, tc.TraceID)
+	assert.NotEqual(t, parent.SpanID, tc.SpanID)
+}
+
+type tracingRequester struct {
+	mockRequester
+	msgs []*amp.Msg
+}
+
+func (r *tracingRequester) Send(_ amp.Subscriber, m *amp.Msg) {
+	r.msgs = append(r.msgs, m)
+}
+
+func TestPoolerWaitsForTerminalResponse(t *testing.T) {
+	req := &amp.Msg{Type: amp.Request, CorrelationID: 1}
+	p := (&Sessions{}).newPooler(Credentials{})
+
+	p.Send(req.PartialResponse(1))
+	p.Send(req.PartialResponse(2))
+	select {
+	case <-p.msgWait.Done():
+		t.Fatal("pooler should wait for terminal response")
+	default:
+	}
+
+	p.Send(req.Response(3))
+	<-p.msgWait.Done()
+	assert.Len(t, p.msgs, 3)
+}
+
+type recordBroker struct {
+	mockBroker
+	subs map[string]int64
+}
+
+func (b *recordBroker) Subscribe(_ amp.Sender, subs map[string]int64) { b.subs = subs }
+
+func TestAuthorizer(t *testing.T) {
+	calls := 0
+	auth := AuthorizerFunc(func(c Credentials, msgType uint8, topic string) uint8 {
+		calls++
+		switch topic {
+		case "user/" + c.Meta["user"] + "/balance":
+			return Allowed
+		case "private":
+			return Filtered
+		}
+		if msgType == amp.Request && topic == "req" {
+			return Allowed
+		}
+		return Denied
+	})
+	conn := &metaConn{mockConn{ReturnMeta: map[string]string{"user": "1"}}}
+	brk := &recordBroker{}
+	req := &mockRequester{}
+	s := &session{
+		conn:           conn,
+		outMessages:    make(chan []*amp.Msg, 256),
+		requester:      req,
+		broker:         brk,
+		authorizer:     auth,
+		topicWhitelist: []string{"other"},
+	}
+
+	s.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{
+		"user/1/balance": 0,
+		"user/2/balance": 0,
+		"private":        0,
+	}})
+	assert.Equal(t, map[string]int64{"user/1/balance": 0}, brk.subs)
+	require.Len(t, s.outMessages, 1)
+	m := (<-s.outMessages)[0]
+	assert.Equal(t, "user/2/balance", m.URI)
+	assert.Equal(t, amp.Close, m.UpdateType)
+	assert.Equal(t, forbiddenCode, m.Error.Code)
+	assert.Equal(t, 3, calls)
+
+	// decisions are cached
+	s.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"user/1/balance": 0}})
+	assert.Equal(t, 3, calls)
+
+	// denied request
+	s.receive(&amp.Msg{Type: amp.Request, URI: "other/method", CorrelationID: 1})
+	require.Len(t, s.outMessages, 1)
+	m = (<-s.outMessages)[0]
+	assert.Equal(t, amp.Response, m.Type)
+	assert.Equal(t, forbiddenCode, m.Error.Code)
+
+	// meta change removes subscriptions which are no longer allowed,
+	// and adds requested ones which became allowed
+	s.receive(&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"user/1/balance": 5, "user/2/balance": 0}})
+	require.Len(t, s.outMessages, 1)
+	<-s.outMessages // close for the user/2/balance
+	conn.ReturnMeta = map[string]string{"user": "2"}
+	s.receive(&amp.Msg{Type: amp.Meta, Meta: conn.ReturnMeta})
+	assert.Equal(t, map[string]int64{"user/2/balance": 0}, brk.subs)
+	require.Len(t, s.outMessages, 2) // close for the user/1/balance and meta response
+	m = (<-s.outMessages)[0]
+	assert.Equal(t, "user/1/balance", m.URI)
+	assert.Equal(t, amp.Close, m.UpdateType)
+
+	conn.ReturnMeta = map[string]string{"user": "1"}
+	s.receive(&amp.Msg{Type: amp.Meta, Meta: conn.ReturnMeta})
+	assert.Equal(t, map[string]int64{"user/1/balance": 0}, brk.subs)
+}
+
+type poolBroker struct {
+	mockBroker
+	subs map[string]int64
+}
+
+func (b *poolBroker) Subscribe(c amp.Sender, subs map[string]int64) {
+	b.subs = subs
+	for name := range subs {
+		c.Send(amp.NewPublish(name, "", 1, amp.Full, nil))
+	}
+}
+
+func TestAuthorizePool(t *testing.T) {
+	auth := AuthorizerFunc(func(c Credentials, msgType uint8, topic string) uint8 {
+		if c.Headers["x-user"] == "1" && c.Meta["app"] == "web" && topic == "user/1" {
+			return Allowed
+		}
+		if topic == "private" {
+			return Filtered
+		}
+		return Denied
+	})
+	brk := &poolBroker{}
+	f := Factory(context.Background(), brk, &mockRequester{}, nil, UseAuthorizer(auth))
+	c := Credentials{Headers: map[string]string{"x-user": "1"}, RemoteIP: "1.2.3.4"}
+	sub := func() *amp.Msg {
+		return &amp.Msg{
+			Type:          amp.Subscribe,
+			Meta:          map[string]string{"app": "web"},
+			Subscriptions: map[string]int64{"user/1": 0, "user/2": 0, "private": 0},
+		}
+	}
+
+	msgs := f.PoolWithCredentials(sub(), c)
+	assert.Equal(t, map[string]int64{"user/1": 0}, brk.subs)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "user/2", msgs[0].URI)
+	assert.Equal(t, amp.Close, msgs[0].UpdateType)
+	assert.Equal(t, forbiddenCode, msgs[0].Error.Code)
+	assert.Equal(t, "user/1", msgs[1].URI)
+
+	// without credentials
+	msgs = f.Pool(sub())
+	require.Len(t, msgs, 2)
+	for _, m := range msgs {
+		assert.Equal(t, amp.Close, m.UpdateType)
+	}
+
+	// pattern topics are authorized in the background with pooler credentials
+	p := f.newPooler(Credentials{Headers: c.Headers, Meta: map[string]string{"app": "web"}})
+	assert.False(t, p.AllowTopic("user/1"))
+	assert.False(t, p.AllowTopic("user/2"))
+	select {
+	case <-p.patternAuth.sig:
+	case <-time.After(time.Second):
+		t.Fatal("pattern topic not authorized")
+	}
+	assert.True(t, p.AllowTopic("user/1"))
+	assert.False(t, p.AllowTopic("user/2"))
+}
+
+func TestAuthorizePatternOutsideBroker(t *testing.T) {
+	block := make(chan struct{})
+	auth := AuthorizerFunc(func(c Credentials, msgType uint8, topic string) uint8 {
+		if topic == "user/2" {
+			<-block
+		}
+		if topic == "user/*" || topic == "user/"+c.Meta["user"] {
+			return Allowed
+		}
+		return Denied
+	})
+	brk, c := newTestBroker()
+	s := &session{
+		conn:        &metaConn{mockConn{ReturnMeta: map[string]string{"user": "2"}}},
+		outMessages: make(chan []*amp.Msg, 256),
+		requester:   &mockRequester{},
+		broker:      brk,
+		authorizer:  auth,
+	}
+	s.subscribe(map[string]int64{"user/*": 0})
+
+	// slow authorizer doesn't block the broker
+	brk.Publish(amp.NewPublish("user/2", "", 1, amp.Full, map[string]int{"a": 1}))
+	m := brokerPublish(t, brk, c, amp.NewPublish("t1", "", 1, amp.Full, map[string]int{"a": 1}))
+	assert.Equal(t, "t1", m.URI)
+	assert.Len(t, s.outMessages, 0)
+
+	// when topic becomes allowed session subscribes again, as in the loop
+	close(block)
+	select {
+	case <-s.topicAuth().sig:
+	case <-time.After(time.Second):
+		t.Fatal("pattern topic not authorized")
+	}
+	s.broker.Subscribe(s, copySubscriptions(s.subscriptions))
+	select {
+	case msgs := <-s.outMessages:
+		assert.Equal(t, "user/2", msgs[0].URI)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+type replayBroker struct {
+	mockBroker
+}
+
+func (b *replayBroker) Replay(topic string) []*amp.Msg {
+	return []*amp.Msg{amp.NewPublish(topic, "", 100, amp.Full, map[string]int{"a": 100})}
+}
+
+func overflowSession(limit int, strategies ...uint8) *session {
+	return &session{
+		conn:           &metaConn{},
+		outMessages:    make(chan []*amp.Msg, 1),
+		requester:      &mockRequester{},
+		broker:         &replayBroker{},
+		overflow:       make(chan struct{}, 1),
+		backlogSig:     make(chan struct{}, 1),
+		overflowPolicy: &overflowPolicy{limit: limit, strategies: strategies},
+	}
+}
+
+func TestOverflowCoalesce(t *testing.T) {
+	s := overflowSession(2, OverflowCoalesce)
+	s.Send(amp.NewPublish("t1", "", 1, amp.Full, map[string]int{"a": 1}))
+	s.Send(amp.NewPublish("t1", "", 2, amp.Diff, map[string]int{"a": 2}))
+	s.Send(amp.NewPublish("t1", "", 3, amp.Diff, map[string]int{"b": 3}))
+	s.Send(amp.NewPublish("t2", "", 4, amp.Diff, map[string]int{"c": 4}))
+	s.Send(amp.NewPublish("t1", "", 5, amp.Diff, map[string]int{"a": 5}))
+
+	assert.Len(t, s.outMessages, 1)
+	require.Len(t, s.backlog, 2)
+	assert.Equal(t, int64(5), s.backlog[0].Ts)
+	assert.Equal(t, amp.Diff, s.backlog[0].UpdateType)
+	assert.Equal(t, "t2", s.backlog[1].URI)
+	assert.Equal(t, 2, s.overflowStats.coalesced)
+	assert.Len(t, s.overflow, 0)
+}
+
+func TestOverflowCoalesceDeleteThenSet(t *testing.T) {
+	s := overflowSession(1, OverflowCoalesce)
+	s.Send(amp.NewPublish("t1", "", 1, amp.Full, map[string]interface{}{"k": map[string]int{"a": 0, "b": 0}}))
+	s.Send(amp.NewPublish("t1", "", 2, amp.Diff, map[string]interface{}{"k": nil}))
+	s.Send(amp.NewPublish("t1", "", 3, amp.Diff, map[string]interface{}{"k": map[string]int{"a": 1}}))
+	s.Send(amp.NewPublish("t1", "", 4, amp.Diff, map[string]interface{}{"k": map[string]int{"c": 2}}))
+
+	// delete and set are kept as separate diffs, later diff is merged into set
+	require.Len(t, s.backlog, 2)
+	assert.Equal(t, int64(2), s.backlog[0].Ts)
+	assert.Equal(t, int64(4), s.backlog[1].Ts)
+
+	// client state after applying diffs
+	full := amp.Parse(amp.NewPublish("t1", "", 1, amp.Full, map[string]interface{}{"k": map[string]int{"a": 0, "b": 0}}).Marshal())
+	for _, m := range s.backlog {
+		var ok bool
+		full, ok = full.Merge(amp.Parse(m.Marshal()))
+		require.True(t, ok)
+	}
+	var state map[string]map[string]int
+	require.NoError(t, full.BodyTo(&state))
+	assert.Equal(t, map[string]int{"a": 1, "c": 2}, state["k"])
+}
+
+// brokerConsumer collects messages delivered by the broker
+type brokerConsumer struct {
+	msgs chan *amp.Msg
+}
+
+func (c *brokerConsumer) Meta() map[string]string    { return nil }
+func (c *brokerConsumer) Headers() map[string]string { return nil }
+func (c *brokerConsumer) Send(m *amp.Msg)            { c.msgs <- m }
+func (c *brokerConsumer) SendMsgs(ms []*amp.Msg) {
+	for _, m := range ms {
+		c.msgs <- m
+	}
+}
+
+// brokerPublish publishes message to the broker and returns the one delivered to the consumer
+func brokerPublish(t *testing.T, brk *ampbroker.Broker, c *brokerConsumer, m *amp.Msg) *amp.Msg {
+	brk.Publish(m)
+	select {
+	case m := <-c.msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+	return nil
+}
+
+func newTestBroker() (*ampbroker.Broker, *brokerConsumer) {
+	brk := ampbroker.New(nil, nil)
+	c := &brokerConsumer{msgs: make(chan *amp.Msg, 16)}
+	brk.Subscribe(c, map[string]int64{"t1": 0, "e": 0})
+	return brk, c
+}
+
+func TestOverflowDropEvents(t *testing.T) {
+	brk, c := newTestBroker()
+	s := overflowSession(2, OverflowDropEvents)
+	s.broker = brk
+	s.Send(amp.NewAlive())
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("t1", "", 1, amp.Full, map[string]int{"a": 1})))
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("e", "", 2, amp.Event, map[string]int{"b": 2})))
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("e", "", 3, amp.Event, map[string]int{"b": 3})))
+	require.Len(t, s.backlog, 1)
+	assert.Equal(t, "t1", s.backlog[0].URI)
+	assert.Equal(t, 2, s.overflowStats.dropped)
+	assert.Len(t, s.overflow, 0)
+}
+
+func TestOverflowReplaceKeepsEvents(t *testing.T) {
+	brk, c := newTestBroker()
+	s := overflowSession(2, OverflowReplace)
+	s.broker = brk
+	s.Send(amp.NewAlive())
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("t1", "", 1, amp.Full, map[string]int{"a": 1})))
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("t1", "", 2, amp.Diff, map[string]int{"a": 2})))
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("e", "", 3, amp.Event, map[string]int{"b": 3})))
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("t1", "", 4, amp.Diff, map[string]int{"a": 4})))
+	require.Len(t, s.backlog, 1)
+	assert.Equal(t, "e", s.backlog[0].URI)
+	assert.Len(t, s.replace, 1)
+	assert.Equal(t, 3, s.overflowStats.replaced)
+	assert.Len(t, s.overflow, 0)
+
+	out := make(chan []byte, 10)
+	s.conn = &metaConn{mockConn{out: out}}
+	s.flushBacklog()
+	require.Len(t, out, 5)
+	assert.Equal(t, amp.Alive, amp.Parse(<-out).Type)
+	// current t1 state from the broker
+	for _, ts := range []int64{1, 2, 4} {
+		m := amp.Parse(<-out)
+		assert.Equal(t, "t1", m.URI)
+		assert.Equal(t, ts, m.Ts)
+	}
+	m := amp.Parse(<-out)
+	assert.Equal(t, amp.Event, m.UpdateType)
+	assert.Equal(t, int64(3), m.Ts)
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	brk, c := newTestBroker()
+	s := overflowSession(1, OverflowCoalesce)
+	s.Send(amp.NewAlive())
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("e", "", 1, amp.Event, nil)))
+	assert.Len(t, s.overflow, 0)
+	s.Send(brokerPublish(t, brk, c, amp.NewPublish("e", "", 2, amp.Event, nil)))
+	assert.Len(t, s.overflow, 1)
+}
+
+type senderBroker struct {
+	mockBroker
+	sender chan amp.Sender
+}
+
+func (b *senderBroker) Subscribe(s amp.Sender, _ map[string]int64) { b.sender <- s }
+
+func TestResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	brk := &senderBroker{sender: make(chan amp.Sender, 1)}
+	f := Factory(ctx, brk, &mockRequester{}, nil, ResumeWindow(time.Minute, 8))
+
+	conn := &metaConn{mockConn{in: make(chan []byte, 1), out: make(chan []byte, 8)}}
+	done := make(chan struct{})
+	go func() {
+		f.Serve(conn)
+		close(done)
+	}()
+	m := amp.Parse(<-conn.out)
+	token := m.Meta[ResumeMetaKey]
+	require.NotEmpty(t, token)
+	conn.in <- (&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"e": 0}}).Marshal()
+	s := <-brk.sender
+
+	// disconnect, session is parked
+	close(conn.in)
+	<-done
+	s.Send(amp.NewPublish("e", "", 1, amp.Event, nil))
+	s.Send(amp.NewPublish("e", "", 2, amp.Event, nil))
+
+	conn = &metaConn{mockConn{
+		in:         make(chan []byte),
+		out:        make(chan []byte, 8),
+		ReturnMeta: map[string]string{ResumeMetaKey: token},
+	}}
+	done = make(chan struct{})
+	go func() {
+		f.Serve(conn)
+		close(done)
+	}()
+	m = amp.Parse(<-conn.out)
+	assert.Equal(t, "true", m.Meta[ResumedMetaKey])
+	assert.Equal(t, int64(1), amp.Parse(<-conn.out).Ts)
+	assert.Equal(t, int64(2), amp.Parse(<-conn.out).Ts)
+
+	close(conn.in)
+	<-done
+	cancel()
+	f.Wait()
+}
+
+func TestResumeRetentionExceeded(t *testing.T) {
+	newParked := func() *session {
+		s := &session{
+			token:       "token",
+			retention:   3,
+			outMessages: make(chan []*amp.Msg, 1),
+			backlogSig:  make(chan struct{}, 1),
+		}
+		// messages in the out queue are counted, not batches
+		s.SendMsgs([]*amp.Msg{amp.NewAlive(), amp.NewAlive()})
+		s.park()
+		return s
+	}
+	s := newParked()
+	s.Send(amp.NewAlive())
+	assert.True(t, s.attach(&metaConn{mockConn{}}))
+
+	s = newParked()
+	s.Send(amp.NewAlive())
+	s.Send(amp.NewAlive())
+	_, open := <-s.expiredSig
+	assert.False(t, open)
+	assert.False(t, s.attach(&metaConn{mockConn{}}))
+}
+
+func verifyAll(Credentials, string, string) bool { return true }
+
+type unsubscribeBroker struct {
+	senderBroker
+	unsubscribed chan amp.Sender
+}
+
+func (b *unsubscribeBroker) Unsubscribe(s amp.Sender) { b.unsubscribed <- s }
+
+func TestResumeParked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	brk := &unsubscribeBroker{
+		senderBroker: senderBroker{sender: make(chan amp.Sender, 1)},
+		unsubscribed: make(chan amp.Sender, 2),
+	}
+	f := Factory(ctx, brk, &mockRequester{}, nil, ResumeWindow(time.Minute, 1), IndexMeta(verifyAll, "userId"))
+
+	conn := &metaConn{mockConn{in: make(chan []byte, 1), out: make(chan []byte, 8), ReturnMeta: map[string]string{"userId": "42"}}}
+	done := make(chan struct{})
+	go func() {
+		f.Serve(conn)
+		close(done)
+	}()
+	token := amp.Parse(<-conn.out).Meta[ResumeMetaKey]
+	require.NotEmpty(t, token)
+	conn.in <- (&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"t": 1}}).Marshal()
+	s := <-brk.sender
+	close(conn.in)
+	<-done
+
+	// parked session stays in the index
+	m := &amp.Msg{Type: amp.Publish, URI: "user/42", Ts: 1}
+	assert.Equal(t, 1, f.Deliver("userId", "42", m))
+
+	meta := map[string]string{ResumeMetaKey: token, "userId": "42"}
+	conn = &metaConn{mockConn{in: make(chan []byte), out: make(chan []byte, 8), ReturnMeta: meta}}
+	done = make(chan struct{})
+	go func() {
+		f.Serve(conn)
+		close(done)
+	}()
+	assert.Equal(t, "true", amp.Parse(<-conn.out).Meta[ResumedMetaKey])
+	assert.Equal(t, int64(1), amp.Parse(<-conn.out).Ts)
+	// token is not kept in the session meta
+	assert.Equal(t, map[string]string{"userId": "42"}, s.Meta())
+	close(conn.in)
+	<-done
+
+	// expired session is unsubscribed without waiting for the window
+	assert.Equal(t, 1, f.Deliver("userId", "42", m))
+	assert.Equal(t, 1, f.Deliver("userId", "42", m))
+	select {
+	case us := <-brk.unsubscribed:
+		assert.Equal(t, s, us)
+	case <-time.After(time.Second):
+		t.Fatal("expired session not unsubscribed")
+	}
+	assert.Len(t, f.Stats(), 0)
+	assert.Equal(t, 0, f.Deliver("userId", "42", m))
+
+	cancel()
+	f.Wait()
+}
+
+func TestStatsAndClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	brk := &senderBroker{sender: make(chan amp.Sender, 1)}
+	f := Factory(ctx, brk, &mockRequester{}, nil)
+
+	conn := &metaConn{mockConn{in: make(chan []byte, 1), out: make(chan []byte, 8), ReturnMeta: map[string]string{"a": "b"}}}
+	done := make(chan struct{})
+	go func() {
+		f.Serve(conn)
+		close(done)
+	}()
+	conn.in <- (&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"t": 1}}).Marshal()
+	<-brk.sender
+
+	ss := f.Stats()
+	require.Len(t, ss, 1)
+	assert.Equal(t, map[string]string{"a": "b"}, ss[0].Meta)
+	assert.Equal(t, map[string]int64{"t": 1}, ss[0].Subscriptions)
+
+	assert.False(t, f.Close(1))
+	assert.True(t, f.Close(0))
+	<-done
+	assert.Len(t, f.Stats(), 0)
+	cancel()
+	f.Wait()
+}
+
+func TestDeliver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	brk := &senderBroker{sender: make(chan amp.Sender, 1)}
+	// client claiming userId 13 is not verified
+	verify := func(c Credentials, key, value string) bool {
+		return !(key == "userId" && value == "13")
+	}
+	f := Factory(ctx, brk, &mockRequester{}, nil, IndexMeta(verify, "userId", "deviceId"))
+
+	var conns []*metaConn
+	var done []chan struct{}
+	for _, meta := range []map[string]string{
+		{"userId": "42", "deviceId": "a"},
+		{"userId": "42", "deviceId": "b"},
+		{"userId": "7"},
+		{"userId": "13", "deviceId": "c"},
+	} {
+		conn := &metaConn{mockConn{in: make(chan []byte, 1), out: make(chan []byte, 8), ReturnMeta: meta}}
+		d := make(chan struct{})
+		go func() {
+			f.Serve(conn)
+			close(d)
+		}()
+		// wait for the session to be registered
+		conn.in <- (&amp.Msg{Type: amp.Subscribe, Subscriptions: map[string]int64{"t": 1}}).Marshal()
+		<-brk.sender
+		conns = append(conns, conn)
+		done = append(done, d)
+	}
+
+	m := &amp.Msg{Type: amp.Publish, URI: "user/42", Ts: 1}
+	assert.Equal(t, 2, f.Deliver("userId", "42", m))
+	assert.Equal(t, int64(1), amp.Parse(<-conns[0].out).Ts)
+	assert.Equal(t, int64(1), amp.Parse(<-conns[1].out).Ts)
+	assert.Equal(t, 1, f.Deliver("deviceId", "b", m))
+	assert.Equal(t, int64(1), amp.Parse(<-conns[1].out).Ts)
+	assert.Equal(t, 0, f.Deliver("userId", "1", m))
+	assert.Equal(t, 0, f.Deliver("unknown", "42", m))
+	assert.Equal(t, 0, f.Deliver("userId", "13", m))
+	assert.Equal(t, 1, f.Deliver("deviceId", "c", m))
+	assert.Equal(t, int64(1), amp.Parse(<-conns[3].out).Ts)
+
+	close(conns[0].in)
+	<-done[0]
+	assert.Equal(t, 1, f.Deliver("userId", "42", m))
+
+	cancel()
+	f.Wait()
+	for _, d := range done[1:] {
+		<-d
+	}
+	assert.Equal(t, 0, f.Deliver("userId", "42", m))
+}
+
+func limitedSession(opts ...func(*Sessions)) (*metaConn, chan struct{}) {
+	f := &Sessions{}
+	for _, fn := range opts {
+		fn(f)
+	}
+	conn := &metaConn{mockConn{in: make(chan []byte, 8), out: make(chan []byte, 8)}}
+	s := &session{
+		conn:        conn,
+		outMessages: make(chan []*amp.Msg, 256),
+		requester:   &mockRequester{},
+		broker:      &mockBroker{},
+		limiter:     newLimiter(f.limits),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.loop(context.Background())
+		close(done)
+	}()
+	return conn, done
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	conn, done := limitedSession(RateLimit(amp.Ping, 0, 2))
+	for i := 1; i <= 4; i++ {
+		conn.in <- ping(uint64(i)).Marshal()
+	}
+	conn.in <- (&amp.Msg{Type: amp.Meta}).Marshal() // not limited
+	assert.Equal(t, 1, msgCID(<-conn.out))
+	assert.Equal(t, 2, msgCID(<-conn.out))
+	assert.Equal(t, amp.Meta, amp.Parse(<-conn.out).Type)
+	close(conn.in)
+	<-done
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	conn, done := limitedSession(RateLimit(amp.Ping, 50, 1), RateLimitPolicy(RateLimitDelay))
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		conn.in <- ping(uint64(i)).Marshal()
+	}
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i, msgCID(<-conn.out))
+	}
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	close(conn.in)
+	<-done
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	conn, done := limitedSession(RateLimit(amp.Subscribe, 0, 1), RateLimitPolicy(RateLimitDisconnect))
+	conn.in <- ping(1).Marshal()
+	conn.in <- (&amp.Msg{Type: amp.Subscribe}).Marshal()
+	conn.in <- (&amp.Msg{Type: amp.Subscribe}).Marshal()
+	assert.Equal(t, 1, msgCID(<-conn.out))
+	<-done // closed by the session
+}
+
+func TestRateLimitIP(t *testing.T) {
+	f := &Sessions{}
+	RateLimitIP(0, 2)(f)
+	l1, l2 := newLimiter(f.limits), newLimiter(f.limits)
+	assert.Equal(t, time.Duration(0), l1.wait(ping(1), "1.2.3.4"))
+	assert.Equal(t, time.Duration(0), l2.wait(ping(1), "1.2.3.4"))
+	assert.NotEqual(t, time.Duration(0), l1.wait(ping(1), "1.2.3.4"))
+	assert.NotEqual(t, time.Duration(0), l2.wait(ping(1), "1.2.3.4"))
+	assert.Equal(t, time.Duration(0), l2.wait(ping(1), "5.6.7.8"))
+}
+
+type ipConn struct {
+	metaConn
+	ip string
+}
+
+func (c *ipConn) ClientIP() string { return c.ip }
+
+func TestConnIP(t *testing.T) {
+	assert.Equal(t, "1.2.3.4", connIP(&ipConn{ip: "1.2.3.4"}))
+	// raw X-Forwarded-For is not used
+	assert.Equal(t, "", connIP(&metaConn{}))
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(rateLimit{rate: 10, burst: 2})
+	b.last = now
+	assert.Equal(t, time.Duration(0), b.take(now))
+	assert.Equal(t, time.Duration(0), b.take(now))
+	assert.Equal(t, 100*time.Millisecond, b.take(now))
+	b.refund()
+	assert.False(t, b.full(now))
+	assert.Equal(t, time.Duration(0), b.take(now.Add(100*time.Millisecond)))
+	assert.True(t, b.full(now.Add(time.Second)))
+}
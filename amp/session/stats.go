@@ -0,0 +1,101 @@
+package session
+
+// SessionStats describes client session.
+type SessionStats struct {
+	No            uint64            `json:"no"`
+	RemoteIP      string            `json:"remoteIp,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"`
+	Subscriptions map[string]int64  `json:"subscriptions,omitempty"`
+	QueueDepth    int               `json:"queueDepth"` // messages waiting to be sent to the client
+	Parked        bool              `json:"parked,omitempty"`
+}
+
+func (f *Sessions) register(s *session) {
+	f.Lock()
+	f.live[s] = struct{}{}
+	f.Unlock()
+	if f.index != nil {
+		f.index.update(s) // resumed session can have different meta
+	}
+}
+
+func (f *Sessions) unregister(s *session) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.live, s)
+}
+
+// release removes session which won't be resumed from the index
+// and unsubscribes it.
+// Parked sessions stay in the index so they get delivered messages.
+func (f *Sessions) release(s *session) {
+	if f.index != nil {
+		f.index.remove(s)
+	}
+	s.unsubscribe()
+}
+
+// Stats returns stats for all connected and parked sessions.
+func (f *Sessions) Stats() []*SessionStats {
+	var ss []*SessionStats
+	for _, s := range f.sessions() {
+		ss = append(ss, s.sessionStats())
+	}
+	return ss
+}
+
+// Close closes session with connection number no.
+// Parked session is removed without waiting for resume.
+// Returns false if session is not found.
+func (f *Sessions) Close(no uint64) bool {
+	for _, s := range f.sessions() {
+		st := s.sessionStats()
+		if st.No != no {
+			continue
+		}
+		if st.Parked {
+			f.Lock()
+			_, ok := f.parked[s.token]
+			delete(f.parked, s.token)
+			f.Unlock()
+			if ok {
+				f.release(s)
+			}
+			return ok
+		}
+		s.connClose()
+		return true
+	}
+	return false
+}
+
+func (f *Sessions) sessions() []*session {
+	f.Lock()
+	defer f.Unlock()
+	var ss []*session
+	for s := range f.live {
+		ss = append(ss, s)
+	}
+	for _, p := range f.parked {
+		ss = append(ss, p.s)
+	}
+	return ss
+}
+
+func (s *session) sessionStats() *SessionStats {
+	conn := s.connection()
+	s.Lock()
+	defer s.Unlock()
+	st := &SessionStats{
+		No:            conn.No(),
+		RemoteIP:      conn.GetRemoteIp(),
+		Meta:          make(map[string]string),
+		Subscriptions: copySubscriptions(s.subscriptions),
+		QueueDepth:    len(s.outMessages) + len(s.backlog),
+		Parked:        s.parked,
+	}
+	for k, v := range conn.Meta() {
+		st.Meta[k] = v
+	}
+	return st
+}
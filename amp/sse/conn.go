@@ -0,0 +1,237 @@
+// Package sse implements amp client connection over server-sent events.
+//
+// Client opens event stream with GET request. First event in the stream
+// (event: session) carries session id. Client messages are sent as POST
+// requests with session id in the query string (?session=id), one message
+// per request. All other events are amp messages, each line of the message
+// in separate data field.
+package sse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	connectionsCounter uint64
+	inQueueLen         = 64
+)
+
+func no() uint64 {
+	return atomic.AddUint64(&connectionsCounter, 1)
+}
+
+// Conn handles sending and reciving on event stream connection
+type Conn struct {
+	id      string
+	no      uint64
+	w       http.ResponseWriter
+	flusher http.Flusher
+	in      chan []byte
+	closed  chan struct{}
+
+	meta           map[string]string
+	headers        map[string]string
+	cookie         string
+	remoteIP       string
+	ip             string
+	backendHeaders map[string]string
+
+	closeOnce sync.Once
+	metaLock  sync.RWMutex
+	sync.Mutex
+}
+
+func newConn(id string, w http.ResponseWriter, r *http.Request, trustedProxies int) (*Conn, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+	c := &Conn{
+		id:       id,
+		no:       no(),
+		w:        w,
+		flusher:  f,
+		in:       make(chan []byte, inQueueLen),
+		closed:   make(chan struct{}),
+		meta:     make(map[string]string),
+		headers:  make(map[string]string),
+		remoteIP: strings.Join(r.Header.Values("X-Forwarded-For"), " "),
+		cookie:   r.Header.Get("Cookie"),
+	}
+	c.ip = clientIP(c.remoteIP, trustedProxies, r.RemoteAddr)
+	if c.remoteIP == "" {
+		c.remoteIP = c.ip
+	}
+	for k, v := range r.URL.Query() {
+		c.meta[k] = strings.Join(v, ",")
+	}
+	for k := range r.Header {
+		c.headers[strings.ToLower(k)] = r.Header.Get(k)
+	}
+	return c, nil
+}
+
+// clientIP is the address in X-Forwarded-For header added by the first of
+// trusted proxies, or remote address.
+func clientIP(forwardedFor string, trustedProxies int, remoteAddr string) string {
+	f := strings.FieldsFunc(forwardedFor, func(r rune) bool { return r == ',' || r == ' ' })
+	if trustedProxies > 0 && len(f) > 0 {
+		if i := len(f) - trustedProxies; i > 0 {
+			return f[i]
+		}
+		return f[0]
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// writeEvent writes one event to the stream.
+func (c *Conn) writeEvent(event string, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.closed:
+		return errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+	buf := bytes.NewBuffer(nil)
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		c.close()
+		return errors.WithStack(err)
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Write writes payload to the event stream.
+func (c *Conn) Write(payload []byte, deflated bool) error {
+	return c.writeEvent("", payload)
+}
+
+// Read reads message posted by the client.
+func (c *Conn) Read() ([]byte, error) {
+	select {
+	case buf := <-c.in:
+		return buf, nil
+	case <-c.closed:
+		return nil, errors.WithStack(io.EOF)
+	}
+}
+
+// receive queues client message
+func (c *Conn) receive(buf []byte) error {
+	// checked first, select with both cases ready picks one at random
+	select {
+	case <-c.closed:
+		return errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+	select {
+	case c.in <- buf:
+		return nil
+	default:
+		return errors.New("in queue full")
+	}
+}
+
+// DeflateSupported is always false, compression is left to http layer.
+func (c *Conn) DeflateSupported() bool {
+	return false
+}
+
+// Headers usefull http headers
+func (c *Conn) Headers() map[string]string {
+	return c.headers
+}
+
+func (c *Conn) SetBackendHeaders(headers map[string]string) {
+	if c.backendHeaders == nil {
+		c.backendHeaders = make(map[string]string)
+	}
+	for k, v := range headers {
+		c.backendHeaders[k] = v
+	}
+}
+
+func (c *Conn) GetBackendHeaders() map[string]string {
+	return c.backendHeaders
+}
+
+// No returns connection identificator.
+func (c *Conn) No() uint64 {
+	return c.no
+}
+
+// Close ends event stream.
+func (c *Conn) Close() error {
+	c.close()
+	return nil
+}
+
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// Meta returns copy of the meta, from the query string of the stream
+// request and set by the client.
+func (c *Conn) Meta() map[string]string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	meta := make(map[string]string, len(c.meta))
+	for k, v := range c.meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+// SetMeta sets meta keys, key with empty value is removed.
+func (c *Conn) SetMeta(m map[string]string) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	for k, v := range m {
+		if v == "" {
+			delete(c.meta, k)
+			continue
+		}
+		c.meta[k] = v
+	}
+}
+
+// GetRemoteIp returns X-Forwarded-For header, or remote address without it.
+func (c *Conn) GetRemoteIp() string {
+	return c.remoteIP
+}
+
+// ClientIP returns client ip, from X-Forwarded-For header by trusted
+// proxies or remote address (see TrustedProxies).
+func (c *Conn) ClientIP() string {
+	return c.ip
+}
+
+func (c *Conn) GetCookie() string {
+	return c.cookie
+}
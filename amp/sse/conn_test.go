@@ -0,0 +1,74 @@
+package sse
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		forwardedFor   string
+		trustedProxies int
+		ip             string
+	}{
+		{"", 1, "10.0.0.1"},
+		{"1.1.1.1", 1, "1.1.1.1"},
+		{"6.6.6.6, 1.1.1.1", 1, "1.1.1.1"},
+		{"6.6.6.6, 1.1.1.1, 2.2.2.2", 2, "1.1.1.1"},
+		{"1.1.1.1", 2, "1.1.1.1"},
+		{"1.1.1.1", 0, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ip, clientIP(c.forwardedFor, c.trustedProxies, "10.0.0.1:1234"), c.forwardedFor)
+	}
+	assert.Equal(t, "pipe", clientIP("", 1, "pipe"))
+}
+
+func TestConnRemoteIp(t *testing.T) {
+	r := httptest.NewRequest("GET", "/sse?a=1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	c, err := newConn("id", httptest.NewRecorder(), r, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", c.GetRemoteIp())
+	assert.Equal(t, "10.0.0.1", c.ClientIP())
+	assert.Equal(t, "1", c.Meta()["a"])
+
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.1.1.1")
+	c, err = newConn("id", httptest.NewRecorder(), r, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "6.6.6.6, 1.1.1.1", c.GetRemoteIp())
+	assert.Equal(t, "1.1.1.1", c.ClientIP())
+}
+
+func TestConnWriteEvent(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, err := newConn("id", w, httptest.NewRequest("GET", "/sse", nil), 1)
+	require.NoError(t, err)
+	require.NoError(t, c.Write([]byte("{\"t\":0}\n{\"a\":1}\n"), false))
+	require.NoError(t, c.writeEvent(sessionEvent, []byte("id")))
+	assert.Equal(t, "data: {\"t\":0}\ndata: {\"a\":1}\n\nevent: session\ndata: id\n\n", w.Body.String())
+	assert.True(t, w.Flushed)
+
+	c.Close()
+	assert.Error(t, c.Write([]byte("x"), false))
+	_, err = c.Read()
+	assert.Error(t, err)
+}
+
+func TestConnReceive(t *testing.T) {
+	defer func(n int) { inQueueLen = n }(inQueueLen)
+	inQueueLen = 1
+	c, err := newConn("id", httptest.NewRecorder(), httptest.NewRequest("GET", "/sse", nil), 1)
+	require.NoError(t, err)
+	require.NoError(t, c.receive([]byte("1")))
+	assert.Error(t, c.receive([]byte("2"))) // queue full
+	buf, err := c.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(buf))
+
+	c.Close()
+	assert.Error(t, c.receive([]byte("3")))
+}
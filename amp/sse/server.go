@@ -0,0 +1,137 @@
+package sse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/minus5/svckit/log"
+)
+
+const (
+	sessionEvent = "session" // first event in the stream, data is session id
+	sessionParam = "session" // query string parameter for client messages
+	maxPostSize  = 1000000   // max client message size
+	contentType  = "text/event-stream"
+)
+
+// Server is http handler for event stream connections.
+type Server struct {
+	onNewConn      func(*Conn)
+	conns          map[string]*Conn
+	trustedProxies int // number of proxies which append to X-Forwarded-For
+	sync.Mutex
+}
+
+// TrustedProxies sets number of proxies in front of the server which
+// append to X-Forwarded-For header (default 1). Client ip is the address
+// added by the first of them. With 0 remote address is used.
+func TrustedProxies(n int) func(*Server) {
+	return func(s *Server) {
+		s.trustedProxies = n
+	}
+}
+
+// NewServer creates http handler. h is called for each new connection
+// and should block until the connection is closed.
+// Example:
+//
+//	httpi.Handle("/sse", sse.NewServer(func(c *sse.Conn) { sessions.Serve(c) }))
+func NewServer(h func(*Conn), opts ...func(*Server)) *Server {
+	s := &Server{
+		onNewConn:      h,
+		conns:          make(map[string]*Conn),
+		trustedProxies: 1,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// ServeHTTP opens event stream on GET and receives client messages on POST.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.stream(w, r)
+	case http.MethodPost:
+		s.post(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	id := newID()
+	c, err := newConn(id, w, r, s.trustedProxies)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	if err := c.writeEvent(sessionEvent, []byte(id)); err != nil {
+		return
+	}
+
+	s.add(c)
+	defer s.remove(c)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.Context().Done():
+			c.close()
+		case <-done:
+		}
+	}()
+	s.onNewConn(c) // blocks until connection is closed
+	close(done)
+	c.close()
+}
+
+func (s *Server) post(w http.ResponseWriter, r *http.Request) {
+	c := s.find(r.URL.Query().Get(sessionParam))
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPostSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := c.receive(buf); err != nil {
+		log.I("no", int(c.no)).Error(err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) add(c *Conn) {
+	s.Lock()
+	defer s.Unlock()
+	s.conns[c.id] = c
+}
+
+func (s *Server) remove(c *Conn) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, c.id)
+}
+
+func (s *Server) find(id string) *Conn {
+	s.Lock()
+	defer s.Unlock()
+	return s.conns[id]
+}
+
+func newID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
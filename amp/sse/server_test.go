@@ -0,0 +1,96 @@
+package sse
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads event name and data lines of the next event in the stream.
+func readEvent(t *testing.T, r *bufio.Reader) (string, []string) {
+	var event string
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	closed := make(chan *Conn, 1)
+	s := NewServer(func(c *Conn) {
+		defer func() { closed <- c }()
+		for {
+			buf, err := c.Read()
+			if err != nil {
+				return
+			}
+			if err := c.Write(buf, false); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL + "?userId=1")
+	require.NoError(t, err)
+	assert.Equal(t, contentType, rsp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", rsp.Header.Get("Cache-Control"))
+	br := bufio.NewReader(rsp.Body)
+	event, data := readEvent(t, br)
+	assert.Equal(t, sessionEvent, event)
+	require.Len(t, data, 1)
+	id := data[0]
+	c := s.find(id)
+	require.NotNil(t, c)
+	assert.Equal(t, "1", c.Meta()["userId"])
+	assert.Equal(t, "127.0.0.1", c.ClientIP())
+
+	// client message is echoed as event
+	prsp, err := http.Post(srv.URL+"?session="+id, "text/plain", strings.NewReader("{\"t\":1}\n{\"a\":1}"))
+	require.NoError(t, err)
+	prsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, prsp.StatusCode)
+	event, data = readEvent(t, br)
+	assert.Equal(t, "", event)
+	assert.Equal(t, []string{"{\"t\":1}", "{\"a\":1}"}, data)
+
+	// unknown session
+	prsp, err = http.Post(srv.URL+"?session=unknown", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	prsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, prsp.StatusCode)
+
+	// method not allowed
+	req, _ := http.NewRequest(http.MethodPut, srv.URL, nil)
+	prsp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	prsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, prsp.StatusCode)
+
+	// client closes stream
+	rsp.Body.Close()
+	select {
+	case cc := <-closed:
+		assert.Equal(t, c, cc)
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	assert.Eventually(t, func() bool { return s.find(id) == nil }, time.Second, 10*time.Millisecond)
+}
@@ -1,6 +1,7 @@
 package amp
 
 import (
+	"bytes"
 	"encoding/json"
 	"strings"
 
@@ -49,6 +50,39 @@ func ParseV1(buf []byte) *Msg {
 	return v2
 }
 
+// ParseV1FromServer parses message sent by the server in version 1 format.
+// Used by clients.
+func ParseV1FromServer(buf []byte) *Msg {
+	if len(buf) == 0 {
+		return nil
+	}
+	parts := bytes.SplitN(buf, separator, 2)
+	v1 := struct {
+		Type   uint8  `json:"t,omitempty"`
+		Stream string `json:"s,omitempty"`
+		No     int64  `json:"n,omitempty"`
+		Full   uint8  `json:"f,omitempty"`
+	}{}
+	if err := json.Unmarshal(parts[0], &v1); err != nil {
+		log.S("header", string(parts[0])).Error(err)
+		return nil
+	}
+	m := &Msg{
+		Type: v1.Type,
+		Ts:   v1.No,
+	}
+	if v1.Stream != "" {
+		m.URI = "sportsbook/" + v1.Stream
+	}
+	if v1.Full == 1 {
+		m.UpdateType = Full
+	}
+	if len(parts) > 1 && len(parts[1]) > 0 {
+		m.body = parts[1]
+	}
+	return m
+}
+
 func ParseV1Subscriptions(buf []byte) *Msg {
 	v1s := []struct {
 		Stream string `json:"s,omitempty"`
@@ -73,13 +107,13 @@ func ParseV1Subscriptions(buf []byte) *Msg {
 
 // Marshal packs message for sending on the wire
 func (m *Msg) MarshalV1() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersion1, jsonSerializer)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersion1, EncodingJSON, false)
 	return buf
 }
 
 // MarshalDeflate packs and compress message
 func (m *Msg) MarshalV1Deflate() ([]byte, bool) {
-	return m.marshal(CompressionDeflate, CompatibilityVersion1, jsonSerializer)
+	return m.marshal(CompressionDeflate, CompatibilityVersion1, EncodingJSON, false)
 }
 
 func (m *Msg) marshalV1header() []byte {
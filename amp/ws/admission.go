@@ -0,0 +1,225 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// Rejection reasons, used in metrics (ws.rejected.<reason>).
+const (
+	rejectMaxConnections = "maxConnections"
+	rejectMaxPerIP       = "maxPerIP"
+	rejectOrigin         = "origin"
+	rejectHeader         = "header"
+	rejectCookie         = "cookie"
+	rejectGeo            = "geo"
+	rejectHook           = "hook"
+)
+
+// ipChecker is implemented by geo.IPCheck.
+type ipChecker interface {
+	Check(ip string) bool
+}
+
+// admission decides which connections are upgraded.
+type admission struct {
+	maxConns int               // max number of connections, 0 unlimited
+	maxPerIP int               // max number of connections from the same ip, 0 unlimited
+	origins  []string          // allowed Origin headers, empty allows all
+	headers  map[string]string // required headers (lowercase keys), empty value requires only presence
+	cookies  []string          // required cookies
+	geo      ipChecker
+	hooks    []func(ip string, headers map[string]string) error
+
+	conns int            // current number of connections
+	ips   map[string]int // current number of connections by ip
+	sync.Mutex
+}
+
+// MaxConnections limits number of connections on the listener.
+// Connections over limit are rejected with 503 Service Unavailable.
+func MaxConnections(n int) func(*listener) {
+	return func(l *listener) {
+		l.adm.maxConns = n
+	}
+}
+
+// MaxConnectionsPerIP limits number of connections from the same client ip
+// (see TrustedProxies).
+// Connections over limit are rejected with 429 Too Many Requests.
+func MaxConnectionsPerIP(n int) func(*listener) {
+	return func(l *listener) {
+		l.adm.maxPerIP = n
+	}
+}
+
+// AllowOrigins sets allowed values of the Origin header.
+// Origin starting with "*." allows all subdomains: *.example.com.
+// Connections from other origins are rejected with 403 Forbidden.
+func AllowOrigins(origins ...string) func(*listener) {
+	return func(l *listener) {
+		l.adm.origins = origins
+	}
+}
+
+// RequireHeader rejects (403 Forbidden) connections without header.
+// Empty value requires only presence of the header.
+func RequireHeader(key, value string) func(*listener) {
+	return func(l *listener) {
+		if l.adm.headers == nil {
+			l.adm.headers = make(map[string]string)
+		}
+		l.adm.headers[strings.ToLower(key)] = value
+	}
+}
+
+// RequireCookie rejects (403 Forbidden) connections without cookie.
+func RequireCookie(name string) func(*listener) {
+	return func(l *listener) {
+		l.adm.cookies = append(l.adm.cookies, name)
+	}
+}
+
+// GeoCheck rejects (403 Forbidden) connections from ips which fail the check.
+// Usually *geo.IPCheck from pkg/geo.
+func GeoCheck(c ipChecker) func(*listener) {
+	return func(l *listener) {
+		l.adm.geo = c
+	}
+}
+
+// Admit adds hook called before upgrade with client ip and http headers
+// (lowercase keys). Connection is rejected if hook returns error;
+// with status from Rejection or 403 Forbidden.
+func Admit(hook func(ip string, headers map[string]string) error) func(*listener) {
+	return func(l *listener) {
+		l.adm.hooks = append(l.adm.hooks, hook)
+	}
+}
+
+// Rejection creates error which rejects connection with the http status and reason.
+func Rejection(status int, reason string) error {
+	return ws.RejectConnectionError(
+		ws.RejectionStatus(status),
+		ws.RejectionReason(reason),
+	)
+}
+
+// admit checks connection policies and takes connection slot.
+// Slot must be returned with release.
+func (a *admission) admit(ip string, cc *connCap) error {
+	if err := a.check(ip, cc); err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.maxConns > 0 && a.conns >= a.maxConns {
+		return a.reject(ip, rejectMaxConnections, http.StatusServiceUnavailable, nil)
+	}
+	if a.maxPerIP > 0 && a.ips[ip] >= a.maxPerIP {
+		return a.reject(ip, rejectMaxPerIP, http.StatusTooManyRequests, nil)
+	}
+	a.conns++
+	if a.ips == nil {
+		a.ips = make(map[string]int)
+	}
+	a.ips[ip]++
+	metric.Counter("ws.accepted")
+	metric.Gauge("ws.connections", a.conns)
+	return nil
+}
+
+// check connection policies which don't depend on other connections.
+func (a *admission) check(ip string, cc *connCap) error {
+	if len(a.origins) > 0 && !allowedOrigin(a.origins, cc.headers["origin"]) {
+		return a.reject(ip, rejectOrigin, http.StatusForbidden, nil)
+	}
+	for k, v := range a.headers {
+		hv, ok := cc.headers[k]
+		if !ok || (v != "" && hv != v) {
+			return a.reject(ip, rejectHeader, http.StatusForbidden, nil)
+		}
+	}
+	if len(a.cookies) > 0 {
+		r := &http.Request{Header: http.Header{"Cookie": {cc.cookie}}}
+		for _, name := range a.cookies {
+			if _, err := r.Cookie(name); err != nil {
+				return a.reject(ip, rejectCookie, http.StatusForbidden, nil)
+			}
+		}
+	}
+	if a.geo != nil && !a.geo.Check(ip) {
+		return a.reject(ip, rejectGeo, http.StatusForbidden, nil)
+	}
+	for _, hook := range a.hooks {
+		if err := hook(ip, cc.headers); err != nil {
+			return a.reject(ip, rejectHook, http.StatusForbidden, err)
+		}
+	}
+	return nil
+}
+
+// release returns connection slot.
+func (a *admission) release(ip string) {
+	a.Lock()
+	defer a.Unlock()
+	a.conns--
+	if a.ips[ip]--; a.ips[ip] <= 0 {
+		delete(a.ips, ip)
+	}
+	metric.Gauge("ws.connections", a.conns)
+}
+
+func (a *admission) reject(ip, reason string, status int, err error) error {
+	metric.Counter("ws.rejected." + reason)
+	log.S("ip", ip).S("reason", reason).Debug("connection rejected")
+	if _, ok := err.(*ws.ConnectionRejectedError); ok {
+		return err
+	}
+	return Rejection(status, http.StatusText(status))
+}
+
+func allowedOrigin(origins []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	host := origin
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	for _, o := range origins {
+		if o == origin || o == host {
+			return true
+		}
+		if strings.HasPrefix(o, "*.") && strings.HasSuffix(host, o[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address in X-Forwarded-For header added by the first of
+// trusted proxies, or remote address.
+func clientIP(forwardedFor string, trustedProxies int, tc net.Conn) string {
+	f := strings.FieldsFunc(forwardedFor, func(r rune) bool { return r == ',' || r == ' ' })
+	if trustedProxies > 0 && len(f) > 0 {
+		if i := len(f) - trustedProxies; i > 0 {
+			return f[i]
+		}
+		return f[0]
+	}
+	if tc.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(tc.RemoteAddr().String())
+	if err != nil {
+		return tc.RemoteAddr().String()
+	}
+	return host
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
+	"github.com/minus5/svckit/amp"
 	"github.com/pkg/errors"
 )
 
@@ -17,8 +19,18 @@ import (
 type Conn struct {
 	tcpConn net.Conn
 	cap     connCap
+	cfg     *config
 	no      uint64
 
+	message    []byte    // fragmented message being received
+	compressed bool      // message has rsv1 bit (permessage-deflate)
+	inflater   *inflater // client compression context, with context takeover
+	lastRead   int64     // unix nano of the last received frame
+	closeSent  int32     // close frame is sent
+	closeOnce  sync.Once
+	wlock      sync.Mutex // serializes frame writes (session, pinger, pong)
+	metaLock   sync.RWMutex
+
 	// backendHeaders can only be set and read on the backend.
 	backendHeaders map[string]string
 }
@@ -26,17 +38,23 @@ type Conn struct {
 // connCap connection capabilities and usefull atributes
 type connCap struct {
 	deflateSupported bool
+	contextTakeover  bool // client compresses with context takeover
 	userAgent        string
 	forwardedFor     string
+	ip               string // client ip, from forwardedFor by trusted proxies or remote address
+	admitted         bool   // holds connection slot in listener admission
 	meta             map[string]string
 	headers          map[string]string
 	cookie           string
+	encoding         uint8 // negotiated wire encoding
+	compression      uint8 // negotiated application level compression
 }
 
 var (
 	maxQueueLen        = 1024
 	aliveInterval      = 32 * time.Second
 	tcpDeadline        = 48 * time.Second // 1.5 * aliveInterval
+	closeTimeout       = time.Second      // wait for the client close frame
 	connectionsCounter uint64
 )
 
@@ -44,15 +62,28 @@ func setDeadline(c net.Conn) {
 	_ = c.SetDeadline(time.Now().Add(tcpDeadline))
 }
 
+// extendDeadline moves deadline after successful read or write.
+// Deadline set by CloseWithStatus is kept.
+func (c *Conn) extendDeadline() {
+	if atomic.LoadInt32(&c.closeSent) == 0 {
+		setDeadline(c.tcpConn)
+	}
+}
+
 func no() uint64 {
 	return atomic.AddUint64(&connectionsCounter, 1)
 }
 
-func newConn(tc net.Conn, cap connCap) *Conn {
+func newConn(tc net.Conn, cap connCap, cfg *config) *Conn {
 	c := &Conn{
-		tcpConn: tc,
-		cap:     cap,
-		no:      no(),
+		tcpConn:  tc,
+		cap:      cap,
+		cfg:      cfg,
+		no:       no(),
+		lastRead: time.Now().UnixNano(),
+	}
+	if cap.contextTakeover {
+		c.inflater = &inflater{}
 	}
 	return c
 }
@@ -77,68 +108,184 @@ func (c *Conn) GetBackendHeaders() map[string]string {
 }
 
 // Write writes payload to the websocket connection.
+// With application level compression deflated means that payload is
+// compressed by the negotiated compressor, and payload is prefixed with
+// the one byte compression flag.
 func (c *Conn) Write(payload []byte, deflated bool) error {
 	var header ws.Header
 	header.OpCode = ws.OpText
+	if c.cap.encoding == amp.EncodingMsgpack {
+		header.OpCode = ws.OpBinary
+	}
 	header.Length = int64(len(payload))
 	header.Fin = true
-	if deflated {
+	appCompression := amp.IsAppCompression(c.cap.compression)
+	if appCompression {
+		header.OpCode = ws.OpBinary
+		header.Length++
+	} else if deflated {
 		header.Rsv = ws.Rsv(true, false, false)
 	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
 	if err := ws.WriteHeader(c.tcpConn, header); err != nil {
-		_ = c.Close()
+		_ = c.tcpConn.Close()
 		return errors.WithStack(err)
 	}
+	if appCompression {
+		flag := []byte{0}
+		if deflated {
+			flag[0] = 1
+		}
+		if _, err := c.tcpConn.Write(flag); err != nil {
+			_ = c.tcpConn.Close()
+			return errors.WithStack(err)
+		}
+	}
 	_, err := c.tcpConn.Write(payload)
 	if err == nil {
-		setDeadline(c.tcpConn)
+		c.extendDeadline()
 	} else {
-		_ = c.Close()
+		_ = c.tcpConn.Close()
 	}
 	return errors.WithStack(err)
 }
 
+// writeFrame writes control frame.
+func (c *Conn) writeFrame(f ws.Frame) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return errors.WithStack(ws.WriteFrame(c.tcpConn, f))
+}
+
 // Read reads message from the connection.
+// Fragmented messages are reassembled, control frames handled.
 func (c *Conn) Read() ([]byte, error) {
+	for {
+		payload, err := c.readFrame()
+		if err != nil || payload != nil {
+			return payload, err
+		}
+	}
+}
+
+// readFrame reads one frame.
+// Returns nil payload for control frames and message fragments.
+func (c *Conn) readFrame() ([]byte, error) {
 	header, err := ws.ReadHeader(c.tcpConn)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if header.Length < 0 || header.Length > 1000000 {
+	if header.Length < 0 || int64(len(c.message))+header.Length > int64(c.cfg.maxMessageSize) {
+		_ = c.CloseWithStatus(ws.StatusMessageTooBig, "")
 		return nil, fmt.Errorf("malformed: %d -- %t -- %s -- %s", header.Length, c.cap.deflateSupported, c.cap.forwardedFor, c.cap.userAgent)
 	}
+	if header.OpCode.IsControl() && (header.Length > 125 || !header.Fin) {
+		_ = c.CloseWithStatus(ws.StatusProtocolError, "")
+		return nil, fmt.Errorf("malformed: control frame %d", header.Length)
+	}
 	payload := make([]byte, header.Length)
 	_, err = io.ReadFull(c.tcpConn, payload)
 	if err != nil {
-		c.Close()
+		_ = c.tcpConn.Close()
 		return nil, errors.WithStack(err)
 	}
+	if header.Masked {
+		ws.Cipher(payload, header.Mask, 0)
+	}
+	c.extendDeadline()
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
 
-	if header.OpCode == ws.OpClose {
-		c.Close()
+	switch header.OpCode {
+	case ws.OpClose:
+		c.onClose(payload)
 		return nil, errors.WithStack(io.EOF)
-	}
-	if header.OpCode == ws.OpContinuation {
+	case ws.OpPing:
+		_ = c.writeFrame(ws.NewPongFrame(payload))
+		return nil, nil
+	case ws.OpPong:
+		return nil, nil
+	case ws.OpText, ws.OpBinary:
+		if c.message != nil {
+			_ = c.CloseWithStatus(ws.StatusProtocolError, "")
+			return nil, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		c.compressed = header.Rsv1()
+		c.message = payload
+	case ws.OpContinuation:
+		if c.message == nil {
+			_ = c.CloseWithStatus(ws.StatusProtocolError, "")
+			return nil, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		c.message = append(c.message, payload...)
+	default:
+		_ = c.CloseWithStatus(ws.StatusProtocolError, "")
 		return nil, errors.WithStack(io.ErrUnexpectedEOF)
 	}
-	if header.OpCode == ws.OpPing {
-		header.OpCode = ws.OpPong
-		header.Masked = false
-		_ = ws.WriteHeader(c.tcpConn, header)
+	if !header.Fin {
 		return nil, nil
 	}
-	if header.OpCode == ws.OpPong {
-		return nil, nil
+
+	payload, c.message = c.message, nil
+	if c.compressed {
+		if c.inflater != nil {
+			payload, err = c.inflater.inflate(payload, c.cfg.maxMessageSize)
+		} else {
+			payload, err = undeflate(payload, c.cfg.maxMessageSize)
+		}
+		if err == errMessageTooBig {
+			_ = c.CloseWithStatus(ws.StatusMessageTooBig, "")
+			return nil, fmt.Errorf("malformed: inflated message over %d -- %s -- %s", c.cfg.maxMessageSize, c.cap.forwardedFor, c.cap.userAgent)
+		}
+		if err != nil {
+			_ = c.CloseWithStatus(ws.StatusInvalidFramePayloadData, "")
+			return nil, fmt.Errorf("malformed: inflate %s -- %s -- %s", err, c.cap.forwardedFor, c.cap.userAgent)
+		}
 	}
-	if header.Masked {
-		ws.Cipher(payload, header.Mask, 0)
+	// empty message is not a control frame
+	if payload == nil {
+		payload = []byte{}
 	}
-	if header.Rsv1() {
-		payload = undeflate(payload)
+	return payload, nil
+}
+
+// onClose responds to the close frame sent by the client and closes connection.
+func (c *Conn) onClose(payload []byte) {
+	if atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		code := ws.StatusNormalClosure
+		if len(payload) >= 2 {
+			code, _ = ws.ParseCloseFrameData(payload)
+		}
+		_ = c.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, "")))
 	}
+	_ = c.tcpConn.Close()
+}
 
-	setDeadline(c.tcpConn)
-	return payload, nil
+// ping sends pings to the client every interval and closes connection if
+// nothing is received from the client for idle duration.
+// Returns when done is closed.
+func (c *Conn) ping(done <-chan struct{}) {
+	if c.cfg.pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+			if c.cfg.idleTimeout > 0 && idle > c.cfg.idleTimeout {
+				_ = c.CloseWithStatus(ws.StatusGoingAway, "idle")
+				return
+			}
+			if err := c.writeFrame(ws.NewPingFrame(nil)); err != nil {
+				_ = c.tcpConn.Close()
+				return
+			}
+		}
+	}
 }
 
 // No returns connection identificator.
@@ -146,43 +293,146 @@ func (c *Conn) No() uint64 {
 	return c.no
 }
 
+// Encoding of the messages negotiated with the client (amp.EncodingJSON or amp.EncodingMsgpack).
+func (c *Conn) Encoding() uint8 {
+	return c.cap.encoding
+}
+
+// Compression negotiated with the client, CompressionDeflate if websocket
+// permessage-deflate is supported, or application level compression.
+func (c *Conn) Compression() uint8 {
+	if c.cap.compression != amp.CompressionNone {
+		return c.cap.compression
+	}
+	if c.cap.deflateSupported {
+		return amp.CompressionDeflate
+	}
+	return amp.CompressionNone
+}
+
 // DeflateSupported whether websocket connection supports per message deflate.
 func (c *Conn) DeflateSupported() bool {
 	return c.cap.deflateSupported
 }
 
-// Close starts clearing connection.
-// Closes tcpConn, that will raise error on reading and break receiveLoop.
+// Close starts closing handshake with the normal closure status.
 func (c *Conn) Close() error {
-	return c.tcpConn.Close()
+	return c.CloseWithStatus(ws.StatusNormalClosure, "")
+}
+
+// CloseWithStatus sends close frame with the code and reason to the client.
+// Tcp connection is closed when client responds (raises error on reading
+// and breaks receiveLoop), or after closeTimeout.
+func (c *Conn) CloseWithStatus(code ws.StatusCode, reason string) error {
+	var err error
+	if atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		c.wlock.Lock()
+		_ = c.tcpConn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		err = errors.WithStack(ws.WriteFrame(c.tcpConn, ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason))))
+		c.wlock.Unlock()
+	}
+	c.closeOnce.Do(func() {
+		if err != nil {
+			_ = c.tcpConn.Close()
+			return
+		}
+		time.AfterFunc(closeTimeout, func() { _ = c.tcpConn.Close() })
+	})
+	return err
 }
 
-// Cookies from the requests which started connection
+// Meta returns copy of the connection meta (query string of the
+// request which started connection and meta set by the client).
 func (c *Conn) Meta() map[string]string {
-	return c.cap.meta
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return copyMeta(c.cap.meta)
 }
 
+// SetMeta sets meta keys, key with empty value is removed.
 func (c *Conn) SetMeta(m map[string]string) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	if c.cap.meta == nil {
+		c.cap.meta = make(map[string]string)
+	}
 	for k, v := range m {
+		if v == "" {
+			delete(c.cap.meta, k)
+			continue
+		}
 		c.cap.meta[k] = v
 	}
 }
 
+func copyMeta(m map[string]string) map[string]string {
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
 func (c *Conn) GetRemoteIp() string {
 	return c.cap.forwardedFor
 }
 
+// ClientIP returns client ip, from X-Forwarded-For header by trusted
+// proxies or tcp remote address (see TrustedProxies).
+func (c *Conn) ClientIP() string {
+	return c.cap.ip
+}
+
 func (c *Conn) GetCookie() string {
 	return c.cap.cookie
 }
 
+// inflater decompresses messages of the client which uses context takeover.
+// Window of the previous uncompressed messages is dictionary for the next one.
+type inflater struct {
+	window []byte
+}
+
+const maxWindow = 1 << 15
+
+func (i *inflater) inflate(data []byte, limit int) ([]byte, error) {
+	buf := bytes.NewBuffer(data)
+	buf.Write([]byte{0x00, 0x00, 0xff, 0xff})
+	r := flate.NewReaderDict(buf, i.window)
+	defer r.Close()
+	out, err := readLimited(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	i.window = append(i.window, out...)
+	if len(i.window) > maxWindow {
+		i.window = append([]byte(nil), i.window[len(i.window)-maxWindow:]...)
+	}
+	return out, nil
+}
+
 // undeflate uncomresses websocket payload
-func undeflate(data []byte) []byte {
+func undeflate(data []byte, limit int) ([]byte, error) {
 	buf := bytes.NewBuffer(data)
 	buf.Write([]byte{0x00, 0x00, 0xff, 0xff})
 	r := flate.NewReader(buf)
 	defer r.Close()
+	return readLimited(r, limit)
+}
+
+var errMessageTooBig = errors.New("message too big")
+
+// readLimited reads inflated message up to limit bytes.
+// Payload ends with sync flush block, not with the final one,
+// so reader ends with io.ErrUnexpectedEOF.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
 	out := bytes.NewBuffer(nil)
-	_, _ = io.Copy(out, r)
-	return out.Bytes()
+	_, err := io.Copy(out, io.LimitReader(r, int64(limit)+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if out.Len() > limit {
+		return nil, errMessageTooBig
+	}
+	return out.Bytes(), nil
 }
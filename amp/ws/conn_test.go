@@ -0,0 +1,374 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	log.Discard()
+}
+
+// echoServer responds with the same payload on each client message.
+func echoServer(t *testing.T, opts ...func(*listener)) (string, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go Listen(ctx, ln, func(c *Conn) {
+		for {
+			buf, err := c.Read()
+			if err != nil {
+				return
+			}
+			if err := c.Write(buf, false); err != nil {
+				return
+			}
+		}
+	}, opts...)
+	return fmt.Sprintf("ws://%s/", ln.Addr().String()), cancel
+}
+
+// dial returns client connection and reader which includes data buffered during handshake.
+func dial(t *testing.T, url string) (net.Conn, io.Reader) {
+	conn, br, _, err := ws.Dial(context.Background(), url)
+	require.NoError(t, err)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if br != nil {
+		return conn, br
+	}
+	return conn, conn
+}
+
+func writeFrame(t *testing.T, conn net.Conn, op ws.OpCode, fin bool, p []byte) {
+	require.NoError(t, ws.WriteFrame(conn, ws.MaskFrame(ws.NewFrame(op, fin, p))))
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	url, stop := echoServer(t)
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	writeFrame(t, conn, ws.OpText, false, []byte("first "))
+	writeFrame(t, conn, ws.OpPing, true, []byte("ping")) // control frame between fragments
+	writeFrame(t, conn, ws.OpContinuation, false, []byte("second "))
+	writeFrame(t, conn, ws.OpContinuation, true, []byte("third"))
+
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpPong, f.Header.OpCode)
+	assert.Equal(t, "ping", string(f.Payload))
+	f, err = ws.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpText, f.Header.OpCode)
+	assert.Equal(t, "first second third", string(f.Payload))
+}
+
+func TestMessageTooBig(t *testing.T) {
+	url, stop := echoServer(t, MaxMessageSize(10))
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	writeFrame(t, conn, ws.OpText, false, []byte("012345"))
+	writeFrame(t, conn, ws.OpContinuation, true, []byte("6789ab"))
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, f.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(f.Payload)
+	assert.Equal(t, ws.StatusMessageTooBig, code)
+}
+
+func TestInflatedMessageTooBig(t *testing.T) {
+	url, stop := echoServer(t, MaxMessageSize(100))
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	// compressed payload fits, inflated doesn't
+	f := ws.NewFrame(ws.OpText, true, compressWithWindow(t, nil, bytes.Repeat([]byte("a"), 1000)))
+	f.Header.Rsv = ws.Rsv(true, false, false)
+	require.NoError(t, ws.WriteFrame(conn, ws.MaskFrame(f)))
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, f.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(f.Payload)
+	assert.Equal(t, ws.StatusMessageTooBig, code)
+}
+
+func TestUnexpectedContinuation(t *testing.T) {
+	url, stop := echoServer(t)
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	writeFrame(t, conn, ws.OpContinuation, true, []byte("x"))
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	code, _ := ws.ParseCloseFrameData(f.Payload)
+	assert.Equal(t, ws.StatusProtocolError, code)
+}
+
+func TestCloseHandshake(t *testing.T) {
+	url, stop := echoServer(t)
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	writeFrame(t, conn, ws.OpClose, true, ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"))
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, f.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(f.Payload)
+	assert.Equal(t, ws.StatusGoingAway, code)
+	_, err = ws.ReadFrame(r)
+	assert.Error(t, err) // closed by server
+}
+
+func TestServerClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go Listen(ctx, ln, func(c *Conn) {
+		_ = c.CloseWithStatus(ws.StatusPolicyViolation, "limit")
+		_, _ = c.Read()
+	})
+	conn, r := dial(t, fmt.Sprintf("ws://%s/", ln.Addr().String()))
+	defer conn.Close()
+
+	f, err := ws.ReadFrame(r)
+	require.NoError(t, err)
+	code, reason := ws.ParseCloseFrameData(f.Payload)
+	assert.Equal(t, ws.StatusPolicyViolation, code)
+	assert.Equal(t, "limit", reason)
+	writeFrame(t, conn, ws.OpClose, true, f.Payload)
+	_, err = ws.ReadFrame(r)
+	assert.Error(t, err)
+}
+
+func TestPingAndIdle(t *testing.T) {
+	url, stop := echoServer(t, PingInterval(10*time.Millisecond, 50*time.Millisecond))
+	defer stop()
+	conn, r := dial(t, url)
+	defer conn.Close()
+
+	// client doesn't respond to pings
+	pings := 0
+	for {
+		f, err := ws.ReadFrame(r)
+		require.NoError(t, err)
+		if f.Header.OpCode == ws.OpPing {
+			pings++
+			continue
+		}
+		assert.Equal(t, ws.OpClose, f.Header.OpCode)
+		code, _ := ws.ParseCloseFrameData(f.Payload)
+		assert.Equal(t, ws.StatusGoingAway, code)
+		break
+	}
+	assert.True(t, pings > 0)
+}
+
+func TestContextTakeover(t *testing.T) {
+	in := &inflater{}
+	msgs := []string{`{"t":2,"u":"math.req/add"}`, `{"t":2,"u":"math.req/add","i":2}`}
+	// client compressor with context takeover
+	var window []byte
+	for _, msg := range msgs {
+		c := compressWithWindow(t, window, []byte(msg))
+		out, err := in.inflate(c, 1024)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(out))
+		window = append(window, msg...)
+	}
+	// without context takeover
+	out, err := in.inflate(compressWithWindow(t, nil, []byte(msgs[0])), 1024)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[0], string(out))
+}
+
+func TestInflateLimit(t *testing.T) {
+	msg := bytes.Repeat([]byte("a"), 1000)
+	c := compressWithWindow(t, nil, msg)
+	out, err := undeflate(c, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	_, err = undeflate(c, 999)
+	assert.Equal(t, errMessageTooBig, err)
+	in := &inflater{}
+	_, err = in.inflate(c, 999)
+	assert.Equal(t, errMessageTooBig, err)
+	assert.Len(t, in.window, 0)
+
+	_, err = undeflate([]byte{0xff, 0xff, 0xff}, 1000)
+	assert.Error(t, err)
+}
+
+// compressWithWindow compresses as permessage-deflate client with previous messages in window.
+func compressWithWindow(t *testing.T, window, msg []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	w, err := flate.NewWriterDict(buf, flate.DefaultCompression, window)
+	require.NoError(t, err)
+	_, err = w.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+func dialHeaders(url string, h http.Header) (net.Conn, error) {
+	d := ws.Dialer{Header: ws.HandshakeHeaderHTTP(h)}
+	conn, _, _, err := d.Dial(context.Background(), url)
+	return conn, err
+}
+
+func rejectedWith(t *testing.T, err error, status int) {
+	require.Error(t, err)
+	se, ok := err.(ws.StatusError)
+	require.True(t, ok, err.Error())
+	assert.Equal(t, status, int(se))
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	url, stop := echoServer(t, MaxConnections(2), MaxConnectionsPerIP(1))
+	defer stop()
+
+	// first address is set by the client, last by the trusted proxy
+	c1, err := dialHeaders(url, http.Header{"X-Forwarded-For": {"9.9.9.9, 1.1.1.1"}})
+	require.NoError(t, err)
+	_, err = dialHeaders(url, http.Header{"X-Forwarded-For": {"1.1.1.1"}})
+	rejectedWith(t, err, http.StatusTooManyRequests)
+	c2, err := dialHeaders(url, http.Header{"X-Forwarded-For": {"2.2.2.2"}})
+	require.NoError(t, err)
+	_, err = dialHeaders(url, http.Header{"X-Forwarded-For": {"3.3.3.3"}})
+	rejectedWith(t, err, http.StatusServiceUnavailable)
+
+	// slot is released when connection is closed
+	c1.Close()
+	require.Eventually(t, func() bool {
+		c, err := dialHeaders(url, http.Header{"X-Forwarded-For": {"1.1.1.1"}})
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+	c2.Close()
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestClientIP(t *testing.T) {
+	tc := remoteAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+	cases := []struct {
+		forwardedFor   string
+		trustedProxies int
+		ip             string
+	}{
+		{"", 1, "10.0.0.1"},
+		{"1.1.1.1", 1, "1.1.1.1"},
+		{"9.9.9.9, 1.1.1.1", 1, "1.1.1.1"},
+		{"9.9.9.9, 1.1.1.1, 10.0.0.2", 2, "1.1.1.1"},
+		{"1.1.1.1", 2, "1.1.1.1"},
+		{"9.9.9.9 1.1.1.1", 1, "1.1.1.1"}, // multiple headers
+		{"1.1.1.1", 0, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ip, clientIP(c.forwardedFor, c.trustedProxies, tc), c.forwardedFor)
+	}
+}
+
+type geoMock struct{}
+
+func (geoMock) Check(ip string) bool { return ip != "6.6.6.6" }
+
+func TestAdmissionPolicies(t *testing.T) {
+	url, stop := echoServer(t,
+		AllowOrigins("https://example.com", "*.example.org"),
+		RequireHeader("X-Client", ""),
+		RequireCookie("session"),
+		GeoCheck(geoMock{}),
+		Admit(func(ip string, headers map[string]string) error {
+			if headers["x-client"] == "scraper" {
+				return Rejection(http.StatusUnauthorized, "go away")
+			}
+			return nil
+		}),
+	)
+	defer stop()
+	valid := func() http.Header {
+		return http.Header{
+			"Origin":   {"https://app.example.org"},
+			"X-Client": {"web"},
+			"Cookie":   {"a=b; session=123"},
+		}
+	}
+
+	c, err := dialHeaders(url, valid())
+	require.NoError(t, err)
+	c.Close()
+
+	h := valid()
+	h.Set("Origin", "https://evil.com")
+	_, err = dialHeaders(url, h)
+	rejectedWith(t, err, http.StatusForbidden)
+
+	h = valid()
+	h.Del("X-Client")
+	_, err = dialHeaders(url, h)
+	rejectedWith(t, err, http.StatusForbidden)
+
+	h = valid()
+	h.Set("Cookie", "a=b")
+	_, err = dialHeaders(url, h)
+	rejectedWith(t, err, http.StatusForbidden)
+
+	h = valid()
+	h.Set("X-Forwarded-For", "6.6.6.6")
+	_, err = dialHeaders(url, h)
+	rejectedWith(t, err, http.StatusForbidden)
+
+	h = valid()
+	h.Set("X-Client", "scraper")
+	_, err = dialHeaders(url, h)
+	rejectedWith(t, err, http.StatusUnauthorized)
+}
+
+func TestMetaConcurrent(t *testing.T) {
+	c := &Conn{cap: connCap{meta: map[string]string{"a": "1"}}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.SetMeta(map[string]string{fmt.Sprintf("k%d", i): "v"})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for range c.Meta() {
+		}
+	}
+	<-done
+	c.SetMeta(map[string]string{"a": ""})
+	meta := c.Meta()
+	assert.Len(t, meta, 100)
+	meta["b"] = "2" // copy
+	assert.NotContains(t, c.Meta(), "b")
+}
@@ -8,9 +8,11 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
+	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
 	"github.com/pkg/errors"
 )
@@ -18,6 +20,62 @@ import (
 type listener struct {
 	ln        net.Listener
 	onNewConn func(*Conn)
+	cfg       config
+	adm       admission
+}
+
+// config of the connections
+type config struct {
+	maxMessageSize  int           // max size of the (reassembled) client message
+	pingInterval    time.Duration // interval of the server pings, 0 disables pings
+	idleTimeout     time.Duration // close connection when nothing is received from the client
+	contextTakeover bool          // allow client to compress with context takeover
+	trustedProxies  int           // number of proxies which append to X-Forwarded-For
+}
+
+var defaultConfig = config{
+	maxMessageSize: 1000000,
+	pingInterval:   16 * time.Second,
+	idleTimeout:    tcpDeadline,
+	trustedProxies: 1,
+}
+
+// MaxMessageSize sets max size of the client message.
+// Connection of the client which sends larger message is closed with status 1009.
+func MaxMessageSize(n int) func(*listener) {
+	return func(l *listener) {
+		l.cfg.maxMessageSize = n
+	}
+}
+
+// PingInterval sets interval of the websocket pings sent to the client.
+// Connection is closed (status 1001) if nothing is received from the
+// client for idle duration. Zero interval disables pings.
+func PingInterval(interval, idle time.Duration) func(*listener) {
+	return func(l *listener) {
+		l.cfg.pingInterval = interval
+		l.cfg.idleTimeout = idle
+	}
+}
+
+// ContextTakeover allows client to use permessage-deflate context takeover.
+// Server messages are always compressed without context takeover, they are
+// compressed once and sent to many clients.
+func ContextTakeover() func(*listener) {
+	return func(l *listener) {
+		l.cfg.contextTakeover = true
+	}
+}
+
+// TrustedProxies sets number of proxies in front of the listener which
+// append to the X-Forwarded-For header (default 1, last hop).
+// Client ip is the address added by the first of them, addresses before
+// it are set by the client. Zero ignores the header, client ip is the
+// tcp remote address.
+func TrustedProxies(n int) func(*listener) {
+	return func(l *listener) {
+		l.cfg.trustedProxies = n
+	}
 }
 
 // Open opens new tcp port.
@@ -43,10 +101,15 @@ func MustOpen(port int) net.Listener {
 
 // Listen starts listening for new connections, blocks until ctx closed.
 // Then stops listening for new connections, and waits for current to finish.
-func Listen(ctx context.Context, ln net.Listener, h func(*Conn)) {
+// opts are functions to set additional options.
+func Listen(ctx context.Context, ln net.Listener, h func(*Conn), opts ...func(*listener)) {
 	l := &listener{
 		ln:        ln,
 		onNewConn: h,
+		cfg:       defaultConfig,
+	}
+	for _, fn := range opts {
+		fn(l)
 	}
 	go func() {
 		<-ctx.Done()
@@ -75,12 +138,18 @@ func (l *listener) loop() {
 func (l *listener) onConn(tc net.Conn) {
 	setDeadline(tc)
 	cc, err := l.upgrade(tc) // upgrade tcp konkekcije na websocket
+	if cc.admitted {
+		defer l.adm.release(cc.ip)
+	}
 	if err != nil {
 		_ = tc.Close()
 		return
 	}
-	c := newConn(tc, cc)
+	c := newConn(tc, cc, &l.cfg)
+	done := make(chan struct{})
+	go c.ping(done)
 	l.onNewConn(c) // ovdje blocka do prekida komunikacije
+	close(done)
 }
 
 func (l *listener) upgrade(tc net.Conn) (connCap, error) {
@@ -89,6 +158,15 @@ func (l *listener) upgrade(tc net.Conn) (connCap, error) {
 	}
 
 	ug := ws.Upgrader{
+		// klijent trazi binarni (MessagePack) format poruka i/ili kompresiju
+		// na aplikacijskom nivou (amp.json+deflate-dict)
+		Protocol: func(p []byte) bool {
+			encoding, compression, ok := amp.ParseSubprotocol(string(p))
+			if ok {
+				cc.encoding, cc.compression = encoding, compression
+			}
+			return ok
+		},
 		// podrzava li klijent websocket permessage-deflate
 		ExtensionCustom: func(f []byte, os []httphead.Option) ([]httphead.Option, bool) {
 			os = make([]httphead.Option, 0)
@@ -99,9 +177,13 @@ func (l *listener) upgrade(tc net.Conn) (connCap, error) {
 			}
 			if strings.Contains(field, "permessage-deflate") && !cc.deflateSupported {
 				params := map[string]string{
-					"client_no_context_takeover": "",
 					"server_no_context_takeover": "",
 				}
+				if l.cfg.contextTakeover {
+					cc.contextTakeover = true
+				} else {
+					params["client_no_context_takeover"] = ""
+				}
 				os = append(os, httphead.NewOption("permessage-deflate", params))
 				cc.deflateSupported = true
 			}
@@ -115,6 +197,15 @@ func (l *listener) upgrade(tc net.Conn) (connCap, error) {
 			}
 			return os, true
 		},
+		// provjera pravila za prihvat konekcije, odbijamo s http statusom
+		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+			cc.ip = clientIP(cc.forwardedFor, l.cfg.trustedProxies, tc)
+			if err := l.adm.admit(cc.ip, &cc); err != nil {
+				return nil, err
+			}
+			cc.admitted = true
+			return nil, nil
+		},
 		OnRequest: func(uri []byte) error {
 			cc.meta = parseQueryString(uri)
 			for k, v := range cc.meta {
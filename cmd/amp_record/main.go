@@ -0,0 +1,97 @@
+// amp_record records amp topic traffic from nsq and replays recordings.
+//
+// Record topics until interrupted:
+//
+//	amp_record -topics sportsbook/m,sportsbook/s -out match.gz
+//
+// Recording uses ephemeral nsq channel unless -channel is set.
+//
+// Replay recording four times faster to nsq (topic of each message):
+//
+//	amp_record -replay match.gz -speed 4 -nsq
+//
+// Replay recording into broker served on websocket port (for clients):
+//
+//	amp_record -replay match.gz -ws 8080
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/local"
+	"github.com/minus5/svckit/amp/nsq"
+	"github.com/minus5/svckit/amp/record"
+	"github.com/minus5/svckit/amp/session"
+	"github.com/minus5/svckit/amp/ws"
+	"github.com/minus5/svckit/log"
+	snsq "github.com/minus5/svckit/nsq"
+	"github.com/minus5/svckit/signal"
+)
+
+func main() {
+	topics := flag.String("topics", "", "comma separated nsq topics to record")
+	channel := flag.String("channel", "", "nsq channel for recording, default is ephemeral channel")
+	out := flag.String("out", "amp.gz", "recording file")
+	replay := flag.String("replay", "", "recording file to replay")
+	speed := flag.Float64("speed", 1, "replay speed factor, 0 replays without waiting")
+	toNsq := flag.Bool("nsq", false, "replay to nsq")
+	wsPort := flag.Int("ws", 0, "replay into broker served on the websocket port")
+	flag.Parse()
+
+	interupt := signal.InteruptContext()
+	switch {
+	case *replay != "" && *toNsq:
+		replayToNsq(interupt, *replay, *speed)
+	case *replay != "" && *wsPort > 0:
+		replayToBroker(interupt, *replay, *speed, *wsPort)
+	case *topics != "":
+		if *channel != "" {
+			snsq.DefaultChannel(*channel)
+		} else {
+			snsq.ChannelEphemeral()
+		}
+		in := nsq.Subscribe(interupt, strings.Split(*topics, ","))
+		log.S("topics", *topics).S("out", *out).Info("recording")
+		if err := record.Save(interupt, *out, in); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+	}
+}
+
+func replayToNsq(ctx context.Context, path string, speed float64) {
+	in, err := record.Replay(ctx, path, speed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nsq.NewPublisher(in).Wait()
+}
+
+// replayToBroker serves recording to the websocket clients.
+// Broker keeps state of the topics after the end of recording, until interrupted.
+func replayToBroker(ctx context.Context, path string, speed float64, port int) {
+	in, err := record.Replay(ctx, path, speed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	msgs := make(chan *amp.Msg)
+	go func() {
+		defer close(msgs)
+		for m := range in {
+			msgs <- m
+		}
+		log.S("path", path).Info("replay finished")
+		<-ctx.Done()
+	}()
+	requester := local.NewRequester(ctx)
+	b := broker.New(requester.Current, nil)
+	b.Consume(msgs)
+	sessions := session.Factory(ctx, b, requester, nil)
+	defer sessions.Wait()
+	ws.Listen(ctx, ws.MustOpen(port), func(c *ws.Conn) { sessions.Serve(c) })
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"os"
 	"time"
 
+	"github.com/minus5/svckit/amp/admin"
 	"github.com/minus5/svckit/amp/broker"
 	"github.com/minus5/svckit/amp/nsq"
 	"github.com/minus5/svckit/amp/session"
@@ -43,16 +45,17 @@ func main() {
 	sessions := session.Factory(interupt, broker, requester, inputTopics)
 	defer sessions.Wait()
 
-	go debugHTTP()
+	go debugHTTP(broker, sessions)
 	go appHTTPServer(interupt, appPortLabel, appRoot, sessions)
 	go stats(interupt, sessions)
 	ws.Listen(interupt, tcpListener, func(c *ws.Conn) { sessions.Serve(c) })
 }
 
-func debugHTTP() {
+func debugHTTP(b *broker.Broker, s *session.Sessions) {
 	health.Set(func() (health.Status, []byte) {
 		return health.Passing, []byte("OK")
 	})
+	admin.Mount(httpi.Subrouter("/amp"), b, s, admin.Token(os.Getenv("AMP_ADMIN_TOKEN")))
 	httpi.Start(env.Address(debugPortLabel))
 }
 
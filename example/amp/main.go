@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/amp/broker"
+	"github.com/minus5/svckit/amp/local"
 	"github.com/minus5/svckit/amp/nsq"
 	"github.com/minus5/svckit/amp/ws"
 	"github.com/minus5/svckit/env"
@@ -28,15 +33,36 @@ var (
 	appPortLabel     = "app"
 )
 
+type requester interface {
+	Send(amp.Subscriber, *amp.Msg)
+	Cancel(amp.Subscriber, *amp.Msg)
+	Unsubscribe(amp.Subscriber)
+	Current(string)
+	Wait()
+}
+
 func main() {
+	inProcess := flag.Bool("local", false, "run without nsq, with in-process math backend")
+	flag.Parse()
+
 	log.Debug("starting")
 	defer log.Debug("stopped")
 
 	tcpListener := ws.MustOpen(env.Port(wsPortLabel))
 	interupt := signal.InteruptContext()
-	requester := nsq.MustRequester(interupt)
+	var requester requester
+	var in <-chan *amp.Msg
+	if *inProcess {
+		lr := local.NewRequester(interupt)
+		lr.Handle("math.req", mathAdd)
+		requester = lr
+		in = local.NewPublisher(interupt).Messages()
+	} else {
+		requester = nsq.MustRequester(interupt)
+		in = nsq.Subscribe(interupt, inputTopics)
+	}
 	broker := broker.New(requester.Current, nil)
-	broker.Consume(nsq.Subscribe(interupt, inputTopics))
+	broker.Consume(in)
 	sessions := session.Factory(interupt, broker, requester, inputTopics)
 	defer sessions.Wait()
 
@@ -46,6 +72,21 @@ func main() {
 	ws.Listen(interupt, tcpListener, func(c *ws.Conn) { sessions.Serve(c) })
 }
 
+// mathAdd is in-process replacement for the add method of the math service.
+func mathAdd(ctx context.Context, m *amp.Msg) (*amp.Msg, error) {
+	if m.Path() != "add" {
+		return nil, fmt.Errorf("unknown method %s", m.Path())
+	}
+	var p struct {
+		X int64 `json:"x,omitempty"`
+		Y int64 `json:"y,omitempty"`
+	}
+	if err := m.Unmarshal(&p); err != nil {
+		return nil, err
+	}
+	return m.Response(map[string]int64{"z": p.X + p.Y}), nil
+}
+
 func poolingHTTP(interupt context.Context, sessions *session.Sessions) {
 	srv := &http.Server{Addr: env.Address(poolingPortLabel), Handler: &restServer{sessions: sessions}}
 	go func() {
@@ -88,7 +129,7 @@ func (s *restServer) pool(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rsp := s.sessions.Pool(m)
+	rsp := s.sessions.PoolWithCredentials(m, poolCredentials(r))
 	for i, r := range rsp {
 		w.Write(r.Marshal())
 		if i < len(rsp)-1 {
@@ -97,6 +138,23 @@ func (s *restServer) pool(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// poolCredentials are used by sessions authorizer.
+func poolCredentials(r *http.Request) session.Credentials {
+	headers := make(map[string]string)
+	for k := range r.Header {
+		headers[strings.ToLower(k)] = r.Header.Get(k)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return session.Credentials{
+		Headers:  headers,
+		Cookie:   r.Header.Get("Cookie"),
+		RemoteIP: ip,
+	}
+}
+
 func debugHTTP() {
 	health.Set(func() (health.Status, []byte) {
 		return health.Passing, []byte("OK")
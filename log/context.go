@@ -0,0 +1,40 @@
+package log
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	ctxHooks     []func(context.Context, *Agregator)
+	ctxHooksLock sync.RWMutex
+)
+
+// AddContextHook registers function which adds attributes from the context
+// to the log line. Used by packages which keep values in context (trace).
+func AddContextHook(fn func(context.Context, *Agregator)) {
+	ctxHooksLock.Lock()
+	defer ctxHooksLock.Unlock()
+	ctxHooks = append(ctxHooks, fn)
+}
+
+// Ctx creates log line with attributes from the context.
+// Example:
+//
+//	log.Ctx(ctx).S("topic", topic).Info("request")
+func Ctx(ctx context.Context) *Agregator {
+	return newAgregator(3).Ctx(ctx)
+}
+
+// Ctx adds attributes from the context.
+func (a *Agregator) Ctx(ctx context.Context) *Agregator {
+	if ctx == nil {
+		return a
+	}
+	ctxHooksLock.RLock()
+	defer ctxHooksLock.RUnlock()
+	for _, fn := range ctxHooks {
+		fn(ctx, a)
+	}
+	return a
+}
@@ -17,7 +17,10 @@ type Consumer struct {
 }
 
 type nsqHandler struct {
-	fn func(*Message) error
+	fn      Handler
+	topic   string
+	channel string
+	dlq     *deadLetters
 }
 
 func (h *nsqHandler) HandleMessage(m *gonsq.Message) error {
@@ -25,7 +28,31 @@ func (h *nsqHandler) HandleMessage(m *gonsq.Message) error {
 	stop := every(DefaultMsgTouchInterval, m.Touch)
 	defer close(stop)
 	// zovi handler
-	return h.fn(newMessage(m))
+	msg := newMessage(m)
+	msg.Topic = h.topic
+	msg.Channel = h.channel
+	msg.dlq = h.dlq
+	if err := h.fn(msg); err != nil {
+		if msg.Failed(err) {
+			msg.done(false)
+			return nil
+		}
+		if msg.requeueDelay > 0 && !msg.requeued {
+			msg.RequeueWithoutBackoff(msg.requeueDelay)
+			msg.done(true)
+			return nil
+		}
+		if !msg.requeued {
+			// go-nsq requeues message on error
+			msg.done(true)
+		}
+		return err
+	}
+	if !msg.requeued {
+		h.dlq.forget(msg.ID)
+	}
+	msg.done(msg.requeued)
+	return nil
 }
 
 func MustNewConsumer(topic string, handler func(*Message) error,
@@ -49,6 +76,10 @@ func NewConsumer(topic string, handler func(*Message) error,
 	cfg.LookupdPollInterval = 10 * time.Second
 	cfg.OutputBufferSize = -1
 	cfg.OutputBufferTimeout = -1
+	if o.maxAttempts > 0 {
+		// poruke nakon max attempts idu na dlq, ne odbacuje ih go-nsq
+		cfg.MaxAttempts = 0
+	}
 
 	c, err := gonsq.NewConsumer(topic, o.channel, cfg)
 	if err != nil {
@@ -56,7 +87,12 @@ func NewConsumer(topic string, handler func(*Message) error,
 	}
 
 	c.SetLogger(o.logger, o.logLevel)
-	c.AddConcurrentHandlers(&nsqHandler{fn: handler}, o.concurrency)
+	c.AddConcurrentHandlers(&nsqHandler{
+		fn:      chain(handler, o.middlewares),
+		topic:   topic,
+		channel: o.channel,
+		dlq:     newDeadLetters(topic, o.channel, o.maxAttempts),
+	}, o.concurrency)
 
 	err = c.ConnectToNSQLookupds(o.lookupds.String())
 	if err != nil {
@@ -0,0 +1,229 @@
+package nsq
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+	"github.com/pkg/errors"
+
+	gonsq "github.com/nsqio/go-nsq"
+)
+
+// Headers of the dead letter envelope.
+const (
+	DlqTopicHeader    = "dlq-topic"    // original topic
+	DlqChannelHeader  = "dlq-channel"  // channel on which message failed
+	DlqErrorHeader    = "dlq-error"    // error of the last attempt
+	DlqAttemptsHeader = "dlq-attempts" // number of attempts
+	DlqHistoryHeader  = "dlq-history"  // json list of attempts seen by the consumer
+)
+
+// how long failed attempts are remembered
+var attemptsTTL = time.Hour
+
+// DlqTopic returns name of the dead letter topic for the topic.
+func DlqTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// Attempt is one failed processing of the message.
+type Attempt struct {
+	Ts    int64  `json:"ts"` // unix time
+	Error string `json:"error"`
+	Nsqd  string `json:"nsqd,omitempty"`
+}
+
+type attempts struct {
+	first time.Time
+	list  []Attempt
+}
+
+type publisher interface {
+	Publish(msg []byte) error
+	Close()
+}
+
+type topicPublisher interface {
+	PublishTo(topic string, msg []byte) error
+}
+
+// deadLetters moves messages which failed maxAttempts times to the dead letter topic.
+// Counts published dead letters (nsq.<topic>.dlq) and failed publishing
+// (nsq.<topic>.dlq.error). Message which can't be published to the dead
+// letter topic is requeued and publish is retried on the next attempt.
+type deadLetters struct {
+	topic       string
+	channel     string
+	maxAttempts uint16
+	pub         publisher
+	attempts    map[gonsq.MessageID]*attempts
+	swept       time.Time
+	sync.Mutex
+}
+
+func newDeadLetters(topic, channel string, maxAttempts uint16) *deadLetters {
+	if maxAttempts == 0 {
+		return nil
+	}
+	return &deadLetters{
+		topic:       topic,
+		channel:     channel,
+		maxAttempts: maxAttempts,
+		attempts:    make(map[gonsq.MessageID]*attempts),
+		swept:       time.Now(),
+	}
+}
+
+// failed records failed attempt.
+// Returns true if message is published to the dead letter topic.
+func (d *deadLetters) failed(m *Message, err error) bool {
+	if d == nil {
+		return false
+	}
+	history := d.record(m, err)
+	if m.Attempts < d.maxAttempts {
+		return false
+	}
+	if perr := d.publish(m, err, history); perr != nil {
+		metric.Counter("nsq." + d.topic + ".dlq.error")
+		logger().S("topic", d.topic).I("attempts", int(m.Attempts)).Error(perr)
+		return false
+	}
+	metric.Counter("nsq." + d.topic + ".dlq")
+	d.forget(m.ID)
+	logger().S("topic", d.topic).S("channel", d.channel).I("attempts", int(m.Attempts)).S("error", err.Error()).Info("dead letter")
+	return true
+}
+
+func (d *deadLetters) record(m *Message, err error) []Attempt {
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	if now.Sub(d.swept) > time.Minute {
+		for id, a := range d.attempts {
+			if now.Sub(a.first) > attemptsTTL {
+				delete(d.attempts, id)
+			}
+		}
+		d.swept = now
+	}
+	a, ok := d.attempts[m.ID]
+	if !ok {
+		a = &attempts{first: now}
+		d.attempts[m.ID] = a
+	}
+	a.list = append(a.list, Attempt{Ts: now.Unix(), Error: err.Error(), Nsqd: m.NSQDAddress})
+	return append([]Attempt(nil), a.list...)
+}
+
+// forget removes history of the message.
+func (d *deadLetters) forget(id gonsq.MessageID) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	delete(d.attempts, id)
+}
+
+func (d *deadLetters) publish(m *Message, err error, history []Attempt) error {
+	e := &Envelope{Headers: make(map[string]string), Body: m.Body}
+	if orig, perr := NewEnvelope(m.Body); perr == nil {
+		e.Type = orig.Type
+		e.CorrelationId = orig.CorrelationId
+		for k, v := range orig.Headers {
+			e.Headers[k] = v
+		}
+	}
+	buf, _ := json.Marshal(history)
+	e.Headers[DlqTopicHeader] = d.topic
+	e.Headers[DlqChannelHeader] = d.channel
+	e.Headers[DlqErrorHeader] = err.Error()
+	e.Headers[DlqAttemptsHeader] = strconv.Itoa(int(m.Attempts))
+	e.Headers[DlqHistoryHeader] = string(buf)
+	return d.producer().Publish(e.Bytes())
+}
+
+func (d *deadLetters) producer() publisher {
+	d.Lock()
+	defer d.Unlock()
+	if d.pub == nil {
+		d.pub = Pub(DlqTopic(d.topic))
+	}
+	return d.pub
+}
+
+// DeadLetter is message from the dead letter topic.
+type DeadLetter struct {
+	Topic    string    // original topic
+	Channel  string    // channel on which message failed
+	Error    string    // error of the last attempt
+	Attempts int       // number of attempts
+	History  []Attempt // failed attempts seen by the consumer
+	// original message, body of the dead letter envelope
+	Body []byte
+	// dead letter envelope, with headers of the original envelope
+	Envelope *Envelope
+}
+
+// ParseDeadLetter decodes message from the dead letter topic.
+func ParseDeadLetter(buf []byte) (*DeadLetter, error) {
+	e, err := NewEnvelope(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d := &DeadLetter{
+		Topic:    e.Headers[DlqTopicHeader],
+		Channel:  e.Headers[DlqChannelHeader],
+		Error:    e.Headers[DlqErrorHeader],
+		Body:     e.Body,
+		Envelope: e,
+	}
+	if d.Topic == "" {
+		return nil, errors.Errorf("not a dead letter, missing %s header", DlqTopicHeader)
+	}
+	d.Attempts, _ = strconv.Atoi(e.Headers[DlqAttemptsHeader])
+	if h := e.Headers[DlqHistoryHeader]; h != "" {
+		if err := json.Unmarshal([]byte(h), &d.History); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return d, nil
+}
+
+// Original decodes original message envelope.
+func (d *DeadLetter) Original() (*Envelope, error) {
+	return NewEnvelope(d.Body)
+}
+
+// Redrive publishes original message back to the original topic.
+// p is usually *Producer.
+func (d *DeadLetter) Redrive(p topicPublisher) error {
+	return p.PublishTo(d.Topic, d.Body)
+}
+
+// DlqSub subscribes to the dead letter topic of the topic.
+// Dead letter is requeued if handler returns error.
+func DlqSub(topic string, handler func(*DeadLetter) error, opts ...func(*options)) *Consumer {
+	h := func(m *Message) error {
+		d, err := ParseDeadLetter(m.Body)
+		if err != nil {
+			logger().S("topic", DlqTopic(topic)).Error(err)
+			return nil
+		}
+		return handler(d)
+	}
+	return Sub(DlqTopic(topic), h, opts...)
+}
+
+// Redrive moves all messages from the dead letter topic back to the
+// original topic. Close returned consumer to stop.
+func Redrive(topic string, opts ...func(*options)) *Consumer {
+	p := Pub(topic)
+	return DlqSub(topic, func(d *DeadLetter) error {
+		return d.Redrive(p)
+	}, opts...)
+}
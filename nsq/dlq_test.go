@@ -0,0 +1,125 @@
+package nsq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/minus5/svckit/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingMetric struct {
+	*metric.Noop
+	counters map[string]int
+	sync.Mutex
+}
+
+func (m *countingMetric) Counter(name string, values ...int) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[name]++
+}
+
+func (m *countingMetric) count(name string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[name]
+}
+
+func setCountingMetric() *countingMetric {
+	m := &countingMetric{Noop: metric.NewNoop(), counters: make(map[string]int)}
+	metric.Set(m)
+	return m
+}
+
+type mockPublisher struct {
+	err  error
+	msgs [][]byte
+	to   []string
+}
+
+func (p *mockPublisher) Publish(msg []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *mockPublisher) Close() {}
+
+func (p *mockPublisher) PublishTo(topic string, msg []byte) error {
+	p.to = append(p.to, topic)
+	return p.Publish(msg)
+}
+
+func TestDeadLetters(t *testing.T) {
+	mc := setCountingMetric()
+	pub := &mockPublisher{}
+	d := newDeadLetters("orders", "app", 3)
+	d.pub = pub
+	orig := &Envelope{Type: "order", CorrelationId: "7", Headers: map[string]string{"h": "v"}, Body: []byte(`{"id":1}`)}
+	m := &Message{ID: [16]byte{1}, Body: orig.Bytes(), NSQDAddress: "nsqd:4150"}
+
+	for i := uint16(1); i < 3; i++ {
+		m.Attempts = i
+		assert.False(t, d.failed(m, errors.New("failed")))
+	}
+	assert.Len(t, pub.msgs, 0)
+
+	// publish to dlq fails, message stays requeued with history
+	pub.err = errors.New("nsqd down")
+	m.Attempts = 3
+	assert.False(t, d.failed(m, errors.New("failed")))
+	assert.Equal(t, 1, mc.count("nsq.orders.dlq.error"))
+
+	pub.err = nil
+	m.Attempts = 4
+	assert.True(t, d.failed(m, errors.New("last")))
+	assert.Equal(t, 1, mc.count("nsq.orders.dlq"))
+	assert.Len(t, d.attempts, 0)
+	require.Len(t, pub.msgs, 1)
+
+	dl, err := ParseDeadLetter(pub.msgs[0])
+	require.NoError(t, err)
+	assert.Equal(t, "orders", dl.Topic)
+	assert.Equal(t, "app", dl.Channel)
+	assert.Equal(t, "last", dl.Error)
+	assert.Equal(t, 4, dl.Attempts)
+	require.Len(t, dl.History, 4)
+	assert.Equal(t, "nsqd:4150", dl.History[0].Nsqd)
+	assert.Equal(t, "last", dl.History[3].Error)
+	assert.Equal(t, "order", dl.Envelope.Type)
+	assert.Equal(t, "v", dl.Envelope.Headers["h"])
+
+	o, err := dl.Original()
+	require.NoError(t, err)
+	assert.Equal(t, orig.Body, o.Body)
+	assert.Equal(t, orig.CorrelationId, o.CorrelationId)
+
+	rp := &mockPublisher{}
+	require.NoError(t, dl.Redrive(rp))
+	assert.Equal(t, []string{"orders"}, rp.to)
+	assert.Equal(t, m.Body, rp.msgs[0])
+}
+
+func TestDeadLettersDisabled(t *testing.T) {
+	d := newDeadLetters("orders", "app", 0)
+	assert.Nil(t, d)
+	assert.False(t, d.failed(&Message{Attempts: 100}, errors.New("failed")))
+	d.forget([16]byte{1})
+}
+
+func TestParseDeadLetter(t *testing.T) {
+	_, err := ParseDeadLetter([]byte("not an envelope"))
+	assert.Error(t, err)
+	e := &Envelope{Headers: map[string]string{}, Body: []byte("x")}
+	_, err = ParseDeadLetter(e.Bytes())
+	assert.Error(t, err) // missing topic header
+	e.Headers[DlqTopicHeader] = "orders"
+	e.Headers[DlqHistoryHeader] = "not json"
+	_, err = ParseDeadLetter(e.Bytes())
+	assert.Error(t, err)
+}
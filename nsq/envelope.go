@@ -20,8 +20,12 @@ type Envelope struct {
 	// connection between request and response
 	CorrelationId string `json:"c,omitempty"`
 	// unix timestamp when message expires, after that should be dropped
-	ExpiresAt int64  `json:"e,omitempty"`
-	Error     string `json:"error,omitempty"`
+	ExpiresAt int64 `json:"e,omitempty"`
+	// expiration in unix milliseconds, ExpiresAt is kept for older consumers
+	ExpiresAtMs int64  `json:"em,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// additional headers (trace context...)
+	Headers map[string]string `json:"h,omitempty"`
 	// message body
 	Body []byte `json:"-"`
 }
@@ -60,6 +64,7 @@ func (m *Envelope) Reply(o interface{}, err error) (*Envelope, error) {
 	e := &Envelope{
 		Type:          strings.Replace(m.Type, ".req", ".rsp", 1),
 		CorrelationId: m.CorrelationId,
+		Headers:       m.Headers,
 	}
 	if err != nil {
 		e.Error = err.Error()
@@ -80,8 +85,34 @@ func (m *Envelope) Reply(o interface{}, err error) (*Envelope, error) {
 
 // Expired returns true if message expired.
 func (m *Envelope) Expired() bool {
+	if m.ExpiresAtMs > 0 {
+		return time.Now().After(m.msDeadline())
+	}
 	if m.ExpiresAt <= 0 {
 		return false
 	}
 	return time.Now().Unix() > m.ExpiresAt
 }
+
+// SetDeadline sets message expiration.
+func (m *Envelope) SetDeadline(t time.Time) {
+	m.ExpiresAt = t.Unix()
+	m.ExpiresAtMs = t.UnixNano() / int64(time.Millisecond)
+}
+
+// Deadline returns time after which message is expired.
+// Without ExpiresAtMs (older producers) deadline is the start of the
+// ExpiresAt second, so it is never after the producer's deadline.
+func (m *Envelope) Deadline() (time.Time, bool) {
+	if m.ExpiresAtMs > 0 {
+		return m.msDeadline(), true
+	}
+	if m.ExpiresAt <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(m.ExpiresAt, 0), true
+}
+
+func (m *Envelope) msDeadline() time.Time {
+	return time.Unix(0, m.ExpiresAtMs*int64(time.Millisecond))
+}
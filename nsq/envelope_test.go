@@ -0,0 +1,36 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeDeadline(t *testing.T) {
+	e := &Envelope{}
+	_, ok := e.Deadline()
+	assert.False(t, ok)
+	assert.False(t, e.Expired())
+
+	d := time.Now().Add(1500 * time.Millisecond).Truncate(time.Millisecond)
+	e.SetDeadline(d)
+	assert.Equal(t, d.Unix(), e.ExpiresAt)
+	e, err := NewEnvelope(e.Bytes())
+	require.NoError(t, err)
+	dl, ok := e.Deadline()
+	require.True(t, ok)
+	assert.True(t, dl.Equal(d), dl)
+	assert.False(t, e.Expired())
+
+	e.SetDeadline(time.Now().Add(-time.Millisecond))
+	assert.True(t, e.Expired())
+
+	// older producer, seconds only
+	e = &Envelope{ExpiresAt: d.Unix()}
+	dl, ok = e.Deadline()
+	require.True(t, ok)
+	assert.Equal(t, time.Unix(d.Unix(), 0), dl)
+	assert.False(t, dl.After(d))
+}
@@ -14,6 +14,14 @@ type Message struct {
 	Timestamp   int64
 	Attempts    uint16
 	NSQDAddress string
+	Topic       string
+	Channel     string
+
+	dlq          *deadLetters
+	requeued     bool
+	requeueDelay time.Duration              // set by Backoff middleware
+	backoff      func(uint16) time.Duration // set by Backoff middleware, used by RrSub
+	onDone       []func(requeued bool)      // called when consumer decides on requeue
 }
 
 func newMessage(m *gonsq.Message) *Message {
@@ -28,9 +36,38 @@ func newMessage(m *gonsq.Message) *Message {
 }
 
 func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
+	m.requeued = true
 	m.nsqm.RequeueWithoutBackoff(delay)
 }
 
+// Requeued returns true if message is requeued by the handler.
+func (m *Message) Requeued() bool {
+	return m.requeued
+}
+
 func (m *Message) Touch() {
 	m.nsqm.Touch()
 }
+
+// retryDelay returns delay for requeue of the failed message,
+// by Backoff middleware or d.
+func (m *Message) retryDelay(d time.Duration) time.Duration {
+	if m.backoff != nil {
+		return m.backoff(m.Attempts)
+	}
+	return d
+}
+
+// done reports whether message is requeued after handling.
+func (m *Message) done(requeued bool) {
+	for _, fn := range m.onDone {
+		fn(requeued)
+	}
+}
+
+// Failed records failed attempt.
+// Returns true if max attempts are reached and message is published to the
+// dead letter topic, false if message should be requeued.
+func (m *Message) Failed(err error) bool {
+	return m.dlq.failed(m, err)
+}
@@ -0,0 +1,111 @@
+package nsq
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// Handler handles consumed message.
+type Handler func(*Message) error
+
+// Middleware wraps handler with additional behavior.
+// Set with Middlewares consumer option or RrMiddlewares for RrSub.
+type Middleware func(Handler) Handler
+
+// chain wraps h with middlewares, first middleware is outermost.
+func chain(h Handler, mws []Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Metrics measures handler duration (nsq.<topic>.duration) and counts
+// returned errors (nsq.<topic>.error) and requeued messages (nsq.<topic>.requeue).
+// Requeue is counted when consumer decides on it, also for messages which
+// go-nsq requeues on returned error.
+func Metrics() Middleware {
+	return func(next Handler) Handler {
+		return func(m *Message) error {
+			prefix := "nsq." + m.Topic
+			m.onDone = append(m.onDone, func(requeued bool) {
+				if requeued {
+					metric.Counter(prefix + ".requeue")
+				}
+			})
+			start := time.Now()
+			err := next(m)
+			metric.Time(prefix+".duration", int(time.Since(start).Nanoseconds()))
+			if err != nil {
+				metric.Counter(prefix + ".error")
+			}
+			return err
+		}
+	}
+}
+
+// Recover converts handler panic into error, so message is requeued
+// instead of crashing the process.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(m *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+					logger().S("topic", m.Topic).S("stack", string(debug.Stack())).Error(err)
+				}
+			}()
+			return next(m)
+		}
+	}
+}
+
+// Logging logs handler errors with topic, channel and attempts.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(m *Message) error {
+			err := next(m)
+			if err != nil {
+				logger().S("topic", m.Topic).
+					S("channel", m.Channel).
+					I("attempts", int(m.Attempts)).
+					S("id", string(m.ID[:])).
+					Error(err)
+			}
+			return err
+		}
+	}
+}
+
+// Backoff requeues failed message with delay which doubles with each
+// attempt: base, 2*base, 4*base... up to max.
+// Unlike go-nsq backoff it doesn't pause the whole consumer.
+// RrSub uses it instead of RequeueDelay.
+func Backoff(base, max time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(m *Message) error {
+			m.backoff = func(attempts uint16) time.Duration {
+				return backoffDelay(base, max, attempts)
+			}
+			err := next(m)
+			if err != nil && !m.Requeued() {
+				m.requeueDelay = backoffDelay(base, max, m.Attempts)
+			}
+			return err
+		}
+	}
+}
+
+func backoffDelay(base, max time.Duration, attempts uint16) time.Duration {
+	d := base
+	for i := uint16(1); i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
@@ -0,0 +1,127 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gonsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDelegate struct {
+	requeues []time.Duration
+	finished int
+}
+
+func (d *mockDelegate) OnFinish(*gonsq.Message) { d.finished++ }
+func (d *mockDelegate) OnTouch(*gonsq.Message)  {}
+func (d *mockDelegate) OnRequeue(_ *gonsq.Message, delay time.Duration, _ bool) {
+	d.requeues = append(d.requeues, delay)
+}
+
+func testNsqMessage(body []byte, attempts uint16) (*gonsq.Message, *mockDelegate) {
+	d := &mockDelegate{}
+	m := gonsq.NewMessage(gonsq.MessageID{1}, body)
+	m.Attempts = attempts
+	m.Delegate = d
+	return m, d
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(m *Message) error {
+				calls = append(calls, name+" before")
+				err := next(m)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	h := chain(func(*Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}, []Middleware{mw("a"), mw("b")})
+	require.NoError(t, h(&Message{}))
+	assert.Equal(t, []string{"a before", "b before", "handler", "b after", "a after"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover()(func(*Message) error {
+		panic("boom")
+	})
+	assert.EqualError(t, h(&Message{Topic: "t"}), "panic: boom")
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	cases := map[uint16]time.Duration{
+		0:   time.Second,
+		1:   time.Second,
+		2:   2 * time.Second,
+		3:   4 * time.Second,
+		4:   8 * time.Second,
+		5:   max,
+		100: max,
+	}
+	for attempts, d := range cases {
+		assert.Equal(t, d, backoffDelay(base, max, attempts), attempts)
+	}
+}
+
+func TestMetricsRequeue(t *testing.T) {
+	mc := setCountingMetric()
+	var err error
+	h := &nsqHandler{
+		fn:    chain(func(*Message) error { return err }, []Middleware{Metrics()}),
+		topic: "orders",
+	}
+
+	m, d := testNsqMessage(nil, 1)
+	require.NoError(t, h.HandleMessage(m))
+	assert.Equal(t, 0, mc.count("nsq.orders.requeue"))
+
+	// requeued by go-nsq
+	err = errors.New("failed")
+	assert.Error(t, h.HandleMessage(m))
+	assert.Equal(t, 1, mc.count("nsq.orders.error"))
+	assert.Equal(t, 1, mc.count("nsq.orders.requeue"))
+
+	// requeued with backoff delay
+	h.fn = chain(func(*Message) error { return err }, []Middleware{Metrics(), Backoff(time.Second, time.Minute)})
+	m, d = testNsqMessage(nil, 3)
+	require.NoError(t, h.HandleMessage(m))
+	assert.Equal(t, []time.Duration{4 * time.Second}, d.requeues)
+	assert.Equal(t, 2, mc.count("nsq.orders.requeue"))
+
+	// moved to dead letter topic
+	h.dlq = newDeadLetters("orders", "app", 3)
+	h.dlq.pub = &mockPublisher{}
+	m, _ = testNsqMessage(nil, 3)
+	require.NoError(t, h.HandleMessage(m))
+	assert.Equal(t, 2, mc.count("nsq.orders.requeue"))
+	assert.Equal(t, 1, mc.count("nsq.orders.dlq"))
+}
+
+func TestRrSubBackoff(t *testing.T) {
+	c := &RrConsumer{}
+	h := chain(c.handler(func(_ context.Context, _ string, _ []byte) (interface{}, error) {
+		return nil, errors.New("failed")
+	}), []Middleware{Backoff(time.Second, time.Minute)})
+
+	e := &Envelope{Type: "add", Body: []byte("{}")}
+	nm, d := testNsqMessage(e.Bytes(), 2)
+	require.NoError(t, h(newMessage(nm)))
+	assert.Equal(t, []time.Duration{2 * time.Second}, d.requeues)
+
+	// without Backoff RequeueDelay is used
+	nm, d = testNsqMessage(e.Bytes(), 2)
+	require.NoError(t, c.handler(func(_ context.Context, _ string, _ []byte) (interface{}, error) {
+		return nil, errors.New("failed")
+	})(newMessage(nm)))
+	assert.Equal(t, []time.Duration{RequeueDelay}, d.requeues)
+}
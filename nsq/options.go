@@ -57,6 +57,8 @@ type options struct {
 	logger      *nsqLogger
 	logLevel    gonsq.LogLevel
 	lookupds    dcy.Addresses
+	maxAttempts uint16
+	middlewares []Middleware
 }
 
 func (o *options) clone() *options {
@@ -110,6 +112,24 @@ func Ordered() func(*options) {
 	}
 }
 
+// MaxAttempts sets maximum number of attempts for the message.
+// Message which fails maxAttempts times is published to the dead letter
+// topic (see DlqTopic) with the error and attempt history in headers.
+func MaxAttempts(n uint16) func(*options) {
+	return func(o *options) {
+		o.maxAttempts = n
+	}
+}
+
+// Middlewares adds handler middlewares, first middleware is outermost.
+//
+//	nsq.Sub(topic, handler, nsq.Middlewares(nsq.Recover(), nsq.Metrics(), nsq.Logging()))
+func Middlewares(mws ...Middleware) func(*options) {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares[:len(o.middlewares):len(o.middlewares)], mws...)
+	}
+}
+
 // LogLevelDebug sets log level to Debug for underlying go-nsq package.
 func LogLevelDebug() func(*options) {
 	return func(o *options) {
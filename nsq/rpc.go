@@ -1,10 +1,14 @@
 package nsq
 
 import (
+	"context"
 	"errors"
 	"time"
 )
 
+// error which is never returned, disables requeue in RrSub
+var errNever = errors.New("newer")
+
 type RpcTransport struct {
 	pub   *RrProducer
 	topic string
@@ -31,6 +35,26 @@ func (t *RpcTransport) Call(typ string, req []byte) ([]byte, error) {
 	})
 }
 
+// CallContext sends request and waits for response until ctx is done.
+// Transport ttl is used if ctx has no deadline.
+func (t *RpcTransport) CallContext(ctx context.Context, typ string, req []byte) ([]byte, error) {
+	return t.pub.ReqRspBase(ReqRspBaseParams{
+		Topic: t.topic,
+		Ttl:   t.ttl,
+		Typ:   typ,
+		Req:   req,
+		Em:    t.em,
+		Ctx:   ctx,
+	})
+}
+
+func (t *RpcTransport) fatal(err error) error {
+	if t.em != nil && t.em.ErrFatal != nil {
+		return t.em.ErrFatal
+	}
+	return err
+}
+
 func (t *RpcTransport) Close() {
 	t.pub.Close()
 }
@@ -42,6 +66,17 @@ func RpcServe(topic string, h rpcHandler) *RrConsumer {
 		func(typ string, body []byte) (interface{}, error) {
 			return h(typ, body)
 		},
-		RequeueError(errors.New("newer")),
+		RequeueError(errNever),
+	)
+}
+
+// RpcServeContext is RpcServe with handler context,
+// canceled when request expires.
+func RpcServeContext(topic string, h func(ctx context.Context, typ string, body []byte) ([]byte, error)) *RrConsumer {
+	return RrSubContext(topic,
+		func(ctx context.Context, typ string, body []byte) (interface{}, error) {
+			return h(ctx, typ, body)
+		},
+		RequeueError(errNever),
 	)
 }
@@ -0,0 +1,98 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// RpcServer dispatches requests to typed handlers by method name (envelope type).
+// Request and response bodies are json, same as RrSub and RrProducer.ReqRsp,
+// so typed services and clients talk with the existing ones.
+//
+//	srv := nsq.NewRpcServer()
+//	nsq.RpcHandle(srv, "add", func(ctx context.Context, req AddReq) (AddRsp, error) {...})
+//	srv.Serve("math.req")
+type RpcServer struct {
+	handlers map[string]func(context.Context, []byte) (interface{}, error)
+	sync.RWMutex
+}
+
+// NewRpcServer creates server without handlers.
+func NewRpcServer() *RpcServer {
+	return &RpcServer{
+		handlers: make(map[string]func(context.Context, []byte) (interface{}, error)),
+	}
+}
+
+// RpcHandle registers typed handler for the method.
+func RpcHandle[Req, Rsp any](s *RpcServer, method string, h func(context.Context, Req) (Rsp, error)) {
+	s.Lock()
+	defer s.Unlock()
+	s.handlers[method] = func(ctx context.Context, body []byte) (interface{}, error) {
+		var req Req
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req); err != nil {
+				return nil, err
+			}
+		}
+		return h(ctx, req)
+	}
+}
+
+func (s *RpcServer) handle(ctx context.Context, method string, body []byte) (interface{}, error) {
+	s.RLock()
+	h, ok := s.handlers[method]
+	s.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	return h(ctx, body)
+}
+
+// Serve subscribes server to the topic.
+// Handler errors are replied to the client without requeue,
+// unless changed with RequeueError option.
+func (s *RpcServer) Serve(topic string, opts ...func(*RrConsumer)) *RrConsumer {
+	opts = append([]func(*RrConsumer){RequeueError(errNever)}, opts...)
+	return RrSubContext(topic, s.handle, opts...)
+}
+
+// RpcMethod is typed client stub for the method.
+type RpcMethod[Req, Rsp any] struct {
+	t      *RpcTransport
+	method string
+}
+
+// NewRpcMethod creates client stub for the method on transport topic.
+// Errors are mapped with transport ErrorsMapping.
+func NewRpcMethod[Req, Rsp any](t *RpcTransport, method string) *RpcMethod[Req, Rsp] {
+	return &RpcMethod[Req, Rsp]{t: t, method: method}
+}
+
+// Call sends request and waits for response until ctx is done
+// (or transport ttl if ctx has no deadline).
+func (m *RpcMethod[Req, Rsp]) Call(ctx context.Context, req Req) (Rsp, error) {
+	var rsp Rsp
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return rsp, m.t.fatal(err)
+	}
+	rspBuf, err := m.t.CallContext(ctx, m.method, buf)
+	if err != nil {
+		return rsp, err
+	}
+	if len(rspBuf) == 0 {
+		return rsp, nil
+	}
+	// Envelope.Reply puts []byte response into body without encoding
+	if raw, ok := any(&rsp).(*[]byte); ok {
+		*raw = rspBuf
+		return rsp, nil
+	}
+	if err := json.Unmarshal(rspBuf, &rsp); err != nil {
+		return rsp, m.t.fatal(err)
+	}
+	return rsp, nil
+}
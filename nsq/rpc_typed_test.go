@@ -0,0 +1,109 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type funcPublisher func([]byte) error
+
+func (p funcPublisher) Publish(msg []byte) error { return p(msg) }
+func (p funcPublisher) Close()                   {}
+
+// loopback connects RrProducer and RrConsumer handler without nsqd.
+func loopback(handler func(context.Context, string, []byte) (interface{}, error)) *RrProducer {
+	s, _ := testRrProducer()
+	c := &RrConsumer{
+		producers: map[string]publisher{
+			s.topic: funcPublisher(func(msg []byte) error {
+				return s.receive(&Message{Body: msg})
+			}),
+		},
+		requeueError: errNever,
+	}
+	h := c.handler(handler)
+	s.producers["math.req"] = funcPublisher(func(msg []byte) error {
+		go func() { _ = h(&Message{Body: msg}) }()
+		return nil
+	})
+	return s
+}
+
+type addReq struct {
+	X, Y int
+}
+
+type addRsp struct {
+	Sum int
+}
+
+var errOverflow = errors.New("overflow")
+
+func testRpcServer() *RpcServer {
+	srv := NewRpcServer()
+	RpcHandle(srv, "add", func(_ context.Context, req addReq) (addRsp, error) {
+		if req.X+req.Y > 100 {
+			return addRsp{}, errOverflow
+		}
+		return addRsp{Sum: req.X + req.Y}, nil
+	})
+	RpcHandle(srv, "raw", func(_ context.Context, req string) ([]byte, error) {
+		return []byte(req), nil
+	})
+	return srv
+}
+
+func TestRpcTyped(t *testing.T) {
+	em := &ErrorsMapping{Parser: func(s string) error {
+		if s == errOverflow.Error() {
+			return errOverflow
+		}
+		return defaultErrorParser(s)
+	}}
+	tr := &RpcTransport{pub: loopback(testRpcServer().handle), topic: "math.req", ttl: time.Second, em: em}
+	add := NewRpcMethod[addReq, addRsp](tr, "add")
+	ctx := context.Background()
+
+	rsp, err := add.Call(ctx, addReq{X: 1, Y: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, rsp.Sum)
+
+	_, err = add.Call(ctx, addReq{X: 100, Y: 2})
+	assert.Equal(t, errOverflow, err)
+
+	_, err = NewRpcMethod[addReq, addRsp](tr, "sub").Call(ctx, addReq{})
+	assert.EqualError(t, err, "unknown method sub")
+
+	// []byte response is passed without encoding
+	raw, err := NewRpcMethod[string, []byte](tr, "raw").Call(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc"), raw)
+}
+
+// typed client and server talk with RrSub and ReqRsp
+func TestRpcWireCompatibility(t *testing.T) {
+	ctx := context.Background()
+
+	// typed client, RrSub server
+	legacy := func(_ context.Context, typ string, body []byte) (interface{}, error) {
+		assert.Equal(t, "add", typ)
+		return map[string]int{"Sum": 42}, nil
+	}
+	tr := &RpcTransport{pub: loopback(legacy), topic: "math.req", ttl: time.Second}
+	rsp, err := NewRpcMethod[addReq, addRsp](tr, "add").Call(ctx, addReq{X: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 42, rsp.Sum)
+
+	// ReqRsp client, typed server
+	p := loopback(testRpcServer().handle)
+	var out addRsp
+	require.NoError(t, p.ReqRspContext(ctx, "math.req", "add", &addReq{X: 2, Y: 3}, &out, nil))
+	assert.Equal(t, 5, out.Sum)
+	require.NoError(t, p.ReqRsp("math.req", "add", &addReq{X: 4, Y: 3}, &out, nil, time.Second, nil))
+	assert.Equal(t, 7, out.Sum)
+}
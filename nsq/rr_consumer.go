@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/trace"
 )
 
 var (
@@ -22,7 +24,7 @@ var (
 type RrConsumer struct {
 	topic           string
 	sub             *Consumer
-	producers       map[string]*Producer
+	producers       map[string]publisher
 	consumerOptions []func(*options)
 	requeueError    error // set this error to requeue only on this
 	// if nil requeues on all errors
@@ -33,28 +35,55 @@ type RrConsumer struct {
 // topic   - nsq topic where reuqest arrive
 // handler - gets message type and body and creates response (or error)
 func RrSub(topic string, handler func(string, []byte) (interface{}, error), opts ...func(*RrConsumer)) *RrConsumer {
+	return RrSubContext(topic, func(_ context.Context, typ string, body []byte) (interface{}, error) {
+		return handler(typ, body)
+	}, opts...)
+}
+
+// RrSubContext creates RrConsumer with handler context.
+// Context carries trace context from the request and is canceled when request expires.
+func RrSubContext(topic string, handler func(context.Context, string, []byte) (interface{}, error), opts ...func(*RrConsumer)) *RrConsumer {
 	s := &RrConsumer{
 		topic:     topic,
-		producers: make(map[string]*Producer),
+		producers: make(map[string]publisher),
 	}
 	s.apply(opts...)
-	h := func(m *Message) error {
+	s.consumerOptions = append(s.consumerOptions, Channel(env.AppName()))
+	s.sub = Sub(topic, s.handler(handler), s.consumerOptions...)
+	return s
+}
+
+// handler replies to the request with the handler response.
+func (s *RrConsumer) handler(handler func(context.Context, string, []byte) (interface{}, error)) Handler {
+	return func(m *Message) error {
 		// zapakiraj poruku u envelope
 		eReq, err := NewEnvelope(m.Body)
 		if err != nil {
 			return err
 		}
+		ctx := trace.Continue(context.Background(), eReq.Headers)
 		// provjeri da li je expired
 		if eReq.Expired() {
-			log.S("type", eReq.Type).S("correlationId", eReq.CorrelationId).I("now", int(time.Now().Unix())).I("expires_at", int(eReq.ExpiresAt)).Info("expired")
+			log.Ctx(ctx).S("type", eReq.Type).S("correlationId", eReq.CorrelationId).I("now", int(time.Now().Unix())).I("expires_at", int(eReq.ExpiresAt)).Info("expired")
 			return nil
 		}
+		if deadline, ok := eReq.Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
 		// radi request
-		rsp, handlerErr := handler(eReq.Type, eReq.Body)
+		rsp, handlerErr := handler(ctx, eReq.Type, eReq.Body)
+		// istekao za vrijeme obrade, nitko ne ceka odgovor
+		if ctx.Err() != nil {
+			log.Ctx(ctx).S("type", eReq.Type).S("correlationId", eReq.CorrelationId).Info("expired while handling")
+			return nil
+		}
 		// ako je puklo vrati poruku u nsq
-		if handlerErr != nil && (s.requeueError == nil || handlerErr == s.requeueError) {
-			m.RequeueWithoutBackoff(RequeueDelay)
-			log.S("type", eReq.Type).S("correlationId", eReq.CorrelationId).Error(handlerErr)
+		// nakon max attempts poruka ide na dlq, a requestu se odgovara s greskom
+		if handlerErr != nil && (s.requeueError == nil || handlerErr == s.requeueError) && !m.Failed(handlerErr) {
+			m.RequeueWithoutBackoff(m.retryDelay(RequeueDelay))
+			log.Ctx(ctx).S("type", eReq.Type).S("correlationId", eReq.CorrelationId).Error(handlerErr)
 			return nil
 		}
 		// treba li odgovoriti
@@ -74,9 +103,6 @@ func RrSub(topic string, handler func(string, []byte) (interface{}, error), opts
 		}
 		return nil
 	}
-	s.consumerOptions = append(s.consumerOptions, Channel(env.AppName()))
-	s.sub = Sub(topic, h, s.consumerOptions...)
-	return s
 }
 
 // apply calls all functions to setup options
@@ -93,12 +119,21 @@ func RequeueError(err error) func(*RrConsumer) {
 }
 
 // ConsumerOptions sets configuration options for the underlying Consumer.
+// Use MaxAttempts to limit requeues and move failed requests to the dead letter topic.
 func ConsumerOptions(opts ...func(*options)) func(*RrConsumer) {
 	return func(s *RrConsumer) {
-		s.consumerOptions = opts
+		s.consumerOptions = append(s.consumerOptions, opts...)
 	}
 }
 
+// RrMiddlewares adds middlewares to the underlying Consumer handler.
+// Handler errors which are requeued by RrSub are not returned to middlewares,
+// use Message.Requeued to detect them. Backoff middleware sets requeue delay
+// of RrSub (instead of RequeueDelay).
+func RrMiddlewares(mws ...Middleware) func(*RrConsumer) {
+	return ConsumerOptions(Middlewares(mws...))
+}
+
 // RrAsyncSub creates RrConsumer in async mode
 // Hendler gets type, correlationId, and body.
 // It is users reposibility to call Pub with that correlationId and response.
@@ -121,7 +156,7 @@ func RrAsyncSub(topic string, handler func(string, string, []byte) error) *RrCon
 	return &RrConsumer{
 		topic:     topic,
 		sub:       Sub(topic, h),
-		producers: make(map[string]*Producer),
+		producers: make(map[string]publisher),
 	}
 }
 
@@ -145,7 +180,7 @@ func (s *RrConsumer) Pub(correlationId string, body []byte) error {
 	return nil
 }
 
-func (s *RrConsumer) pub(topic string) *Producer {
+func (s *RrConsumer) pub(topic string) publisher {
 	s.Lock()
 	defer s.Unlock()
 	if p, ok := s.producers[topic]; ok {
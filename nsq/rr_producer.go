@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/trace"
 )
 
 var (
@@ -27,7 +29,7 @@ var (
 // Implements request response communication over nsq.
 type RrProducer struct {
 	s         map[string]chan *Envelope
-	producers map[string]*Producer
+	producers map[string]publisher
 	topic     string
 	sub       *Consumer
 	msgNo     int
@@ -54,7 +56,7 @@ func RrPub(topic string, opts ...func(*RrProducer)) *RrProducer {
 	s := &RrProducer{
 		msgNo:     rand.Intn(math.MaxInt32),
 		s:         make(map[string]chan *Envelope),
-		producers: make(map[string]*Producer),
+		producers: make(map[string]publisher),
 		topic:     topic,
 	}
 	rrProducers[topic] = s
@@ -111,7 +113,7 @@ func (s *RrProducer) timeout(id string) {
 	}
 }
 
-func (s *RrProducer) pub(topic string) *Producer {
+func (s *RrProducer) pub(topic string) publisher {
 	s.Lock()
 	defer s.Unlock()
 	if p, ok := s.producers[topic]; ok {
@@ -148,15 +150,30 @@ type ErrorsMapping struct {
 // ttl   - time to live of message for envelope
 // em    - error mapping, mapping to application specific messages
 func (s *RrProducer) ReqRsp(topic, typ string, req interface{}, rsp interface{}, sig chan struct{}, ttl time.Duration, em *ErrorsMapping) error {
-	if typ == "" {
-		typ = typeToString(req)
-	}
-	p := ReqRspBaseParams{
+	return s.reqRsp(ReqRspBaseParams{
 		Topic: topic,
 		Typ:   typ,
 		Ttl:   ttl,
 		Sig:   sig,
 		Em:    em,
+	}, req, rsp)
+}
+
+// ReqRspContext sends request and waits for response until ctx is done.
+// Ctx deadline sets envelope expiration, without deadline DefaultTimeout is used.
+// Returns em.ErrTimeout when ctx deadline is exceeded, em.ErrStopped when ctx is canceled.
+func (s *RrProducer) ReqRspContext(ctx context.Context, topic, typ string, req interface{}, rsp interface{}, em *ErrorsMapping) error {
+	return s.reqRsp(ReqRspBaseParams{
+		Topic: topic,
+		Typ:   typ,
+		Em:    em,
+		Ctx:   ctx,
+	}, req, rsp)
+}
+
+func (s *RrProducer) reqRsp(p ReqRspBaseParams, req interface{}, rsp interface{}) error {
+	if p.Typ == "" {
+		p.Typ = typeToString(req)
 	}
 	p.defaults()
 	reqBuf, err := json.Marshal(req)
@@ -164,7 +181,7 @@ func (s *RrProducer) ReqRsp(topic, typ string, req interface{}, rsp interface{},
 		return p.Fatal(err)
 	}
 	p.Req = reqBuf
-	p.correlationId = s.corr.NewCorrelationID(topic, typ, req)
+	p.correlationId = s.corr.NewCorrelationID(p.Topic, p.Typ, req)
 	rspBuf, err := s.ReqRspBase(p)
 	if err != nil {
 		return err
@@ -179,15 +196,28 @@ func (s *RrProducer) ReqRsp(topic, typ string, req interface{}, rsp interface{},
 
 // ReqRspBuf sends request and waits for response, passes rsp as []byte
 func (s *RrProducer) ReqRspBuf(topic, typ string, req interface{}, sig chan struct{}, ttl time.Duration, em *ErrorsMapping) ([]byte, error) {
-	if typ == "" {
-		typ = typeToString(req)
-	}
-	p := ReqRspBaseParams{
+	return s.reqRspBuf(ReqRspBaseParams{
 		Topic: topic,
 		Typ:   typ,
 		Ttl:   ttl,
 		Sig:   sig,
 		Em:    em,
+	}, req)
+}
+
+// ReqRspBufContext sends request and waits for response until ctx is done, passes rsp as []byte
+func (s *RrProducer) ReqRspBufContext(ctx context.Context, topic, typ string, req interface{}, em *ErrorsMapping) ([]byte, error) {
+	return s.reqRspBuf(ReqRspBaseParams{
+		Topic: topic,
+		Typ:   typ,
+		Em:    em,
+		Ctx:   ctx,
+	}, req)
+}
+
+func (s *RrProducer) reqRspBuf(p ReqRspBaseParams, req interface{}) ([]byte, error) {
+	if p.Typ == "" {
+		p.Typ = typeToString(req)
 	}
 	p.defaults()
 	reqBuf, err := json.Marshal(req)
@@ -195,7 +225,7 @@ func (s *RrProducer) ReqRspBuf(topic, typ string, req interface{}, sig chan stru
 		return nil, p.Fatal(err)
 	}
 	p.Req = reqBuf
-	p.correlationId = s.corr.NewCorrelationID(topic, typ, req)
+	p.correlationId = s.corr.NewCorrelationID(p.Topic, p.Typ, req)
 	return s.ReqRspBase(p)
 }
 
@@ -206,13 +236,20 @@ type ReqRspBaseParams struct {
 	Ttl           time.Duration
 	Sig           chan struct{}
 	Em            *ErrorsMapping
+	Ctx           context.Context // trace context is propagated to the envelope headers, deadline shortens Ttl
 	correlationId string
 }
 
 func (p *ReqRspBaseParams) defaults() {
+	if p.Ctx == nil {
+		p.Ctx = context.Background()
+	}
 	if p.Ttl <= 0 {
 		p.Ttl = DefaultTimeout
 	}
+	if deadline, ok := p.Ctx.Deadline(); ok && time.Until(deadline) < p.Ttl {
+		p.Ttl = time.Until(deadline)
+	}
 	if p.Em == nil {
 		p.Em = &ErrorsMapping{
 			Parser:     defaultErrorParser,
@@ -243,6 +280,14 @@ func (p *ReqRspBaseParams) Stopped() error {
 	return ErrStopped
 }
 
+// Done maps ctx error.
+func (p *ReqRspBaseParams) Done() error {
+	if p.Ctx.Err() == context.DeadlineExceeded {
+		return p.Timeout()
+	}
+	return p.Stopped()
+}
+
 func (p *ReqRspBaseParams) Error(text string) error {
 	if p.Em.Parser != nil {
 		return p.Em.Parser(text)
@@ -255,14 +300,18 @@ func (s *RrProducer) ReqRspBase(p ReqRspBaseParams) ([]byte, error) {
 	if p.correlationId == "" {
 		p.correlationId = s.NewCorrelationID("", "", nil)
 	}
+	if p.Ctx.Err() != nil {
+		return nil, p.Done()
+	}
 
 	eReq := &Envelope{
 		Type:          p.Typ,
 		ReplyTo:       s.topic,
 		CorrelationId: p.correlationId,
 		Body:          p.Req,
-		ExpiresAt:     time.Now().Add(p.Ttl).Unix(),
+		Headers:       trace.Inject(p.Ctx, nil),
 	}
+	eReq.SetDeadline(time.Now().Add(p.Ttl))
 	c := make(chan *Envelope)
 	s.add(p.correlationId, c)
 
@@ -281,6 +330,9 @@ func (s *RrProducer) ReqRspBase(p ReqRspBaseParams) ([]byte, error) {
 	case <-p.Sig:
 		s.timeout(p.correlationId)
 		return nil, p.Stopped()
+	case <-p.Ctx.Done():
+		s.timeout(p.correlationId)
+		return nil, p.Done()
 	}
 	return nil, nil
 }
@@ -314,24 +366,26 @@ func (s *RrProducer) Pub(topic, typ string, req interface{}) error {
 }
 
 func (s *RrProducer) listen() {
-	handler := func(m *Message) error {
-		e, err := NewEnvelope(m.Body)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-		if s, found := s.get(e.CorrelationId); found {
-			// when s == nil, means that request timed out, nobody is waiting for response
-			// nothing to do in that case
-			if s != nil {
-				s <- e
-			}
-			return nil
+	s.sub = Sub(s.topic, s.receive)
+}
+
+// receive passes response to the waiting request.
+func (s *RrProducer) receive(m *Message) error {
+	e, err := NewEnvelope(m.Body)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if c, found := s.get(e.CorrelationId); found {
+		// when c == nil, means that request timed out, nobody is waiting for response
+		// nothing to do in that case
+		if c != nil {
+			c <- e
 		}
-		log.S("id", e.CorrelationId).Info("subscriber not found")
 		return nil
 	}
-	s.sub = Sub(s.topic, handler)
+	log.S("id", e.CorrelationId).Info("subscriber not found")
+	return nil
 }
 
 // Close implements gracefully stop.
@@ -374,6 +428,19 @@ func (c *RrClient) Call(req, rsp interface{}) error {
 	)
 }
 
+// CallContext sends req and waits for rsp until ctx is done.
+// Client ttl is used if ctx has no deadline.
+func (c *RrClient) CallContext(ctx context.Context, req, rsp interface{}) error {
+	return c.pub.reqRsp(ReqRspBaseParams{
+		Topic: c.topic,
+		Typ:   c.nameFor(req),
+		Ttl:   c.ttl,
+		Sig:   c.sig,
+		Em:    c.em,
+		Ctx:   ctx,
+	}, req, rsp)
+}
+
 func (c *RrClient) Close() {
 	c.pub.Close()
 }
@@ -0,0 +1,99 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chanPublisher passes published requests to the test.
+type chanPublisher chan *Envelope
+
+func (p chanPublisher) Publish(msg []byte) error {
+	e, err := NewEnvelope(msg)
+	if err != nil {
+		return err
+	}
+	p <- e
+	return nil
+}
+
+func (p chanPublisher) Close() {}
+
+func testRrProducer() (*RrProducer, chanPublisher) {
+	reqs := make(chanPublisher, 1)
+	s := &RrProducer{
+		s:         make(map[string]chan *Envelope),
+		producers: map[string]publisher{"req": reqs},
+		topic:     "rsp",
+	}
+	s.corr = s
+	return s, reqs
+}
+
+// respond delivers response as listen does.
+func (s *RrProducer) respond(req *Envelope, body []byte) {
+	if c, ok := s.get(req.CorrelationId); ok && c != nil {
+		c <- &Envelope{CorrelationId: req.CorrelationId, Body: body}
+	}
+}
+
+func TestReqRspContext(t *testing.T) {
+	s, reqs := testRrProducer()
+	go func() {
+		req := <-reqs
+		assert.Equal(t, "rsp", req.ReplyTo)
+		assert.Equal(t, "add", req.Type)
+		s.respond(req, []byte(`3`))
+	}()
+	var rsp int
+	require.NoError(t, s.ReqRspContext(context.Background(), "req", "add", []int{1, 2}, &rsp, nil))
+	assert.Equal(t, 3, rsp)
+}
+
+func TestReqRspContextDeadline(t *testing.T) {
+	s, reqs := testRrProducer()
+	deadline := time.Now().Add(100 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	err := s.ReqRspContext(ctx, "req", "add", []int{1, 2}, nil, nil)
+	assert.Equal(t, ErrTimeout, err)
+
+	req := <-reqs
+	dl, ok := req.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, deadline, dl, 10*time.Millisecond)
+	assert.False(t, dl.After(deadline.Add(time.Millisecond)))
+	assert.Equal(t, dl.Unix(), req.ExpiresAt)
+
+	// late response is dropped
+	s.respond(req, []byte(`3`))
+}
+
+func TestReqRspContextCancel(t *testing.T) {
+	s, reqs := testRrProducer()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-reqs
+		cancel()
+	}()
+	err := s.ReqRspContext(ctx, "req", "add", []int{1, 2}, nil, nil)
+	assert.Equal(t, ErrStopped, err)
+
+	// already canceled, request is not sent
+	err = s.ReqRspContext(ctx, "req", "add", []int{1, 2}, nil, nil)
+	assert.Equal(t, ErrStopped, err)
+	assert.Len(t, reqs, 0)
+
+	// mapped errors
+	errStopped, errTimeout := assert.AnError, context.DeadlineExceeded
+	em := &ErrorsMapping{ErrStopped: errStopped, ErrTimeout: errTimeout}
+	assert.Equal(t, errStopped, s.ReqRspContext(ctx, "req", "add", 1, nil, em))
+	tctx, tcancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer tcancel()
+	<-tctx.Done()
+	assert.Equal(t, errTimeout, s.ReqRspContext(tctx, "req", "add", 1, nil, em))
+}
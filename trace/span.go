@@ -0,0 +1,113 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/log"
+)
+
+var (
+	recorder     Recorder = LogRecorder{}
+	recorderLock sync.RWMutex
+)
+
+// Span is timed operation in the trace.
+type Span struct {
+	Name     string
+	Context  Context
+	Start    time.Time
+	Duration time.Duration
+	Attrs    map[string]string
+	Err      error
+	sync.Mutex
+}
+
+// Recorder receives finished spans.
+type Recorder interface {
+	Record(*Span)
+}
+
+// SetRecorder replaces default recorder, nil disables recording.
+func SetRecorder(r Recorder) {
+	recorderLock.Lock()
+	defer recorderLock.Unlock()
+	recorder = r
+}
+
+// StartSpan creates child span of the trace in ctx (or starts new trace).
+// Returned context carries the new span.
+// Example:
+//
+//	ctx, span := trace.StartSpan(ctx, "db.query")
+//	defer span.End()
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	var c Context
+	if parent, ok := FromContext(ctx); ok {
+		c = parent.Child()
+	} else {
+		c = New()
+	}
+	s := &Span{
+		Name:    name,
+		Context: c,
+		Start:   time.Now(),
+	}
+	return NewContext(ctx, c), s
+}
+
+// SetAttr adds attribute to the span.
+func (s *Span) SetAttr(key, val string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	s.Attrs[key] = val
+}
+
+// SetError marks span as failed.
+func (s *Span) SetError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.Err = err
+}
+
+// End finishes span and passes it to the recorder.
+func (s *Span) End() {
+	s.Lock()
+	s.Duration = time.Since(s.Start)
+	s.Unlock()
+	if !s.Context.Sampled() {
+		return
+	}
+	recorderLock.RLock()
+	r := recorder
+	recorderLock.RUnlock()
+	if r != nil {
+		r.Record(s)
+	}
+}
+
+// LogRecorder writes one log line per span.
+// Path of the request can be reconstructed by traceId, spanId and parentId attributes.
+type LogRecorder struct{}
+
+// Record implements Recorder.
+func (LogRecorder) Record(s *Span) {
+	s.Lock()
+	defer s.Unlock()
+	a := log.S("traceId", s.Context.TraceID).
+		S("spanId", s.Context.SpanID).
+		S("parentId", s.Context.ParentID).
+		S("span", s.Name).
+		I("duration", int(s.Duration/time.Microsecond))
+	for k, v := range s.Attrs {
+		a.S(k, v)
+	}
+	if s.Err != nil {
+		a.S("error", s.Err.Error())
+	}
+	a.Info("span")
+}
@@ -0,0 +1,171 @@
+// Package trace propagates W3C traceparent style trace context between
+// services (amp sessions, nsq requests and responses).
+//
+// Trace context is carried in the message headers under the Header key:
+//
+//	traceparent: 00-<32 hex trace id>-<16 hex span id>-<2 hex flags>
+//
+// Inside of the service it is kept in context.Context. Log lines created
+// with log.Ctx(ctx) get traceId and spanId attributes.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/minus5/svckit/log"
+)
+
+const (
+	// Header is the name of the header (http, amp BackendHeaders, nsq Envelope Headers).
+	Header = "traceparent"
+
+	version     = "00"
+	flagSampled = 0x01
+)
+
+// Context identifies the trace and the current span in it.
+type Context struct {
+	TraceID  string // 32 hex
+	SpanID   string // 16 hex
+	ParentID string // span id of the parent, empty for root span
+	Flags    byte
+}
+
+type ctxKey struct{}
+
+func init() {
+	log.AddContextHook(func(ctx context.Context, a *log.Agregator) {
+		if tc, ok := FromContext(ctx); ok {
+			a.S("traceId", tc.TraceID).S("spanId", tc.SpanID)
+		}
+	})
+}
+
+// New starts new trace.
+func New() Context {
+	return Context{
+		TraceID: randomHex(16),
+		SpanID:  randomHex(8),
+		Flags:   flagSampled,
+	}
+}
+
+// Parse decodes traceparent header value.
+func Parse(s string) (Context, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 ||
+		len(parts[0]) != 2 || parts[0] == "ff" ||
+		!isHex(parts[1], 32) ||
+		!isHex(parts[2], 16) ||
+		!isHex(parts[3], 2) {
+		return Context{}, false
+	}
+	if parts[0] == version && len(parts) != 4 {
+		return Context{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	c := Context{
+		TraceID: strings.ToLower(parts[1]),
+		SpanID:  strings.ToLower(parts[2]),
+		Flags:   flags[0],
+	}
+	if !c.Valid() {
+		return Context{}, false
+	}
+	return c, true
+}
+
+// String encodes context as traceparent header value.
+func (c Context) String() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", version, c.TraceID, c.SpanID, c.Flags)
+}
+
+// Valid returns false for the zero or malformed context.
+func (c Context) Valid() bool {
+	return isHex(c.TraceID, 32) && c.TraceID != strings.Repeat("0", 32) &&
+		isHex(c.SpanID, 16) && c.SpanID != strings.Repeat("0", 16)
+}
+
+// Sampled flag is set.
+func (c Context) Sampled() bool {
+	return c.Flags&flagSampled != 0
+}
+
+// Child creates context for the new span in the same trace.
+func (c Context) Child() Context {
+	return Context{
+		TraceID:  c.TraceID,
+		SpanID:   randomHex(8),
+		ParentID: c.SpanID,
+		Flags:    c.Flags,
+	}
+}
+
+// NewContext returns ctx with trace context.
+func NewContext(ctx context.Context, c Context) context.Context {
+	return context.WithValue(ctx, ctxKey{}, c)
+}
+
+// FromContext returns trace context from ctx.
+func FromContext(ctx context.Context) (Context, bool) {
+	if ctx == nil {
+		return Context{}, false
+	}
+	c, ok := ctx.Value(ctxKey{}).(Context)
+	return c, ok
+}
+
+// FromHeaders returns trace context from the headers.
+func FromHeaders(h map[string]string) (Context, bool) {
+	if h == nil {
+		return Context{}, false
+	}
+	return Parse(h[Header])
+}
+
+// Inject returns copy of the headers with trace context from ctx.
+// Original headers map is not changed, returns h if there is no trace in ctx.
+func Inject(ctx context.Context, h map[string]string) map[string]string {
+	c, ok := FromContext(ctx)
+	if !ok {
+		return h
+	}
+	return c.Headers(h)
+}
+
+// Headers returns copy of h with traceparent header set to c.
+func (c Context) Headers(h map[string]string) map[string]string {
+	hh := make(map[string]string, len(h)+1)
+	for k, v := range h {
+		hh[k] = v
+	}
+	hh[Header] = c.String()
+	return hh
+}
+
+// Continue returns ctx with the child of the trace found in the headers,
+// or with the new trace if there is no valid trace in headers.
+func Continue(ctx context.Context, h map[string]string) context.Context {
+	if c, ok := FromHeaders(h); ok {
+		return NewContext(ctx, c.Child())
+	}
+	return NewContext(ctx, New())
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func isHex(s string, l int) bool {
+	if len(s) != l {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
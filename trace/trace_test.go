@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/minus5/svckit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	c, ok := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", c.SpanID)
+	assert.True(t, c.Sampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", c.String())
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, ok := Parse(s)
+		assert.False(t, ok, s)
+	}
+	// future versions can have more fields
+	_, ok = Parse("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+}
+
+func TestPropagation(t *testing.T) {
+	root := New()
+	assert.True(t, root.Valid())
+	h := map[string]string{"foo": "bar"}
+	h2 := Inject(NewContext(context.Background(), root), h)
+	assert.Len(t, h, 1)
+	assert.Equal(t, root.String(), h2[Header])
+	assert.Equal(t, "bar", h2["foo"])
+
+	ctx := Continue(context.Background(), h2)
+	c, ok := FromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, root.TraceID, c.TraceID)
+	assert.Equal(t, root.SpanID, c.ParentID)
+	assert.NotEqual(t, root.SpanID, c.SpanID)
+
+	// new trace when there is nothing to continue
+	c2, ok := FromContext(Continue(context.Background(), nil))
+	require.True(t, ok)
+	assert.NotEqual(t, root.TraceID, c2.TraceID)
+
+	assert.Nil(t, Inject(context.Background(), nil))
+}
+
+type testRecorder struct {
+	spans []*Span
+}
+
+func (r *testRecorder) Record(s *Span) {
+	r.spans = append(r.spans, s)
+}
+
+func TestSpan(t *testing.T) {
+	r := &testRecorder{}
+	SetRecorder(r)
+	defer SetRecorder(LogRecorder{})
+
+	ctx, parent := StartSpan(context.Background(), "request")
+	_, child := StartSpan(ctx, "db")
+	child.SetAttr("table", "users")
+	child.End()
+	parent.End()
+
+	require.Len(t, r.spans, 2)
+	assert.Equal(t, "db", r.spans[0].Name)
+	assert.Equal(t, parent.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, parent.Context.SpanID, child.Context.ParentID)
+	assert.Equal(t, "users", child.Attrs["table"])
+}
+
+func TestLogHook(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	log.SetOutput(buf)
+	defer log.Discard()
+
+	c := New()
+	log.Ctx(NewContext(context.Background(), c)).Info("msg")
+	line := buf.String()
+	assert.True(t, strings.Contains(line, `"traceId":"`+c.TraceID+`"`), line)
+	assert.True(t, strings.Contains(line, `"spanId":"`+c.SpanID+`"`), line)
+}